@@ -2,6 +2,9 @@ package main
 
 import (
 	"context"
+	"os"
+	"path/filepath"
+	"strconv"
 
 	"bittorrent/pkg/client"
 	"bittorrent/pkg/files"
@@ -22,8 +25,15 @@ func NewApp() *App {
 	
 	// start seeder stack
 	a.seederStack = &Torrent.SeederStack{}
+	a.seederStack.SetAnnouncer(client.Announcer{}) // Keep announcing everything we seed to its trackers
 	go a.seederStack.Listen(6881, 10) // Start listening on port 6881 with 10 retries
 
+	// Serve Prometheus metrics only when BITTORRENT_METRICS_PORT is set
+	metricsPort, err := strconv.Atoi(os.Getenv("BITTORRENT_METRICS_PORT"))
+	if err == nil && metricsPort != 0 {
+		go a.seederStack.ServeMetrics(metricsPort)
+	}
+
 	return &a
 }
 
@@ -33,6 +43,11 @@ func (a *App) startup(ctx context.Context) {
 	a.ctx = ctx
 }
 
+// shutdown is called when the app closes, so the trackers hear that we stopped seeding
+func (a *App) shutdown(ctx context.Context) {
+	a.seederStack.StopAll()
+}
+
 // SelectTorrentFile opens a file dialog, allowing only .torrent files and returns the selected file path
 func (a *App) SelectTorrentFile() (*backend.FileInfo, error) {
     return backend.SelectTorrentFile(a.ctx)
@@ -43,6 +58,11 @@ func (a *App) SelectAnyFile() (*backend.FileInfo, error) {
     return backend.SelectAnyFile(a.ctx)
 }
 
+// SelectDirectory opens a directory dialog, used to upload a whole folder as a multi-file torrent
+func (a *App) SelectDirectory() (*backend.FileInfo, error) {
+	return backend.SelectDirectory(a.ctx)
+}
+
 // ReadFile reads a file and returns the file data
 func (a *App) ReadFileToBytes(path string) ([]byte, error) {
 	return backend.ReadFileToBytes(path)
@@ -62,20 +82,42 @@ func (a *App) SendTrackerRequest(torrent Torrent.Torrent, peerId string) ([]trac
 	return client.SendTrackerRequest(torrent, peerId)
 }
 
+// Scrape asks the torrent's trackers how many seeders and leechers it has, without joining the swarm
+func (a *App) Scrape(torrent Torrent.Torrent) (client.ScrapeStats, error) {
+	return client.Scrape(torrent)
+}
+
 func (a *App) HashInfo(torrent Torrent.Torrent) ([]byte, error) {
 	return torrent.HashInfo()
 }
 
-func (a *App) DownloadFromSeeders(peers []trackingserver.Peer, torrent Torrent.Torrent, totalPieces uint32) ([]byte, error) {
-	return Torrent.DownloadFromSeeders(peers, torrent, totalPieces)
+// DownloadFromSeeders downloads the torrent straight to disk at savePath and returns where it ended up.
+// The pieces we already have are served to other peers while the download runs.
+func (a *App) DownloadFromSeeders(peers []trackingserver.Peer, torrent Torrent.Torrent, savePath string, peerId string) (string, error) {
+	return Torrent.DownloadFromSeeders(a.seederStack, peers, torrent, savePath, peerId, Torrent.DownloadOptions{})
+}
+
+// SelectSavePath asks where a torrent should be downloaded to, a file for single-file torrents and a folder for multi-file ones
+func (a *App) SelectSavePath(torrent Torrent.Torrent) (string, error) {
+	if !torrent.Info.IsMultiFile() {
+		return backend.SelectSavePath(a.ctx, torrent.Info.Name)
+	}
+
+	dir, err := backend.SelectDirectory(a.ctx)
+	if err != nil || dir == nil {
+		return "", err
+	}
+	return filepath.Join(dir.Path, torrent.Info.Name), nil
 }
 
 func (a *App) GeneratePeerID() string {
 	return client.GeneratePeerID()
 }
 
-func (a *App) CreateTorrentFile(filePath string) ([]byte, error) {
-	return Torrent.CreateTorrentFile(a.seederStack, filePath, client.GeneratePeerID()) // Every torrent file has new peerId which is wrong
+// CreateTorrentFile creates a torrent for a file or folder, a pieceLength of 0 picks one automatically.
+// announceList holds tiers of extra trackers, and can be empty unless the torrent is private.
+func (a *App) CreateTorrentFile(filePath string, pieceLength int, announceList [][]string, private bool) ([]byte, error) {
+	return Torrent.CreateTorrentFile(a.seederStack, filePath, client.GeneratePeerID(), pieceLength, announceList, private) // Every torrent file has new peerId which is wrong
 }
 
 func (a *App) SaveFileFromBytes(data []byte, defaultFileName string, displayName string, pattern string) error {
@@ -5,24 +5,39 @@ import {
     SelectTorrentFile, 
     UnmarshalTorrent,
     SelectAnyFile,
+    SelectDirectory,
+    SelectSavePath,
     SendTrackerRequest, 
+    Scrape,
     DownloadFromSeeders, 
     GeneratePeerID,
     CreateTorrentFile,
     SaveFileFromBytes,
 } from "../../../wailsjs/go/main/App";
 import { useState } from "react";
+import { client } from "../../../wailsjs/go/models";
 
 type File = {
     bytes: number[];
     name: string;
 }
 
+// One tracker per line, with a blank line between tiers
+const parseTiers = (text: string): string[][] => {
+    return text
+        .split(/\n\s*\n/)
+        .map(tier => tier.split("\n").map(tracker => tracker.trim()).filter(tracker => tracker !== ""))
+        .filter(tier => tier.length > 0);
+}
+
 export default function FileSelect({ tab }: { tab: Tab }) {
     const [uploadedFile, setUploadedFile] = useState<File | null>(null); // used for uploading
-    const [downloadedFile, setDownloadedFile] = useState<File | null>(null); // used for downloading
+    const [downloadedPath, setDownloadedPath] = useState<string | null>(null); // used for downloading, the file is already on disk
+    const [trackers, setTrackers] = useState<string>(""); // used for uploading, extra trackers for the announce-list
+    const [privateTorrent, setPrivateTorrent] = useState<boolean>(false); // used for uploading, only share through the trackers above
+    const [swarm, setSwarm] = useState<client.ScrapeStats | null>(null); // used for downloading, how healthy the swarm is
 
-    const handleFileSelect = async () => {
+    const handleFileSelect = async (directory: boolean = false) => {
         if (tab === "Download") {
             // Parse torrent file
             const file = await SelectTorrentFile();
@@ -30,8 +45,12 @@ export default function FileSelect({ tab }: { tab: Tab }) {
             const torrent = await UnmarshalTorrent(bytes);
             console.log("torrent:", torrent);
 
-            const totalPieces = Math.ceil((torrent.Info.Length + torrent.Info.PieceLength - 1) / torrent.Info.PieceLength);
-            console.log("totalPieces:", totalPieces);
+            // Show how many peers there are before starting, the download works without it
+            Scrape(torrent).then(setSwarm).catch((err) => console.log("scrape failed:", err));
+
+            // Pick where the download goes before starting, pieces are written straight to disk
+            const savePath = await SelectSavePath(torrent);
+            if (!savePath) return;
 
             const peerId = await GeneratePeerID(); // I dont like how this is frontend
 
@@ -40,38 +59,54 @@ export default function FileSelect({ tab }: { tab: Tab }) {
             console.log("peers:", peers);
 
             // Start downloading file from peers
-            const downloadedBytes = await DownloadFromSeeders(peers, torrent, totalPieces);
-            setDownloadedFile({ bytes: downloadedBytes, name: torrent.Info.Name });
+            const path = await DownloadFromSeeders(peers, torrent, savePath, peerId);
+            setDownloadedPath(path);
 
 
         } else if (tab === "Upload" ) { // tab === "upload"
-            const file = await SelectAnyFile();
-            const torrentBytes = await CreateTorrentFile(file.Path);
+            const file = directory ? await SelectDirectory() : await SelectAnyFile();
+            const torrentBytes = await CreateTorrentFile(file.Path, 0, parseTiers(trackers), privateTorrent); // 0 lets the backend pick a piece length
             setUploadedFile({ bytes: torrentBytes, name: file.Name });
         }
     }
 
-    const handleDownload = async (tab: Tab) => {
-        if (tab === "Upload") {
-            // Save Torrent File
-            if (!uploadedFile) return;
-            await SaveFileFromBytes(uploadedFile!.bytes, uploadedFile!.name, "Torrent Files", "*.torrent");
-        } else if (tab === "Download") {
-            // Save File
-            if (!downloadedFile) return
-            await SaveFileFromBytes(downloadedFile!.bytes, downloadedFile!.name, "Downloaded Files", "*.*");
-        }
+    const handleDownload = async () => {
+        // Save Torrent File
+        if (!uploadedFile) return;
+        await SaveFileFromBytes(uploadedFile!.bytes, uploadedFile!.name, "Torrent Files", "*.torrent");
     };
 
     return (
         <div>
-            {((tab === "Download" && !downloadedFile) || (tab === "Upload" && !uploadedFile)) && <button className="button-1" onClick={() => handleFileSelect()}>Select File</button>}
+            {((tab === "Download" && !downloadedPath) || (tab === "Upload" && !uploadedFile)) && <button className="button-1" onClick={() => handleFileSelect()}>Select File</button>}
+            {(tab === "Upload" && !uploadedFile) && <button className="button-1" onClick={() => handleFileSelect(true)}>Select Folder</button>}
+            {(tab === "Upload" && !uploadedFile) &&
+                <textarea
+                    className="trackers"
+                    placeholder={"Extra trackers, one per line\nLeave a blank line between tiers"}
+                    value={trackers}
+                    onChange={(e) => setTrackers(e.target.value)}
+                />
+            }
+            {(tab === "Upload" && !uploadedFile) &&
+                <label className="private">
+                    <input
+                        type="checkbox"
+                        checked={privateTorrent}
+                        onChange={(e) => setPrivateTorrent(e.target.checked)}
+                    />
+                    Private torrent, the trackers above need your passkey
+                </label>
+            }
             {(tab === "Upload" && uploadedFile) &&
-                <button className="button-1 button-download" onClick={() => handleDownload("Upload")}>Download Torrent File</button>
+                <button className="button-1 button-download" onClick={() => handleDownload()}>Download Torrent File</button>
             }
-            {(tab === "Download" && downloadedFile) && 
-                <button className="button-1 button-download" onClick={() => handleDownload("Download")}>Download File</button>
+            {(tab === "Download" && swarm) &&
+                <p>{swarm.Seeders} seeders, {swarm.Leechers} leechers, downloaded {swarm.Completed} times</p>
+            }
+            {(tab === "Download" && downloadedPath) && 
+                <p>Downloaded to {downloadedPath}</p>
             }
         </div>
     )
-}
\ No newline at end of file
+}
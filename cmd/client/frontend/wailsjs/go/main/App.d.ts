@@ -3,10 +3,11 @@
 import {trackingserver} from '../models';
 import {torrent} from '../models';
 import {backend} from '../models';
+import {client} from '../models';
 
-export function CreateTorrentFile(arg1:string):Promise<Array<number>>;
+export function CreateTorrentFile(arg1:string,arg2:number,arg3:Array<Array<string>>,arg4:boolean):Promise<Array<number>>;
 
-export function DownloadFromSeeders(arg1:Array<trackingserver.Peer>,arg2:torrent.Torrent,arg3:number):Promise<Array<number>>;
+export function DownloadFromSeeders(arg1:Array<trackingserver.Peer>,arg2:torrent.Torrent,arg3:string,arg4:string):Promise<string>;
 
 export function GeneratePeerID():Promise<string>;
 
@@ -16,8 +17,14 @@ export function ReadFileToBytes(arg1:string):Promise<Array<number>>;
 
 export function SaveFileFromBytes(arg1:Array<number>,arg2:string,arg3:string,arg4:string):Promise<void>;
 
+export function Scrape(arg1:torrent.Torrent):Promise<client.ScrapeStats>;
+
 export function SelectAnyFile():Promise<backend.FileInfo>;
 
+export function SelectDirectory():Promise<backend.FileInfo>;
+
+export function SelectSavePath(arg1:torrent.Torrent):Promise<string>;
+
 export function SelectTorrentFile():Promise<backend.FileInfo>;
 
 export function SendTrackerRequest(arg1:torrent.Torrent,arg2:string):Promise<Array<trackingserver.Peer>>;
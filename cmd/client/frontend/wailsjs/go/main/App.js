@@ -2,12 +2,12 @@
 // Cynhyrchwyd y ffeil hon yn awtomatig. PEIDIWCH Â MODIWL
 // This file is automatically generated. DO NOT EDIT
 
-export function CreateTorrentFile(arg1) {
-  return window['go']['main']['App']['CreateTorrentFile'](arg1);
+export function CreateTorrentFile(arg1, arg2, arg3, arg4) {
+  return window['go']['main']['App']['CreateTorrentFile'](arg1, arg2, arg3, arg4);
 }
 
-export function DownloadFromSeeders(arg1, arg2, arg3) {
-  return window['go']['main']['App']['DownloadFromSeeders'](arg1, arg2, arg3);
+export function DownloadFromSeeders(arg1, arg2, arg3, arg4) {
+  return window['go']['main']['App']['DownloadFromSeeders'](arg1, arg2, arg3, arg4);
 }
 
 export function GeneratePeerID() {
@@ -26,10 +26,22 @@ export function SaveFileFromBytes(arg1, arg2, arg3, arg4) {
   return window['go']['main']['App']['SaveFileFromBytes'](arg1, arg2, arg3, arg4);
 }
 
+export function Scrape(arg1) {
+  return window['go']['main']['App']['Scrape'](arg1);
+}
+
 export function SelectAnyFile() {
   return window['go']['main']['App']['SelectAnyFile']();
 }
 
+export function SelectDirectory() {
+  return window['go']['main']['App']['SelectDirectory']();
+}
+
+export function SelectSavePath(arg1) {
+  return window['go']['main']['App']['SelectSavePath'](arg1);
+}
+
 export function SelectTorrentFile() {
   return window['go']['main']['App']['SelectTorrentFile']();
 }
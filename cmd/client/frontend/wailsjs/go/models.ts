@@ -44,13 +44,50 @@ export namespace backend {
 
 }
 
+export namespace client {
+	
+	export class ScrapeStats {
+	    Seeders: number;
+	    Completed: number;
+	    Leechers: number;
+	
+	    static createFrom(source: any = {}) {
+	        return new ScrapeStats(source);
+	    }
+	
+	    constructor(source: any = {}) {
+	        if ('string' === typeof source) source = JSON.parse(source);
+	        this.Seeders = source["Seeders"];
+	        this.Completed = source["Completed"];
+	        this.Leechers = source["Leechers"];
+	    }
+	}
+
+}
+
 export namespace torrent {
 	
+	export class TorrentFile {
+	    Length: number;
+	    Path: string[];
+	
+	    static createFrom(source: any = {}) {
+	        return new TorrentFile(source);
+	    }
+	
+	    constructor(source: any = {}) {
+	        if ('string' === typeof source) source = JSON.parse(source);
+	        this.Length = source["Length"];
+	        this.Path = source["Path"];
+	    }
+	}
 	export class TorrentInfo {
 	    Name: string;
 	    Length: number;
+	    Files: TorrentFile[];
 	    PieceLength: number;
 	    Pieces: number[];
+	    Private: number;
 	
 	    static createFrom(source: any = {}) {
 	        return new TorrentInfo(source);
@@ -60,13 +97,35 @@ export namespace torrent {
 	        if ('string' === typeof source) source = JSON.parse(source);
 	        this.Name = source["Name"];
 	        this.Length = source["Length"];
+	        this.Files = this.convertValues(source["Files"], TorrentFile);
 	        this.PieceLength = source["PieceLength"];
 	        this.Pieces = source["Pieces"];
+	        this.Private = source["Private"];
 	    }
+	
+		convertValues(a: any, classs: any, asMap: boolean = false): any {
+		    if (!a) {
+		        return a;
+		    }
+		    if (a.slice && a.map) {
+		        return (a as any[]).map(elem => this.convertValues(elem, classs));
+		    } else if ("object" === typeof a) {
+		        if (asMap) {
+		            for (const key of Object.keys(a)) {
+		                a[key] = new classs(a[key]);
+		            }
+		            return a;
+		        }
+		        return new classs(a);
+		    }
+		    return a;
+		}
 	}
 	export class Torrent {
 	    Announce: string;
+	    AnnounceList: string[][];
 	    Info: TorrentInfo;
+	    RawInfo: number[];
 	
 	    static createFrom(source: any = {}) {
 	        return new Torrent(source);
@@ -75,7 +134,9 @@ export namespace torrent {
 	    constructor(source: any = {}) {
 	        if ('string' === typeof source) source = JSON.parse(source);
 	        this.Announce = source["Announce"];
+	        this.AnnounceList = source["AnnounceList"];
 	        this.Info = this.convertValues(source["Info"], TorrentInfo);
+	        this.RawInfo = source["RawInfo"];
 	    }
 	
 		convertValues(a: any, classs: any, asMap: boolean = false): any {
@@ -108,6 +169,9 @@ export namespace trackingserver {
 	    Port: number;
 	    // Go type: time
 	    LastAnnounce: any;
+	    Uploaded: number;
+	    Downloaded: number;
+	    Left: number;
 	
 	    static createFrom(source: any = {}) {
 	        return new Peer(source);
@@ -120,6 +184,9 @@ export namespace trackingserver {
 	        this.IP = source["IP"];
 	        this.Port = source["Port"];
 	        this.LastAnnounce = this.convertValues(source["LastAnnounce"], null);
+	        this.Uploaded = source["Uploaded"];
+	        this.Downloaded = source["Downloaded"];
+	        this.Left = source["Left"];
 	    }
 	
 		convertValues(a: any, classs: any, asMap: boolean = false): any {
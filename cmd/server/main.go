@@ -3,14 +3,61 @@ package main
 import (
 	TrackingServer "bittorrent/pkg/trackingserver"
 	"bufio"
+	"flag"
 	"fmt"
 	"os"
 	"strings"
 )
 
 func main() {
-	tracker := TrackingServer.NewTracker()
+	udpPort := flag.Int("udp-port", 6969, "port to answer UDP tracker requests on, 0 to turn UDP off")
+	statePath := flag.String("state", "tracker-state.log", "file to keep the peers in across restarts, empty to only keep them in memory")
+	adminPort := flag.Int("admin-port", 0, "port to serve the admin API on, 0 to turn it off")
+	adminToken := flag.String("admin-token", os.Getenv("TRACKER_ADMIN_TOKEN"), "bearer token the admin API asks for, defaults to $TRACKER_ADMIN_TOKEN")
+	registryPath := flag.String("private", "", "registry of users and torrents for a private tracker, empty for a public tracker")
+	flag.Parse()
+
+	var tracker *TrackingServer.Tracker
+	if *statePath == "" {
+		tracker = TrackingServer.NewTracker()
+	} else {
+		store, err := TrackingServer.OpenFileStore(*statePath)
+		if err != nil {
+			fmt.Println("Error opening tracker state:", err)
+			os.Exit(1)
+		}
+		defer store.Close()
+
+		tracker, err = TrackingServer.NewTrackerWithStore(store)
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+	}
+
+	var registry *TrackingServer.Registry
+	if *registryPath != "" {
+		var err error
+		registry, err = TrackingServer.LoadRegistry(*registryPath)
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		defer registry.Save()
+		tracker.SetRegistry(registry)
+	}
+
 	go tracker.Listen()
+	if *udpPort != 0 {
+		go tracker.ListenUDP(*udpPort)
+	}
+	if *adminPort != 0 {
+		if *adminToken == "" {
+			fmt.Println("The admin API needs a token, set -admin-token or TRACKER_ADMIN_TOKEN")
+			os.Exit(1)
+		}
+		go tracker.ListenAdmin(*adminPort, *adminToken)
+	}
 
 	// repl
 	reader := bufio.NewReader(os.Stdin)
@@ -22,11 +69,16 @@ func main() {
 		}
 
 		input = strings.TrimSpace(input)
-		switch input {
+		command, arg, _ := strings.Cut(input, " ")
+		arg = strings.TrimSpace(arg)
+		switch command {
 		case "help":
 			fmt.Println("Commands:")
 			fmt.Println("  help - display this message")
 			fmt.Println("  lp - display the list of peers")
+			fmt.Println("  users - display the users of a private tracker and their totals")
+			fmt.Println("  adduser <name> - add a user to a private tracker and print their passkey")
+			fmt.Println("  register <info_hash> - let a private tracker track a torrent, given as hex")
 			fmt.Println("  exit - exit the program")
 		case "lp":
 			peersMap := tracker.GetPeers()
@@ -37,9 +89,44 @@ func main() {
 					fmt.Print("    ", peer.IP, ":", peer.Port, "\n")
 				}
 			}
+		case "users":
+			if registry == nil {
+				fmt.Println("Not a private tracker, start with -private to use users")
+				continue
+			}
+			fmt.Println("Users:")
+			for _, user := range registry.ListUsers() {
+				fmt.Println("  ", user.Name, user.Passkey, "uploaded:", user.Uploaded, "downloaded:", user.Downloaded)
+			}
+		case "adduser":
+			if registry == nil {
+				fmt.Println("Not a private tracker, start with -private to use users")
+				continue
+			}
+			if arg == "" {
+				fmt.Println("Usage: adduser <name>")
+				continue
+			}
+			user, err := registry.AddUser(arg)
+			if err != nil {
+				fmt.Println(err)
+				continue
+			}
+			fmt.Println("Added", user.Name, "announce with /announce/"+user.Passkey)
+		case "register":
+			if registry == nil {
+				fmt.Println("Not a private tracker, start with -private to register torrents")
+				continue
+			}
+			err := registry.RegisterTorrent(arg)
+			if err != nil {
+				fmt.Println(err)
+				continue
+			}
+			fmt.Println("Registered", arg)
 		case "exit":
 			fmt.Println("Exiting...")
-			os.Exit(0)
+			return
 		default:
 			fmt.Println("Unknown command. Type 'help' for a list of commands.")
 		}
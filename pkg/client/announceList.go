@@ -0,0 +1,58 @@
+package client
+
+import (
+	"encoding/hex"
+	"math/rand"
+	"sync"
+)
+
+// The order of the trackers in every tier is kept for as long as the client runs. BEP 12 has each tier shuffled
+// once, and a tracker that responds gets moved to the front of its tier so it is tried first next time.
+var announceTiers = struct {
+	mtx   sync.Mutex
+	tiers map[string][][]string // Keyed by hex info_hash
+}{tiers: make(map[string][][]string)}
+
+// trackerTiers returns the tiers of trackers for a torrent in the order to try them, shuffling them the first time
+func trackerTiers(infoHash []byte, tiers [][]string) [][]string {
+	key := hex.EncodeToString(infoHash)
+
+	announceTiers.mtx.Lock()
+	defer announceTiers.mtx.Unlock()
+
+	ordered, ok := announceTiers.tiers[key]
+	if !ok {
+		ordered = make([][]string, len(tiers))
+		for i, tier := range tiers {
+			ordered[i] = append([]string{}, tier...)
+			rand.Shuffle(len(ordered[i]), func(a, b int) {
+				ordered[i][a], ordered[i][b] = ordered[i][b], ordered[i][a]
+			})
+		}
+		announceTiers.tiers[key] = ordered
+	}
+
+	// Hand out a copy so promoting a tracker doesn't reorder a tier that is still being tried
+	tiersCopy := make([][]string, len(ordered))
+	for i, tier := range ordered {
+		tiersCopy[i] = append([]string{}, tier...)
+	}
+	return tiersCopy
+}
+
+// promoteTracker moves a tracker that responded to the front of its tier
+func promoteTracker(infoHash []byte, tierIndex int, trackerIndex int) {
+	key := hex.EncodeToString(infoHash)
+
+	announceTiers.mtx.Lock()
+	defer announceTiers.mtx.Unlock()
+
+	tiers := announceTiers.tiers[key]
+	if tierIndex >= len(tiers) || trackerIndex >= len(tiers[tierIndex]) {
+		return
+	}
+	tier := tiers[tierIndex]
+	tracker := tier[trackerIndex]
+	copy(tier[1:trackerIndex+1], tier[:trackerIndex])
+	tier[0] = tracker
+}
@@ -0,0 +1,197 @@
+package client
+
+import (
+	"bittorrent/pkg/torrent"
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"slices"
+	"sync/atomic"
+	"testing"
+)
+
+// fakeTracker is an HTTP tracker that either answers every announce or refuses it, counting the announces it gets
+type fakeTracker struct {
+	url       string
+	announces atomic.Int32
+}
+
+// startFakeTracker starts a fake tracker that is closed once the test is over
+func startFakeTracker(t *testing.T, working bool) *fakeTracker {
+	t.Helper()
+
+	tracker := &fakeTracker{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		tracker.announces.Add(1)
+		if working {
+			w.Write([]byte("d8:intervali60e5:peers0:e"))
+		} else {
+			w.Write([]byte("d14:failure reason4:downe"))
+		}
+	}))
+	t.Cleanup(server.Close)
+	tracker.url = server.URL + "/announce"
+	return tracker
+}
+
+// testInfoHash gives every test its own info_hash, since the tier order is kept for as long as the package runs
+func testInfoHash(name string) []byte {
+	hash := sha1.Sum([]byte(name))
+	return hash[:]
+}
+
+func TestTrackerTiers(t *testing.T) {
+	tiers := [][]string{{"a", "b", "c", "d", "e"}, {"f"}, {"g", "h"}}
+
+	t.Run("tiers keep their order and trackers", func(t *testing.T) {
+		got := trackerTiers(testInfoHash(t.Name()), tiers)
+		if len(got) != len(tiers) {
+			t.Fatalf("trackerTiers() returned %d tiers, want %d", len(got), len(tiers))
+		}
+		for i := range tiers {
+			sorted := slices.Sorted(slices.Values(got[i]))
+			if !reflect.DeepEqual(sorted, tiers[i]) {
+				t.Errorf("tier %d = %v, want the trackers %v in any order", i, got[i], tiers[i])
+			}
+		}
+	})
+
+	t.Run("shuffled once", func(t *testing.T) {
+		infoHash := testInfoHash(t.Name())
+		want := trackerTiers(infoHash, tiers)
+
+		// Changing the tiers that were handed out doesn't change the order that is kept
+		trackerTiers(infoHash, tiers)[0][0] = "changed"
+
+		for i := 0; i < 10; i++ {
+			got := trackerTiers(infoHash, tiers)
+			if !reflect.DeepEqual(got, want) {
+				t.Fatalf("trackerTiers() = %v, want %v every time", got, want)
+			}
+		}
+	})
+
+	t.Run("shuffled differently for each torrent", func(t *testing.T) {
+		// A tier of five comes out in its original order one time in 120, so twenty torrents all
+		// keeping it would mean the tiers aren't shuffled
+		for i := 0; i < 20; i++ {
+			got := trackerTiers(testInfoHash(fmt.Sprintf("%s %d", t.Name(), i)), tiers)
+			if !reflect.DeepEqual(got[0], tiers[0]) {
+				return
+			}
+		}
+		t.Error("trackerTiers() never shuffled the first tier")
+	})
+
+	t.Run("promoting a tracker out of range", func(t *testing.T) {
+		infoHash := testInfoHash(t.Name())
+		want := trackerTiers(infoHash, tiers)
+		promoteTracker(infoHash, 3, 0)
+		promoteTracker(infoHash, 1, 1)
+		promoteTracker(testInfoHash("unknown torrent"), 0, 0)
+		if got := trackerTiers(infoHash, tiers); !reflect.DeepEqual(got, want) {
+			t.Errorf("trackerTiers() = %v, want %v unchanged", got, want)
+		}
+	})
+}
+
+func TestAnnounceToTiersPromotion(t *testing.T) {
+	tests := []struct {
+		name      string
+		working   [][]bool // Which trackers of every tier respond, in the order they are tried
+		wantOrder [][]int  // The trackers of every tier in the order they are tried after announcing
+		wantHits  [][]int  // Announces every tracker gets over two announces
+		wantErr   bool
+	}{
+		{
+			name:      "first tracker fails",
+			working:   [][]bool{{false, true}},
+			wantOrder: [][]int{{1, 0}},
+			wantHits:  [][]int{{1, 2}},
+		},
+		{
+			name:      "a later tracker responds",
+			working:   [][]bool{{false, false, true, true}},
+			wantOrder: [][]int{{2, 0, 1, 3}},
+			wantHits:  [][]int{{1, 1, 2, 0}},
+		},
+		{
+			name:      "first tracker responds",
+			working:   [][]bool{{true, false}},
+			wantOrder: [][]int{{0, 1}},
+			wantHits:  [][]int{{2, 0}},
+		},
+		{
+			name:      "tier without a working tracker",
+			working:   [][]bool{{false, false}, {false, true}},
+			wantOrder: [][]int{{0, 1}, {1, 0}},
+			wantHits:  [][]int{{2, 2}, {1, 2}},
+		},
+		{
+			name:      "no tracker responds",
+			working:   [][]bool{{false}, {false, false}},
+			wantOrder: [][]int{{0}, {0, 1}},
+			wantHits:  [][]int{{2}, {2, 2}},
+			wantErr:   true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			infoHash := testInfoHash(t.Name())
+			trackers := [][]*fakeTracker{}
+			tiers := [][]string{}
+			for _, working := range test.working {
+				tierTrackers := []*fakeTracker{}
+				tier := []string{}
+				for _, w := range working {
+					tracker := startFakeTracker(t, w)
+					tierTrackers = append(tierTrackers, tracker)
+					tier = append(tier, tracker.url)
+				}
+				trackers = append(trackers, tierTrackers)
+				tiers = append(tiers, tier)
+			}
+
+			// Keep the tiers in the order they were given instead of shuffling them
+			ordered := [][]string{}
+			for _, tier := range tiers {
+				ordered = append(ordered, append([]string{}, tier...))
+			}
+			announceTiers.mtx.Lock()
+			announceTiers.tiers[hex.EncodeToString(infoHash)] = ordered
+			announceTiers.mtx.Unlock()
+
+			announce := torrent.TrackerAnnounce{Trackers: tiers, InfoHash: infoHash, PeerID: "-TEST-peer-000000001", Port: 6881}
+			_, _, err := announceToTiers(announce)
+			if (err != nil) != test.wantErr {
+				t.Fatalf("announceToTiers() error = %v, wantErr %v", err, test.wantErr)
+			}
+
+			wantOrder := [][]string{}
+			for i, order := range test.wantOrder {
+				tier := []string{}
+				for _, j := range order {
+					tier = append(tier, trackers[i][j].url)
+				}
+				wantOrder = append(wantOrder, tier)
+			}
+			if got := trackerTiers(infoHash, tiers); !reflect.DeepEqual(got, wantOrder) {
+				t.Errorf("tiers after announcing = %v, want %v", got, wantOrder)
+			}
+
+			// The next announce goes to the promoted trackers first
+			announceToTiers(announce)
+			for i, tier := range trackers {
+				for j, tracker := range tier {
+					if hits := int(tracker.announces.Load()); hits != test.wantHits[i][j] {
+						t.Errorf("tracker %d of tier %d got %d announces, want %d", j, i, hits, test.wantHits[i][j])
+					}
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,130 @@
+package client
+
+import (
+	"bittorrent/pkg/torrent"
+	TrackingServer "bittorrent/pkg/trackingserver"
+	"bytes"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/zeebo/bencode"
+)
+
+// Scrape asks the torrent's trackers how many seeders and leechers it has, without announcing to them.
+// Trackers are tried in the same order as announces, and the first one that answers wins.
+func Scrape(t torrent.Torrent) (ScrapeStats, error) {
+	infoHash, err := t.HashInfo()
+	if err != nil {
+		return ScrapeStats{}, fmt.Errorf("error hashing info dictionary: %v", err)
+	}
+
+	var lastErr error = fmt.Errorf("torrent has no trackers")
+	for _, tier := range trackerTiers(infoHash, t.Trackers()) {
+		for _, trackerURL := range tier {
+			stats, err := scrapeTracker(trackerURL, [][]byte{infoHash})
+			if err != nil {
+				log.Printf("Scraping %s failed: %v", trackerURL, err)
+				lastErr = err
+				continue
+			}
+			return stats[0], nil
+		}
+	}
+
+	return ScrapeStats{}, fmt.Errorf("no tracker could be scraped: %v", lastErr)
+}
+
+// scrapeTracker scrapes a single tracker, which can be either UDP or HTTP
+func scrapeTracker(trackerURL string, infoHashes [][]byte) ([]ScrapeStats, error) {
+	if strings.HasPrefix(trackerURL, "http") {
+		scrape, err := scrapeURL(trackerURL)
+		if err != nil {
+			return nil, err
+		}
+		return sendHTTPScrapeRequest(scrape, infoHashes)
+	} else if strings.HasPrefix(trackerURL, "udp") {
+		return sendUDPScrapeRequest(trackerURL, infoHashes)
+	} else {
+		return nil, fmt.Errorf("unsupported tracker protocol")
+	}
+}
+
+// scrapeURL finds the scrape URL of an HTTP tracker. By convention it is the announce URL with the
+// "announce" at the start of the last path segment replaced by "scrape", trackers without one can't be scraped.
+// Private trackers keep "announce" in the segment before the passkey instead.
+func scrapeURL(announce string) (string, error) {
+	u, err := url.Parse(announce)
+	if err != nil {
+		return "", fmt.Errorf("invalid tracker URL: %v", err)
+	}
+
+	dir, last := path.Split(u.Path)
+	if strings.HasPrefix(last, "announce") {
+		u.Path = dir + "scrape" + strings.TrimPrefix(last, "announce")
+		return u.String(), nil
+	}
+
+	// Private trackers put the passkey after it, /announce/<passkey> scrapes at /scrape/<passkey>
+	parent, second := path.Split(strings.TrimSuffix(dir, "/"))
+	if second == "announce" && last != "" {
+		u.Path = parent + "scrape/" + last
+		return u.String(), nil
+	}
+	return "", fmt.Errorf("tracker %s doesn't support scraping", announce)
+}
+
+// sendHTTPScrapeRequest asks an HTTP tracker for the counts of several torrents at once.
+// Torrents the tracker doesn't know about come back as all zeros.
+func sendHTTPScrapeRequest(scrape string, infoHashes [][]byte) ([]ScrapeStats, error) {
+	// Every info_hash is its own parameter
+	params := []string{}
+	for _, infoHash := range infoHashes {
+		params = append(params, "info_hash="+URLEncodeBytes(infoHash))
+	}
+
+	// The scrape URL may already have a query of its own
+	separator := "?"
+	if strings.Contains(scrape, "?") {
+		separator = "&"
+	}
+	requestURL := scrape + separator + strings.Join(params, "&")
+
+	client := http.Client{Timeout: 10 * time.Second}
+	resp, err := client.Get(requestURL)
+	if err != nil {
+		return nil, fmt.Errorf("error sending scrape request: %v", err)
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("error reading scrape response: %v", err)
+	}
+
+	var scrapeResponse TrackingServer.ScrapeResponse
+	err = bencode.NewDecoder(bytes.NewReader(body)).Decode(&scrapeResponse)
+	if err != nil {
+		return nil, fmt.Errorf("error decoding scrape response: %v", err)
+	}
+
+	if scrapeResponse.FailureReason != "" {
+		return nil, fmt.Errorf("tracker refused scrape: %s", scrapeResponse.FailureReason)
+	}
+
+	stats := make([]ScrapeStats, len(infoHashes))
+	for i, infoHash := range infoHashes {
+		file := scrapeResponse.Files[string(infoHash)]
+		stats[i] = ScrapeStats{
+			Seeders:   file.Complete,
+			Completed: file.Downloaded,
+			Leechers:  file.Incomplete,
+		}
+	}
+	return stats, nil
+}
@@ -0,0 +1,36 @@
+package client
+
+import (
+	"testing"
+)
+
+func TestScrapeURL(t *testing.T) {
+	tests := []struct {
+		announce string
+		want     string
+		wantErr  bool
+	}{
+		{announce: "http://example.com/announce", want: "http://example.com/scrape"},
+		{announce: "http://example.com:8080/x/announce", want: "http://example.com:8080/x/scrape"},
+		{announce: "http://example.com/announce.php", want: "http://example.com/scrape.php"},
+		{announce: "http://example.com/announce?key=abc", want: "http://example.com/scrape?key=abc"},
+		{announce: "http://example.com/announce/0123abcd", want: "http://example.com/scrape/0123abcd"},
+		{announce: "https://example.com/t/announce/0123abcd", want: "https://example.com/t/scrape/0123abcd"},
+		{announce: "http://example.com/a", wantErr: true},
+		{announce: "http://example.com/x/announce/y/z", wantErr: true},
+		{announce: "http://example.com/announce/", wantErr: true},
+		{announce: "http://example.com/%zz", wantErr: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.announce, func(t *testing.T) {
+			got, err := scrapeURL(test.announce)
+			if (err != nil) != test.wantErr {
+				t.Fatalf("scrapeURL() error = %v, wantErr %v", err, test.wantErr)
+			}
+			if got != test.want {
+				t.Errorf("scrapeURL() = %q, want %q", got, test.want)
+			}
+		})
+	}
+}
@@ -8,8 +8,11 @@ import (
 	"crypto/rand"
 	"fmt"
 	"io"
+	"net"
 	"net/http"
 	"net/url"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/zeebo/bencode"
@@ -31,29 +34,86 @@ func GeneratePeerID() string {
 	return clientPrefix + fmt.Sprintf("%x", randomBytes)
 }
 
-// SendTrackerRequest sends a GET request to the tracker's announce URL.
-func SendTrackerRequest(torrent torrent.Torrent, peerId string) ([]TrackingServer.Peer, error) {
-	// Announce can be either UDP or HTTP
-	// We are going to ignore announce list for now
-	var trackerType string
-	if torrent.Announce[:4] == "http" {
-		trackerType = "http"
-	} else if torrent.Announce[:3] == "udp" {
-		trackerType = "udp"
-	} else {
-		return nil, fmt.Errorf("unsupported tracker protocol")
+// SendTrackerRequest tells the torrent's trackers that we are starting a download and returns every peer they know about
+func SendTrackerRequest(t torrent.Torrent, peerId string) ([]TrackingServer.Peer, error) {
+	infoHash, err := t.HashInfo()
+	if err != nil {
+		return nil, fmt.Errorf("error hashing info dictionary: %v", err)
 	}
 
-	if trackerType == "http" {
-		infoHash, err := torrent.HashInfo()
-		if err != nil {
-			return nil, fmt.Errorf("error hashing info dictionary: %v", err)
+	peers, _, err := announceToTiers(torrent.TrackerAnnounce{
+		Trackers: t.Trackers(),
+		InfoHash: infoHash,
+		PeerID:   peerId,
+		Port:     6881,
+		Event:    TrackingServer.STARTED,
+		Left:     t.Info.TotalLength(),
+	})
+	return peers, err
+}
+
+// Announcer sends the announces of a SeederStack to HTTP and UDP trackers
+type Announcer struct{}
+
+// Announce announces to the torrent's trackers and returns the shortest interval any of them asked for
+func (Announcer) Announce(announce torrent.TrackerAnnounce) (time.Duration, error) {
+	_, interval, err := announceToTiers(announce)
+	return interval, err
+}
+
+// announceToTiers announces to one tracker in every tier and merges the peers they return.
+// Tiers of the announce-list (BEP 12) are tried in order, and within a tier the trackers are tried until one responds.
+func announceToTiers(announce torrent.TrackerAnnounce) ([]TrackingServer.Peer, time.Duration, error) {
+	peers := []TrackingServer.Peer{}
+	seen := make(map[string]bool)
+	var interval time.Duration
+	responded := false
+	var lastErr error = fmt.Errorf("torrent has no trackers")
+
+	tiers := trackerTiers(announce.InfoHash, announce.Trackers)
+	for tierIndex, tier := range tiers {
+		for trackerIndex, trackerURL := range tier {
+			tierPeers, tierInterval, err := announceToTracker(trackerURL, announce)
+			if err != nil {
+				log.Printf("Tracker %s failed: %v", trackerURL, err)
+				lastErr = err
+				continue
+			}
+
+			// Trackers that respond are tried first next time
+			promoteTracker(announce.InfoHash, tierIndex, trackerIndex)
+			responded = true
+
+			// Announce again before any of the trackers forgets about us
+			if tierInterval > 0 && (interval == 0 || tierInterval < interval) {
+				interval = tierInterval
+			}
+
+			for _, peer := range tierPeers {
+				addr := net.JoinHostPort(peer.IP, strconv.Itoa(peer.Port))
+				if !seen[addr] {
+					seen[addr] = true
+					peers = append(peers, peer)
+				}
+			}
+			break
 		}
-		return sendHTTPTrackerRequest(peerId, torrent.Announce, infoHash)
-	} else if trackerType == "udp" {
-		return nil, fmt.Errorf("unsupported tracker protocol UDP")
+	}
+
+	if !responded {
+		return nil, 0, fmt.Errorf("no tracker responded: %v", lastErr)
+	}
+	return peers, interval, nil
+}
+
+// announceToTracker announces to a single tracker, which can be either UDP or HTTP, and returns its peers and interval
+func announceToTracker(trackerURL string, announce torrent.TrackerAnnounce) ([]TrackingServer.Peer, time.Duration, error) {
+	if strings.HasPrefix(trackerURL, "http") {
+		return sendHTTPTrackerRequest(trackerURL, announce)
+	} else if strings.HasPrefix(trackerURL, "udp") {
+		return sendUDPTrackerRequest(trackerURL, announce)
 	} else {
-		return nil, fmt.Errorf("unsupported tracker protocol OTHER")
+		return nil, 0, fmt.Errorf("unsupported tracker protocol")
 	}
 }
 
@@ -65,26 +125,40 @@ func URLEncodeBytes(data []byte) string {
 	return encoded
 }
 
-func sendHTTPTrackerRequest(peerId string, announce string, infoHash []byte) ([]TrackingServer.Peer, error) {
+// httpEvents are the event parameters of HTTP announces, regular announces leave it out
+var httpEvents = map[int]string{
+	TrackingServer.STARTED:   "started",
+	TrackingServer.COMPLETED: "completed",
+	TrackingServer.STOPPED:   "stopped",
+}
+
+func sendHTTPTrackerRequest(trackerURL string, announce torrent.TrackerAnnounce) ([]TrackingServer.Peer, time.Duration, error) {
 	// Manually encode each byte of the info_hash
-	encodedInfoHash := URLEncodeBytes(infoHash)
+	encodedInfoHash := URLEncodeBytes(announce.InfoHash)
 
 	// Manually construct the query parameters
 	query := fmt.Sprintf(
-		"info_hash=%s&peer_id=%s&port=6881&uploaded=0&downloaded=0&left=0&compact=1",
+		"info_hash=%s&peer_id=%s&port=%d&uploaded=%d&downloaded=%d&left=%d&compact=1",
 		encodedInfoHash,
-		url.QueryEscape(peerId),
+		url.QueryEscape(announce.PeerID),
+		announce.Port,
+		announce.Uploaded,
+		announce.Downloaded,
+		announce.Left,
 	)
+	if event, ok := httpEvents[announce.Event]; ok {
+		query += "&event=" + event
+	}
 
 	// Construct the full request URL
-	requestURL := fmt.Sprintf("%s?%s", announce, query)
+	requestURL := fmt.Sprintf("%s?%s", trackerURL, query)
 
 	fmt.Println("Request URL:", requestURL)
 
 	// Create a new HTTP request
 	req, err := http.NewRequest("GET", requestURL, nil)
 	if err != nil {
-		return nil, fmt.Errorf("error creating HTTP request: %v", err)
+		return nil, 0, fmt.Errorf("error creating HTTP request: %v", err)
 	}
 
 	// Set a BitTorrent-compatible User-Agent
@@ -96,25 +170,35 @@ func sendHTTPTrackerRequest(peerId string, announce string, infoHash []byte) ([]
 	// Send the request
 	resp, err := client.Do(req)
 	if err != nil {
-		return nil, fmt.Errorf("error sending tracker request: %v", err)
+		return nil, 0, fmt.Errorf("error sending tracker request: %v", err)
 	}
 	defer resp.Body.Close()
 
 	// Read the response body
 	body, err := io.ReadAll(resp.Body)
 	if err != nil {
-		return nil, fmt.Errorf("error reading tracker response: %v", err)
+		return nil, 0, fmt.Errorf("error reading tracker response: %v", err)
 	}
 
 	// Decode the Bencoded response
 	var trackerResponse TrackingServer.AnnounceResponse
 	err = bencode.NewDecoder(bytes.NewReader(body)).Decode(&trackerResponse)
 	if err != nil {
-		return nil, fmt.Errorf("error decoding tracker response: %v", err)
+		return nil, 0, fmt.Errorf("error decoding tracker response: %v", err)
+	}
+
+	if trackerResponse.FailureReason != "" {
+		return nil, 0, fmt.Errorf("tracker refused announce: %s", trackerResponse.FailureReason)
+	}
+
+	// Peers can come back compact or as dictionaries
+	peers, err := trackerResponse.DecodePeers()
+	if err != nil {
+		return nil, 0, fmt.Errorf("error decoding tracker peers: %v", err)
 	}
 
 	// Log the response
-	log.Printf("Tracker response: %v\n", trackerResponse.Peers)
+	log.Printf("Tracker response: %v\n", peers)
 
-	return trackerResponse.Peers, nil
+	return peers, time.Duration(trackerResponse.Interval) * time.Second, nil
 }
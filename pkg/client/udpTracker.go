@@ -0,0 +1,293 @@
+package client
+
+import (
+	"bittorrent/pkg/torrent"
+	TrackingServer "bittorrent/pkg/trackingserver"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"sync"
+	"time"
+)
+
+// UDP tracker protocol (BEP 15). Every request after connect carries a connection ID, which the tracker hands out
+// and which stays valid for a minute, so they get cached per tracker.
+const (
+	UDP_PROTOCOL_ID = 0x41727101980 // The magic connection ID of a connect request
+
+	UDP_CONNECT  = 0
+	UDP_ANNOUNCE = 1
+	UDP_SCRAPE   = 2
+	UDP_ERROR    = 3
+
+	UDP_EVENT_NONE      = 0
+	UDP_EVENT_COMPLETED = 1
+	UDP_EVENT_STARTED   = 2
+	UDP_EVENT_STOPPED   = 3
+
+	UDP_CONNECTION_ID_TTL = time.Minute
+	UDP_BASE_TIMEOUT      = 15 * time.Second // Doubled on every retransmission
+	UDP_MAX_RETRIES       = 3                // BEP 15 goes up to 8, which adds up to over an hour of waiting
+	UDP_TOTAL_TIMEOUT     = time.Minute      // Caps a whole announce or scrape, connecting included, so a dead tracker can't hold up the next one
+	UDP_MAX_SCRAPE        = 74               // The most info_hashes a single scrape can ask about
+	UDP_MAX_PACKET        = 65507
+)
+
+// errUDPTimeout means the tracker didn't answer in time, so the request gets sent again
+var errUDPTimeout = errors.New("udp tracker request timed out")
+
+// ScrapeStats are a tracker's counts for a single torrent
+type ScrapeStats struct {
+	Seeders   int // Peers with the whole torrent
+	Completed int // How many times the torrent has been downloaded
+	Leechers  int // Peers still downloading
+}
+
+// udpConnectionID is a connection ID from a tracker along with when it runs out
+type udpConnectionID struct {
+	id      uint64
+	expires time.Time
+}
+
+// Connection IDs are shared by every request to the same tracker
+var udpConnections = struct {
+	mtx sync.Mutex
+	ids map[string]udpConnectionID
+}{ids: make(map[string]udpConnectionID)}
+
+// udpTracker is a socket to a single UDP tracker
+type udpTracker struct {
+	host     string
+	conn     net.Conn
+	deadline time.Time // When we give up on the tracker, however many retries are left
+}
+
+func dialUDPTracker(announce string) (*udpTracker, error) {
+	u, err := url.Parse(announce)
+	if err != nil {
+		return nil, fmt.Errorf("invalid tracker URL: %v", err)
+	}
+
+	conn, err := net.Dial("udp", u.Host)
+	if err != nil {
+		return nil, fmt.Errorf("error connecting to tracker: %v", err)
+	}
+
+	return &udpTracker{host: u.Host, conn: conn, deadline: time.Now().Add(UDP_TOTAL_TIMEOUT)}, nil
+}
+
+// udpEvents are the event numbers of UDP announces, regular announces send UDP_EVENT_NONE
+var udpEvents = map[int]uint32{
+	TrackingServer.STARTED:   UDP_EVENT_STARTED,
+	TrackingServer.COMPLETED: UDP_EVENT_COMPLETED,
+	TrackingServer.STOPPED:   UDP_EVENT_STOPPED,
+}
+
+// sendUDPTrackerRequest announces to a UDP tracker and returns the peers it knows about and its interval
+func sendUDPTrackerRequest(trackerURL string, announce torrent.TrackerAnnounce) ([]TrackingServer.Peer, time.Duration, error) {
+	tracker, err := dialUDPTracker(trackerURL)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer tracker.conn.Close()
+
+	// info_hash, peer_id, downloaded, left, uploaded, event, IP, key, num_want, port
+	body := make([]byte, 82)
+	copy(body[0:20], announce.InfoHash)
+	copy(body[20:40], announce.PeerID)
+	binary.BigEndian.PutUint64(body[40:48], uint64(announce.Downloaded))
+	binary.BigEndian.PutUint64(body[48:56], uint64(announce.Left))
+	binary.BigEndian.PutUint64(body[56:64], uint64(announce.Uploaded))
+	binary.BigEndian.PutUint32(body[64:68], udpEvents[announce.Event])
+	binary.BigEndian.PutUint32(body[68:72], 0) // Let the tracker use the address the packet came from
+	rand.Read(body[72:76])
+	binary.BigEndian.PutUint32(body[76:80], 0xFFFFFFFF) // -1, let the tracker decide how many peers to send
+	binary.BigEndian.PutUint16(body[80:82], uint16(announce.Port))
+
+	resp, err := tracker.request(UDP_ANNOUNCE, body)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	// Trackers reached over IPv6 send IPv6 peers, which take 18 bytes instead of 6
+	ipLength := net.IPv4len
+	if addr, ok := tracker.conn.RemoteAddr().(*net.UDPAddr); ok && addr.IP.To4() == nil {
+		ipLength = net.IPv6len
+	}
+	entryLength := ipLength + 2
+
+	// interval, leechers, seeders and then an entry for every peer
+	if len(resp) < 12 || (len(resp)-12)%entryLength != 0 {
+		return nil, 0, fmt.Errorf("invalid announce response length %d", len(resp))
+	}
+	interval := time.Duration(binary.BigEndian.Uint32(resp[0:4])) * time.Second
+
+	peers := []TrackingServer.Peer{}
+	for i := 12; i < len(resp); i += entryLength {
+		peers = append(peers, TrackingServer.Peer{
+			IP:   net.IP(resp[i : i+ipLength]).String(),
+			Port: int(binary.BigEndian.Uint16(resp[i+ipLength : i+entryLength])),
+		})
+	}
+
+	fmt.Println("UDP tracker returned", len(peers), "peers")
+	return peers, interval, nil
+}
+
+// sendUDPScrapeRequest asks a UDP tracker for the counts of up to UDP_MAX_SCRAPE torrents at once
+func sendUDPScrapeRequest(announce string, infoHashes [][]byte) ([]ScrapeStats, error) {
+	if len(infoHashes) == 0 || len(infoHashes) > UDP_MAX_SCRAPE {
+		return nil, fmt.Errorf("can scrape between 1 and %d torrents at once, got %d", UDP_MAX_SCRAPE, len(infoHashes))
+	}
+
+	tracker, err := dialUDPTracker(announce)
+	if err != nil {
+		return nil, err
+	}
+	defer tracker.conn.Close()
+
+	body := make([]byte, 0, 20*len(infoHashes))
+	for _, infoHash := range infoHashes {
+		body = append(body, infoHash...)
+	}
+
+	resp, err := tracker.request(UDP_SCRAPE, body)
+	if err != nil {
+		return nil, err
+	}
+
+	// seeders, completed and leechers for every info_hash, in the order they were asked for
+	if len(resp) != 12*len(infoHashes) {
+		return nil, fmt.Errorf("invalid scrape response length %d", len(resp))
+	}
+
+	stats := make([]ScrapeStats, len(infoHashes))
+	for i := range stats {
+		stats[i] = ScrapeStats{
+			Seeders:   int(binary.BigEndian.Uint32(resp[12*i : 12*i+4])),
+			Completed: int(binary.BigEndian.Uint32(resp[12*i+4 : 12*i+8])),
+			Leechers:  int(binary.BigEndian.Uint32(resp[12*i+8 : 12*i+12])),
+		}
+	}
+	return stats, nil
+}
+
+// connectionID returns the cached connection ID for the tracker, connecting again if it has run out
+func (t *udpTracker) connectionID() (uint64, error) {
+	udpConnections.mtx.Lock()
+	cached, ok := udpConnections.ids[t.host]
+	udpConnections.mtx.Unlock()
+	if ok && time.Now().Before(cached.expires) {
+		return cached.id, nil
+	}
+
+	resp, err := t.request(UDP_CONNECT, nil)
+	if err != nil {
+		return 0, err
+	}
+	if len(resp) < 8 {
+		return 0, fmt.Errorf("invalid connect response length %d", len(resp))
+	}
+	id := binary.BigEndian.Uint64(resp[0:8])
+
+	udpConnections.mtx.Lock()
+	udpConnections.ids[t.host] = udpConnectionID{id, time.Now().Add(UDP_CONNECTION_ID_TTL)}
+	udpConnections.mtx.Unlock()
+	return id, nil
+}
+
+// forgetConnectionID drops the cached connection ID for the tracker, so the next request connects again.
+// Errors and mismatched responses mostly come from a connection ID the tracker no longer accepts.
+func (t *udpTracker) forgetConnectionID() {
+	udpConnections.mtx.Lock()
+	defer udpConnections.mtx.Unlock()
+	delete(udpConnections.ids, t.host)
+}
+
+// request sends a request to the tracker and returns the body of its response, the part after the action and
+// transaction ID. Requests that go unanswered are sent again after 15 * 2^n seconds, up to UDP_MAX_RETRIES times,
+// but never past the tracker's deadline.
+func (t *udpTracker) request(action uint32, body []byte) ([]byte, error) {
+	for attempt := 0; attempt <= UDP_MAX_RETRIES; attempt++ {
+		timeout := min(UDP_BASE_TIMEOUT<<attempt, time.Until(t.deadline))
+		if timeout <= 0 {
+			break
+		}
+
+		// The connection ID can run out while we are retrying, so it is looked up again every time
+		var connectionID uint64 = UDP_PROTOCOL_ID
+		if action != UDP_CONNECT {
+			var err error
+			connectionID, err = t.connectionID()
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		transactionID := make([]byte, 4)
+		rand.Read(transactionID)
+
+		packet := make([]byte, 16, 16+len(body))
+		binary.BigEndian.PutUint64(packet[0:8], connectionID)
+		binary.BigEndian.PutUint32(packet[8:12], action)
+		copy(packet[12:16], transactionID)
+		packet = append(packet, body...)
+
+		resp, err := t.exchange(packet, action, binary.BigEndian.Uint32(transactionID), timeout)
+		if err == errUDPTimeout {
+			fmt.Println("UDP tracker", t.host, "timed out, retrying")
+			continue
+		}
+		return resp, err
+	}
+
+	return nil, fmt.Errorf("udp tracker %s did not respond", t.host)
+}
+
+// exchange sends a packet and waits for the response with the same transaction ID, ignoring anything else
+func (t *udpTracker) exchange(packet []byte, action uint32, transactionID uint32, timeout time.Duration) ([]byte, error) {
+	_, err := t.conn.Write(packet)
+	if err != nil {
+		return nil, fmt.Errorf("error sending to tracker: %v", err)
+	}
+
+	t.conn.SetReadDeadline(time.Now().Add(timeout))
+	buf := make([]byte, UDP_MAX_PACKET)
+	for {
+		n, err := t.conn.Read(buf)
+		if errors.Is(err, os.ErrDeadlineExceeded) {
+			return nil, errUDPTimeout
+		}
+		if err != nil {
+			return nil, fmt.Errorf("error reading from tracker: %v", err)
+		}
+
+		// Responses start with the action and the transaction ID of the request
+		if n < 8 {
+			continue
+		}
+		if binary.BigEndian.Uint32(buf[4:8]) != transactionID {
+			// Most likely the answer to an earlier attempt, but the next request connects again to be safe
+			t.forgetConnectionID()
+			continue
+		}
+
+		respAction := binary.BigEndian.Uint32(buf[0:4])
+		if respAction == UDP_ERROR {
+			t.forgetConnectionID()
+			return nil, fmt.Errorf("tracker error: %s", string(buf[8:n]))
+		}
+		if respAction != action {
+			t.forgetConnectionID()
+			return nil, fmt.Errorf("tracker responded with action %d, expected %d", respAction, action)
+		}
+
+		resp := make([]byte, n-8)
+		copy(resp, buf[8:n])
+		return resp, nil
+	}
+}
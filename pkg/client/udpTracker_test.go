@@ -0,0 +1,152 @@
+package client
+
+import (
+	"bittorrent/pkg/torrent"
+	TrackingServer "bittorrent/pkg/trackingserver"
+	"bytes"
+	"fmt"
+	"net"
+	"testing"
+	"time"
+)
+
+// startUDPTracker runs a tracker's UDP endpoint on a free port and returns its announce URL
+func startUDPTracker(t *testing.T) string {
+	t.Helper()
+
+	conn, err := net.ListenPacket("udp", ":0")
+	if err != nil {
+		t.Fatalf("error finding a free port: %v", err)
+	}
+	port := conn.LocalAddr().(*net.UDPAddr).Port
+	conn.Close()
+
+	go TrackingServer.NewTracker().ListenUDP(port)
+
+	// The port is taken once the tracker is listening
+	for start := time.Now(); time.Since(start) < 5*time.Second; time.Sleep(10 * time.Millisecond) {
+		conn, err := net.ListenPacket("udp", fmt.Sprintf(":%d", port))
+		if err != nil {
+			return fmt.Sprintf("udp://127.0.0.1:%d/announce", port)
+		}
+		conn.Close()
+	}
+	t.Fatal("the UDP tracker never started listening")
+	return ""
+}
+
+func TestUDPTrackerRoundTrip(t *testing.T) {
+	trackerURL := startUDPTracker(t)
+	infoHash := bytes.Repeat([]byte{0xab}, 20)
+	other := bytes.Repeat([]byte{0xcd}, 20)
+
+	// Every step runs against the same swarm, in order
+	steps := []struct {
+		name      string
+		peerID    string
+		port      int
+		event     int
+		left      int64
+		wantPeers []TrackingServer.Peer
+	}{
+		{
+			name:      "first leecher gets nobody",
+			peerID:    "-TEST-leecher-000001",
+			port:      6881,
+			event:     TrackingServer.STARTED,
+			left:      100,
+			wantPeers: []TrackingServer.Peer{},
+		},
+		{
+			name:      "seeder gets the leecher",
+			peerID:    "-TEST-seeder-0000001",
+			port:      6882,
+			event:     TrackingServer.STARTED,
+			left:      0,
+			wantPeers: []TrackingServer.Peer{{IP: "127.0.0.1", Port: 6881}},
+		},
+		{
+			name:      "leecher gets the seeder",
+			peerID:    "-TEST-leecher-000001",
+			port:      6881,
+			event:     TrackingServer.NONE,
+			left:      50,
+			wantPeers: []TrackingServer.Peer{{IP: "127.0.0.1", Port: 6882}},
+		},
+		{
+			name:      "leecher completes",
+			peerID:    "-TEST-leecher-000001",
+			port:      6881,
+			event:     TrackingServer.COMPLETED,
+			left:      0,
+			wantPeers: []TrackingServer.Peer{},
+		},
+		{
+			name:      "second leecher gets both seeders",
+			peerID:    "-TEST-leecher-000002",
+			port:      6883,
+			event:     TrackingServer.STARTED,
+			left:      100,
+			wantPeers: []TrackingServer.Peer{{IP: "127.0.0.1", Port: 6881}, {IP: "127.0.0.1", Port: 6882}},
+		},
+	}
+
+	for _, step := range steps {
+		t.Run(step.name, func(t *testing.T) {
+			peers, interval, err := sendUDPTrackerRequest(trackerURL, torrent.TrackerAnnounce{
+				InfoHash: infoHash,
+				PeerID:   step.peerID,
+				Port:     step.port,
+				Event:    step.event,
+				Left:     step.left,
+			})
+			if err != nil {
+				t.Fatalf("sendUDPTrackerRequest() error = %v", err)
+			}
+			if interval != TrackingServer.ANNOUNCE_INTERVAL {
+				t.Errorf("interval = %v, want %v", interval, TrackingServer.ANNOUNCE_INTERVAL)
+			}
+			if !samePeers(peers, step.wantPeers) {
+				t.Errorf("sendUDPTrackerRequest() = %+v, want %+v", peers, step.wantPeers)
+			}
+		})
+	}
+
+	t.Run("scrape", func(t *testing.T) {
+		stats, err := sendUDPScrapeRequest(trackerURL, [][]byte{infoHash, other})
+		if err != nil {
+			t.Fatalf("sendUDPScrapeRequest() error = %v", err)
+		}
+		want := []ScrapeStats{{Seeders: 2, Completed: 1, Leechers: 1}, {}}
+		if len(stats) != len(want) || stats[0] != want[0] || stats[1] != want[1] {
+			t.Errorf("sendUDPScrapeRequest() = %+v, want %+v", stats, want)
+		}
+	})
+
+	t.Run("scrape without torrents", func(t *testing.T) {
+		_, err := sendUDPScrapeRequest(trackerURL, [][]byte{})
+		if err == nil {
+			t.Error("sendUDPScrapeRequest() succeeded, want an error")
+		}
+	})
+}
+
+// samePeers compares the addresses of two peer lists in any order
+func samePeers(got []TrackingServer.Peer, want []TrackingServer.Peer) bool {
+	if len(got) != len(want) {
+		return false
+	}
+	addresses := make(map[string]int)
+	for _, peer := range got {
+		addresses[fmt.Sprintf("%s:%d", peer.IP, peer.Port)]++
+	}
+	for _, peer := range want {
+		addresses[fmt.Sprintf("%s:%d", peer.IP, peer.Port)]--
+	}
+	for _, count := range addresses {
+		if count != 0 {
+			return false
+		}
+	}
+	return true
+}
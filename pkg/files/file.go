@@ -74,6 +74,40 @@ func SelectAnyFile(ctx context.Context) (*FileInfo, error) {
     }, nil
 }
 
+// SelectDirectory opens a directory dialog and returns the selected directory, used for multi-file torrents
+func SelectDirectory(ctx context.Context) (*FileInfo, error) {
+    dirPath, err := runtime.OpenDirectoryDialog(ctx, runtime.OpenDialogOptions{
+        Title: "Select a Folder",
+    })
+
+    if err != nil || dirPath == "" {
+        return nil, err
+    }
+
+    // Get directory information
+    info, err := os.Stat(dirPath)
+    if err != nil {
+        return nil, err
+    }
+
+    return &FileInfo{
+        Path:    dirPath,
+        Length:  info.Size(),
+        Name:    info.Name(),
+        Size:    info.Size(),
+        ModTime: info.ModTime(),
+        IsDir:   info.IsDir(),
+    }, nil
+}
+
+// SelectSavePath opens a save file dialog for where a download should go, without writing anything
+func SelectSavePath(ctx context.Context, defaultFileName string) (string, error) {
+    return runtime.SaveFileDialog(ctx, runtime.SaveDialogOptions{
+        Title:           "Save Download As",
+        DefaultFilename: defaultFileName,
+    })
+}
+
 func ReadFileToBytes(path string) ([]byte, error) {
     return os.ReadFile(path)
 }
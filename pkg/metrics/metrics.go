@@ -0,0 +1,109 @@
+// Package metrics writes counters and gauges in the Prometheus text format, so the tracker and the client can be
+// scraped without pulling in the Prometheus client library.
+package metrics
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// The kinds of metric a family can be
+const (
+	COUNTER = "counter"
+	GAUGE   = "gauge"
+)
+
+// CONTENT_TYPE is the content type of version 0.0.4 of the text format
+const CONTENT_TYPE = "text/plain; version=0.0.4; charset=utf-8"
+
+// Sample is a single value of a metric family
+type Sample struct {
+	Labels []string // Label names and values, one after the other
+	Value  float64
+}
+
+// Writer writes metric families one after the other, keeping the first error so callers only check it once
+type Writer struct {
+	w   *bufio.Writer
+	err error
+}
+
+func NewWriter(w io.Writer) *Writer {
+	return &Writer{w: bufio.NewWriter(w)}
+}
+
+// Family writes the help and type lines of a metric family followed by its samples
+func (mw *Writer) Family(name string, kind string, help string, samples ...Sample) {
+	mw.printf("# HELP %s %s\n", name, escape(help, false))
+	mw.printf("# TYPE %s %s\n", name, kind)
+	for _, sample := range samples {
+		mw.printf("%s%s %s\n", name, labels(sample.Labels), strconv.FormatFloat(sample.Value, 'g', -1, 64))
+	}
+}
+
+// Flush writes out whatever is buffered and returns the first error the writer ran into
+func (mw *Writer) Flush() error {
+	if mw.err == nil {
+		mw.err = mw.w.Flush()
+	}
+	return mw.err
+}
+
+func (mw *Writer) printf(format string, args ...any) {
+	if mw.err != nil {
+		return
+	}
+	_, mw.err = fmt.Fprintf(mw.w, format, args...)
+}
+
+// Value is a sample without labels
+func Value(value float64) Sample {
+	return Sample{Value: value}
+}
+
+// Labeled is a sample with labels, given as names and values one after the other
+func Labeled(value float64, labels ...string) Sample {
+	return Sample{Labels: labels, Value: value}
+}
+
+// Handler serves the metrics that write puts out
+func Handler(write func(mw *Writer)) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
+			return
+		}
+
+		w.Header().Set("Content-Type", CONTENT_TYPE)
+		mw := NewWriter(w)
+		write(mw)
+		mw.Flush()
+	})
+}
+
+// labels formats label pairs as {name="value",...}, an odd one out is dropped
+func labels(pairs []string) string {
+	if len(pairs) < 2 {
+		return ""
+	}
+
+	parts := []string{}
+	for i := 0; i+1 < len(pairs); i += 2 {
+		parts = append(parts, pairs[i]+"=\""+escape(pairs[i+1], true)+"\"")
+	}
+	return "{" + strings.Join(parts, ",") + "}"
+}
+
+// escape escapes backslashes and newlines, and double quotes too in label values
+func escape(s string, quotes bool) string {
+	s = strings.ReplaceAll(s, "\\", "\\\\")
+	s = strings.ReplaceAll(s, "\n", "\\n")
+	if quotes {
+		s = strings.ReplaceAll(s, "\"", "\\\"")
+	}
+	return s
+}
@@ -0,0 +1,215 @@
+package torrent
+
+import (
+	"bytes"
+	"log"
+	"sync"
+	"time"
+
+	"bittorrent/pkg/trackingserver"
+)
+
+// Trackers forget peers that stop announcing, so every torrent we serve is announced again on the interval the
+// tracker asks for. DEFAULT_ANNOUNCE_INTERVAL is used when the tracker didn't say or couldn't be reached, and
+// STOPPED_ANNOUNCE_TIMEOUT is how long StopAll waits for the trackers to hear that we are leaving.
+const (
+	DEFAULT_ANNOUNCE_INTERVAL = 1 * time.Minute
+	STOPPED_ANNOUNCE_TIMEOUT  = 5 * time.Second
+)
+
+// TrackerAnnounce is everything a tracker is told about a torrent we are serving
+type TrackerAnnounce struct {
+	Trackers   [][]string // Tiers of announce URLs
+	InfoHash   []byte
+	PeerID     string
+	Port       int   // The port leechers can reach us on
+	Event      int   // One of the trackingserver events, NONE for a regular announce
+	Uploaded   int64 // Bytes of blocks we have sent since we started serving the torrent
+	Downloaded int64 // Bytes of verified pieces we have downloaded since we started
+	Left       int64 // Bytes we still need for the whole torrent
+}
+
+// Announcer sends announces to a torrent's trackers and returns how long to wait before the next one.
+// client.Announcer is the real one, it lives in the client package since that package imports this one.
+type Announcer interface {
+	Announce(announce TrackerAnnounce) (time.Duration, error)
+}
+
+// announceState is the announce loop of one torrent along with the counters it reports. It is shared by every
+// Seeder that serves the torrent, so replacing a seeder keeps both the loop and the counters going.
+type announceState struct {
+	mtx        sync.Mutex
+	uploaded   int64
+	downloaded int64
+
+	completed    chan struct{}        // Closed when the download finishes
+	completeOnce sync.Once            // completed can only be closed once
+	stop         chan TrackerAnnounce // The stopped announce, sent when the torrent is removed
+	done         chan struct{}        // Closed once the stopped announce has gone out
+}
+
+func newAnnounceState() *announceState {
+	return &announceState{
+		completed: make(chan struct{}),
+		stop:      make(chan TrackerAnnounce, 1),
+		done:      make(chan struct{}),
+	}
+}
+
+func (a *announceState) addUploaded(n int64) {
+	a.mtx.Lock()
+	defer a.mtx.Unlock()
+	a.uploaded += n
+}
+
+func (a *announceState) addDownloaded(n int64) {
+	a.mtx.Lock()
+	defer a.mtx.Unlock()
+	a.downloaded += n
+}
+
+func (a *announceState) transferred() (int64, int64) {
+	a.mtx.Lock()
+	defer a.mtx.Unlock()
+	return a.uploaded, a.downloaded
+}
+
+// complete tells the announce loop that the download has finished
+func (a *announceState) complete() {
+	a.completeOnce.Do(func() { close(a.completed) })
+}
+
+// SetAnnouncer sets how torrents get announced, nothing is announced until it is set
+func (s *SeederStack) SetAnnouncer(announcer Announcer) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	s.announcer = announcer
+}
+
+// StopAll stops serving every torrent and tells the trackers that we are leaving, waiting up to
+// STOPPED_ANNOUNCE_TIMEOUT for the stopped announces to go out
+func (s *SeederStack) StopAll() {
+	s.mtx.Lock()
+	infoHashes := [][]byte{}
+	states := []*announceState{}
+	for _, seeder := range s.seeders {
+		infoHashes = append(infoHashes, seeder.infoHash)
+		states = append(states, seeder.announce)
+	}
+	s.mtx.Unlock()
+
+	for _, infoHash := range infoHashes {
+		s.removeSeeder(infoHash)
+	}
+
+	timeout := time.After(STOPPED_ANNOUNCE_TIMEOUT)
+	for _, state := range states {
+		select {
+		case <-state.done:
+		case <-timeout:
+			log.Println("Timed out telling the trackers we stopped")
+			return
+		}
+	}
+}
+
+// trackerAnnounce fills in an announce for a torrent we are serving, returning false if we aren't serving it anymore
+func (s *SeederStack) trackerAnnounce(infoHash []byte, event int) (TrackerAnnounce, bool) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	for i := range s.seeders {
+		if bytes.Equal(s.seeders[i].infoHash, infoHash) {
+			return s.seeders[i].trackerAnnounce(s.port, event), true
+		}
+	}
+	return TrackerAnnounce{}, false
+}
+
+// trackerAnnounce fills in an announce for this seeder with the counters so far, the caller must hold the stack's lock
+func (s *Seeder) trackerAnnounce(port int, event int) TrackerAnnounce {
+	uploaded, downloaded := s.announce.transferred()
+
+	var left int64
+	if s.download != nil {
+		left = s.download.bytesLeft()
+	}
+
+	return TrackerAnnounce{
+		Trackers:   s.trackers,
+		InfoHash:   s.infoHash,
+		PeerID:     string(s.peerID),
+		Port:       port,
+		Event:      event,
+		Uploaded:   uploaded,
+		Downloaded: downloaded,
+		Left:       left,
+	}
+}
+
+// sendAnnounce sends an announce and returns how long to wait before the next one
+func (s *SeederStack) sendAnnounce(announce TrackerAnnounce) (time.Duration, error) {
+	s.mtx.Lock()
+	announcer := s.announcer
+	s.mtx.Unlock()
+
+	if announcer == nil {
+		return DEFAULT_ANNOUNCE_INTERVAL, nil
+	}
+
+	interval, err := announcer.Announce(announce)
+	if err != nil || interval <= 0 {
+		interval = DEFAULT_ANNOUNCE_INTERVAL
+	}
+	return interval, err
+}
+
+// startAnnouncing tells the trackers that we started serving a torrent and keeps announcing it from then on
+func (s *SeederStack) startAnnouncing(infoHash []byte, state *announceState) {
+	interval := DEFAULT_ANNOUNCE_INTERVAL
+	announce, ok := s.trackerAnnounce(infoHash, trackingserver.STARTED)
+	if ok {
+		var err error
+		interval, err = s.sendAnnounce(announce)
+		if err != nil {
+			log.Println("Error announcing torrent:", err)
+		}
+	}
+
+	s.announceLoop(infoHash, state, interval)
+}
+
+// announceLoop announces a torrent again every interval until it is removed, telling the trackers straight away
+// when the download completes and sending the stopped announce on the way out
+func (s *SeederStack) announceLoop(infoHash []byte, state *announceState, interval time.Duration) {
+	defer close(state.done)
+
+	completed := state.completed
+	for {
+		event := trackingserver.NONE
+		select {
+		case <-time.After(interval):
+		case <-completed:
+			completed = nil // Only announce completed once
+			event = trackingserver.COMPLETED
+		case stopped := <-state.stop:
+			_, err := s.sendAnnounce(stopped)
+			if err != nil {
+				log.Println("Error announcing stopped torrent:", err)
+			}
+			return
+		}
+
+		// The torrent was removed, the stopped announce is waiting for us
+		announce, ok := s.trackerAnnounce(infoHash, event)
+		if !ok {
+			continue
+		}
+
+		var err error
+		interval, err = s.sendAnnounce(announce)
+		if err != nil {
+			log.Println("Error announcing torrent:", err)
+		}
+	}
+}
@@ -0,0 +1,225 @@
+package torrent
+
+import (
+	"bittorrent/pkg/trackingserver"
+	"bytes"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// recordAnnouncer is an Announcer that hands every announce over on a channel, so the announce loop waits for the
+// test to take each one
+type recordAnnouncer struct {
+	interval  time.Duration // Returned to the loop, DEFAULT_ANNOUNCE_INTERVAL is used if 0
+	announces chan TrackerAnnounce
+}
+
+func newRecordAnnouncer(interval time.Duration) *recordAnnouncer {
+	return &recordAnnouncer{interval: interval, announces: make(chan TrackerAnnounce)}
+}
+
+func (a *recordAnnouncer) Announce(announce TrackerAnnounce) (time.Duration, error) {
+	a.announces <- announce
+	return a.interval, nil
+}
+
+// next waits for the next announce
+func (a *recordAnnouncer) next(t *testing.T) TrackerAnnounce {
+	t.Helper()
+
+	select {
+	case announce := <-a.announces:
+		return announce
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for an announce")
+		return TrackerAnnounce{}
+	}
+}
+
+// checkAnnounce compares the event and counters of an announce with what was expected
+func checkAnnounce(t *testing.T, got TrackerAnnounce, want TrackerAnnounce) {
+	t.Helper()
+
+	if got.Event != want.Event || got.Left != want.Left || got.Uploaded != want.Uploaded || got.Downloaded != want.Downloaded {
+		t.Errorf("announce = event %d, left %d, uploaded %d, downloaded %d, want event %d, left %d, uploaded %d, downloaded %d",
+			got.Event, got.Left, got.Uploaded, got.Downloaded, want.Event, want.Left, want.Uploaded, want.Downloaded)
+	}
+}
+
+func TestAnnounceLoop(t *testing.T) {
+	const numPieces = 4
+	const length = numPieces * BLOCK_SIZE
+
+	type step struct {
+		stored   int   // Pieces of the download stored before this step
+		uploaded int64 // Bytes uploaded before this step
+		complete bool  // Whether the download completes
+		stop     bool  // Whether the torrent is removed
+		want     TrackerAnnounce
+	}
+	tests := []struct {
+		name        string
+		downloading bool
+		interval    time.Duration
+		steps       []step // What happens after the started announce
+	}{
+		{
+			name: "seeding",
+			steps: []step{
+				{uploaded: 500, stop: true, want: TrackerAnnounce{Event: trackingserver.STOPPED, Uploaded: 500}},
+			},
+		},
+		{
+			name:        "stopped part way through a download",
+			downloading: true,
+			steps: []step{
+				{stored: 2, uploaded: 100, stop: true, want: TrackerAnnounce{
+					Event: trackingserver.STOPPED, Left: 2 * BLOCK_SIZE, Uploaded: 100, Downloaded: 2 * BLOCK_SIZE,
+				}},
+			},
+		},
+		{
+			name:        "download completes",
+			downloading: true,
+			steps: []step{
+				{stored: 4, complete: true, want: TrackerAnnounce{Event: trackingserver.COMPLETED, Downloaded: length}},
+				{uploaded: 300, stop: true, want: TrackerAnnounce{Event: trackingserver.STOPPED, Uploaded: 300, Downloaded: length}},
+			},
+		},
+		{
+			name:        "completed is only announced once",
+			downloading: true,
+			interval:    10 * time.Millisecond,
+			steps: []step{
+				{stored: 4, complete: true, want: TrackerAnnounce{Event: trackingserver.COMPLETED, Downloaded: length}},
+				{complete: true, want: TrackerAnnounce{Event: trackingserver.NONE, Downloaded: length}},
+			},
+		},
+		{
+			name:        "regular announces in between",
+			downloading: true,
+			interval:    10 * time.Millisecond,
+			steps: []step{
+				{stored: 1, want: TrackerAnnounce{Event: trackingserver.NONE, Left: 3 * BLOCK_SIZE, Downloaded: BLOCK_SIZE}},
+				{stored: 1, uploaded: 50, want: TrackerAnnounce{
+					Event: trackingserver.NONE, Left: 2 * BLOCK_SIZE, Uploaded: 50, Downloaded: 2 * BLOCK_SIZE,
+				}},
+			},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			announcer := newRecordAnnouncer(test.interval)
+			stack := &SeederStack{port: 6881}
+			stack.SetAnnouncer(announcer)
+
+			infoHash := []byte("announce-test-infohs")
+			trackers := [][]string{{"http://tracker.example/announce"}}
+			seeder := Seeder{infoHash: infoHash, peerID: []byte("-TEST-seeder-0000001"), trackers: trackers, connectedLeechers: []*Leecher{}}
+			var m *downloadManager
+			if test.downloading {
+				m = newTestManager(numPieces, BLOCK_SIZE, 1)
+				seeder.download = m
+			}
+
+			// Seeders are announced straight away, downloads start announcing in the background
+			added := make(chan error, 1)
+			var state *announceState
+			if test.downloading {
+				state, _ = stack.addSeeder(seeder)
+				go stack.startAnnouncing(infoHash, state)
+			} else {
+				go func() { added <- stack.AddSeeder(seeder) }()
+			}
+
+			var left int64
+			if test.downloading {
+				left = length
+			}
+			started := announcer.next(t)
+			checkAnnounce(t, started, TrackerAnnounce{Event: trackingserver.STARTED, Left: left})
+			if !reflect.DeepEqual(started.Trackers, trackers) || !bytes.Equal(started.InfoHash, infoHash) || started.PeerID != string(seeder.peerID) || started.Port != 6881 {
+				t.Errorf("started announce = %+v, want it for the seeder's torrent on port 6881", started)
+			}
+			if !test.downloading {
+				if err := <-added; err != nil {
+					t.Fatalf("AddSeeder() error = %v", err)
+				}
+				stack.mtx.Lock()
+				state = stack.seeders[0].announce
+				stack.mtx.Unlock()
+			}
+
+			stored := 0
+			stopped := false
+			for _, step := range test.steps {
+				if step.stored > 0 {
+					m.mtx.Lock()
+					for j := 0; j < step.stored; j++ {
+						setPiece(m.bitfield, uint32(stored+j))
+					}
+					m.mtx.Unlock()
+					state.addDownloaded(int64(step.stored * BLOCK_SIZE))
+					stored += step.stored
+				}
+				state.addUploaded(step.uploaded)
+				if step.complete {
+					state.complete()
+				}
+				if step.stop {
+					go stack.StopAll()
+					stopped = true
+				}
+
+				got := announcer.next(t)
+				if step.want.Event == trackingserver.NONE {
+					// Regular announces keep going, so skip any that went out before this step's changes
+					for got.Uploaded != step.want.Uploaded || got.Downloaded != step.want.Downloaded {
+						got = announcer.next(t)
+					}
+				}
+				checkAnnounce(t, got, step.want)
+			}
+
+			// Let the announce loop finish instead of leaving it waiting on the announcer
+			if !stopped {
+				go stack.StopAll()
+				for announcer.next(t).Event != trackingserver.STOPPED {
+				}
+			}
+		})
+	}
+}
+
+func TestDownloadAnnounces(t *testing.T) {
+	dir := t.TempDir()
+	torrent, _ := newTestTorrent(t, filepath.Join(dir, "seeded"), []TorrentFile{{Length: 3*BLOCK_SIZE + 100}}, BLOCK_SIZE)
+	torrent.AnnounceList = [][]string{{"http://tracker.example/announce"}}
+	_, peer := startTestSeeder(t, torrent, filepath.Join(dir, "seeded"), "-TEST-seeder-0000001")
+
+	announcer := newRecordAnnouncer(0)
+	stack := &SeederStack{}
+	stack.SetAnnouncer(announcer)
+
+	// Downloads start announcing in the background, so it doesn't wait for the started announce
+	_, err := DownloadFromSeeders(stack, []trackingserver.Peer{peer}, torrent, filepath.Join(dir, "downloaded"), "-TEST-leecher-000001", DownloadOptions{})
+	if err != nil {
+		t.Fatalf("DownloadFromSeeders() error = %v", err)
+	}
+
+	length := torrent.Info.TotalLength()
+	started := announcer.next(t)
+	if started.Event != trackingserver.STARTED || started.Uploaded != 0 {
+		t.Errorf("first announce = %+v, want started with nothing uploaded", started)
+	}
+	if !reflect.DeepEqual(started.Trackers, torrent.AnnounceList) {
+		t.Errorf("announced to %v, want %v", started.Trackers, torrent.AnnounceList)
+	}
+	checkAnnounce(t, announcer.next(t), TrackerAnnounce{Event: trackingserver.COMPLETED, Downloaded: length})
+
+	go stack.StopAll()
+	checkAnnounce(t, announcer.next(t), TrackerAnnounce{Event: trackingserver.STOPPED, Downloaded: length})
+}
@@ -0,0 +1,176 @@
+package torrent
+
+import (
+	"bytes"
+	"log"
+	"math/rand"
+	"sort"
+	"time"
+)
+
+// The choker reranks the leechers of every torrent each CHOKE_INTERVAL and unchokes the best UPLOAD_SLOTS of them
+// (unless SetUploadSlots says otherwise), plus one optimistic unchoke that moves on every OPTIMISTIC_UNCHOKE_INTERVAL
+const (
+	CHOKE_INTERVAL              = 10 * time.Second
+	OPTIMISTIC_UNCHOKE_INTERVAL = 30 * time.Second
+	UPLOAD_SLOTS                = 4
+)
+
+// chokeDecision is what a choke round decided for one leecher, applied once the stack is unlocked
+type chokeDecision struct {
+	leecher *Leecher
+	unchoke bool
+}
+
+// SetUploadSlots sets how many leechers of each torrent get unchoked by rate, not counting the optimistic unchoke
+func (s *SeederStack) SetUploadSlots(slots int) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	s.uploadSlots = slots
+}
+
+// slots is the number of upload slots per torrent, the caller must hold s.mtx
+func (s *SeederStack) slots() int {
+	if s.uploadSlots <= 0 {
+		return UPLOAD_SLOTS
+	}
+	return s.uploadSlots
+}
+
+// runChoker runs a choke round every CHOKE_INTERVAL, rotating the optimistic unchoke every few rounds
+func (s *SeederStack) runChoker() {
+	ticker := time.NewTicker(CHOKE_INTERVAL)
+	defer ticker.Stop()
+
+	roundsPerRotation := int(OPTIMISTIC_UNCHOKE_INTERVAL / CHOKE_INTERVAL)
+	for round := 0; ; round++ {
+		<-ticker.C
+		s.chokeRound(round%roundsPerRotation == 0)
+	}
+}
+
+// chokeRound ranks the interested leechers of every torrent and unchokes the fastest ones. While we are still
+// downloading a torrent, leechers are ranked by how fast they upload to us (tit-for-tat), otherwise by how fast
+// we upload to them. Everyone else is choked, apart from one optimistic unchoke so new leechers get a chance to
+// show what they can do.
+func (s *SeederStack) chokeRound(rotateOptimistic bool) {
+	s.mtx.Lock()
+	slots := s.slots()
+	decisions := []chokeDecision{}
+	for i := range s.seeders {
+		seeder := &s.seeders[i]
+		downloading := seeder.download != nil && seeder.download.missingPieces() > 0
+
+		// Sample every leecher so rates always cover exactly one round
+		interested := []*Leecher{}
+		rates := make(map[*Leecher]transferRate)
+		for _, leecher := range seeder.connectedLeechers {
+			rates[leecher] = leecher.sampleRate()
+			if leecher.conn.isInterested() {
+				interested = append(interested, leecher)
+			}
+		}
+
+		sort.SliceStable(interested, func(a, b int) bool {
+			rateA, rateB := rates[interested[a]], rates[interested[b]]
+			if downloading && rateA.downloaded != rateB.downloaded {
+				return rateA.downloaded > rateB.downloaded
+			}
+			return rateA.uploaded > rateB.uploaded
+		})
+
+		unchoked := make(map[*Leecher]bool)
+		for j := 0; j < len(interested) && j < slots; j++ {
+			unchoked[interested[j]] = true
+		}
+
+		// Keep the optimistic unchoke until it is time to move on, unless it left or lost interest
+		optimistic := seeder.optimistic
+		if rotateOptimistic || optimistic == nil || !containsLeecher(interested, optimistic) || unchoked[optimistic] {
+			optimistic = nil
+			candidates := []*Leecher{}
+			for _, leecher := range interested {
+				if !unchoked[leecher] {
+					candidates = append(candidates, leecher)
+				}
+			}
+			if len(candidates) > 0 {
+				optimistic = candidates[rand.Intn(len(candidates))]
+			}
+		}
+		seeder.optimistic = optimistic
+		if optimistic != nil {
+			unchoked[optimistic] = true
+		}
+
+		for _, leecher := range seeder.connectedLeechers {
+			decisions = append(decisions, chokeDecision{leecher, unchoked[leecher]})
+		}
+	}
+	s.mtx.Unlock()
+
+	// Messages are sent without holding the lock so a slow leecher can't hold up the rest
+	for _, decision := range decisions {
+		var err error
+		if decision.unchoke {
+			err = decision.leecher.conn.setChoking(false)
+		} else {
+			err = decision.leecher.choke()
+		}
+		if err != nil {
+			log.Println("Error updating choke state:", err)
+		}
+	}
+}
+
+// unchokeIfSlotFree unchokes a leecher that just became interested straight away if its torrent has a free upload slot,
+// rather than making it wait for the next choke round
+func (s *SeederStack) unchokeIfSlotFree(infoHash []byte, leecher *Leecher) error {
+	s.mtx.Lock()
+	slots := s.slots()
+	leechers := []*Leecher{}
+	for i := range s.seeders {
+		if bytes.Equal(s.seeders[i].infoHash, infoHash) {
+			leechers = append(leechers, s.seeders[i].connectedLeechers...)
+		}
+	}
+	s.mtx.Unlock()
+
+	unchoked := 0
+	for _, l := range leechers {
+		if l != leecher && !l.conn.isChoking() {
+			unchoked++
+		}
+	}
+	if unchoked >= slots {
+		return nil
+	}
+	return leecher.conn.setChoking(false)
+}
+
+// transferRate is how many bytes of blocks went each way over a connection during the last choke round
+type transferRate struct {
+	downloaded int64
+	uploaded   int64
+}
+
+// sampleRate returns what the leecher transferred since the last sample
+func (l *Leecher) sampleRate() transferRate {
+	downloaded, uploaded := l.conn.transferred()
+
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+
+	rate := transferRate{downloaded - l.lastSample.downloaded, uploaded - l.lastSample.uploaded}
+	l.lastSample = transferRate{downloaded, uploaded}
+	return rate
+}
+
+func containsLeecher(leechers []*Leecher, leecher *Leecher) bool {
+	for _, l := range leechers {
+		if l == leecher {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,195 @@
+package torrent
+
+import (
+	"slices"
+	"testing"
+)
+
+// testLeecher is how a leecher in a choker test behaves every round
+type testLeecher struct {
+	rate       int64 // Bytes transferred in each choke round, uploaded to it or downloaded from it
+	interested bool
+}
+
+// newTestLeechers connects leechers to a seeder on a new stack, over connections that go nowhere and start out choked
+func newTestLeechers(leechers []testLeecher, downloading bool) (*SeederStack, []*Leecher) {
+	seeder := Seeder{infoHash: []byte("choker-test-infohash"), connectedLeechers: []*Leecher{}}
+	if downloading {
+		seeder.download = newTestManager(1, BLOCK_SIZE, 1)
+	}
+	for _, l := range leechers {
+		conn := newPeerConn(&recordConn{})
+		conn.peerInterested = l.interested
+		seeder.connectedLeechers = append(seeder.connectedLeechers, &Leecher{conn: conn, wake: make(chan struct{}, 1)})
+	}
+
+	stack := &SeederStack{}
+	stack.addSeeder(seeder)
+	return stack, seeder.connectedLeechers
+}
+
+// transfer adds a round's worth of traffic to every leecher's connection
+func transfer(leechers []*Leecher, rates []testLeecher, downloading bool) {
+	for i, leecher := range leechers {
+		leecher.conn.mtx.Lock()
+		if downloading {
+			leecher.conn.downloaded += rates[i].rate
+		} else {
+			leecher.conn.uploaded += rates[i].rate
+		}
+		leecher.conn.mtx.Unlock()
+	}
+}
+
+func TestChokeRound(t *testing.T) {
+	tests := []struct {
+		name           string
+		leechers       []testLeecher
+		downloading    bool
+		slots          int
+		wantUnchoked   []int // Unchoked for their rate
+		wantOptimistic []int // One of these gets the optimistic unchoke, none if empty
+	}{
+		{
+			name: "top uploaders plus one optimistic",
+			leechers: []testLeecher{
+				{10, true}, {70, true}, {30, true}, {60, true}, {20, true}, {50, true}, {40, true},
+			},
+			wantUnchoked:   []int{1, 3, 5, 6},
+			wantOptimistic: []int{0, 2, 4},
+		},
+		{
+			name: "ranked by what they send us while downloading",
+			leechers: []testLeecher{
+				{10, true}, {70, true}, {30, true}, {60, true}, {20, true}, {50, true}, {40, true},
+			},
+			downloading:    true,
+			wantUnchoked:   []int{1, 3, 5, 6},
+			wantOptimistic: []int{0, 2, 4},
+		},
+		{
+			name: "leechers that aren't interested never get a slot",
+			leechers: []testLeecher{
+				{1000, false}, {10, true}, {900, false}, {30, true}, {20, true}, {50, true}, {40, true}, {5, true},
+			},
+			wantUnchoked:   []int{3, 5, 6, 4},
+			wantOptimistic: []int{1, 7},
+		},
+		{
+			name: "fewer interested leechers than slots",
+			leechers: []testLeecher{
+				{10, true}, {1000, false}, {30, true}, {20, true},
+			},
+			wantUnchoked: []int{2, 3, 0},
+		},
+		{
+			name: "one more interested leecher than slots",
+			leechers: []testLeecher{
+				{10, true}, {30, true}, {20, true}, {50, true}, {40, true},
+			},
+			wantUnchoked:   []int{3, 4, 1, 2},
+			wantOptimistic: []int{0},
+		},
+		{
+			name: "fewer upload slots",
+			leechers: []testLeecher{
+				{10, true}, {30, true}, {20, true}, {50, true}, {40, true},
+			},
+			slots:          2,
+			wantUnchoked:   []int{3, 4},
+			wantOptimistic: []int{0, 1, 2},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			stack, leechers := newTestLeechers(test.leechers, test.downloading)
+			stack.SetUploadSlots(test.slots)
+
+			transfer(leechers, test.leechers, test.downloading)
+			stack.chokeRound(true)
+
+			unchoked := make(map[int]bool)
+			for i, leecher := range leechers {
+				if !leecher.conn.isChoking() {
+					unchoked[i] = true
+				}
+			}
+			for _, i := range test.wantUnchoked {
+				if !unchoked[i] {
+					t.Errorf("leecher %d is choked, want it unchoked for its rate", i)
+				}
+				delete(unchoked, i)
+			}
+
+			// Whatever is left over is the optimistic unchoke
+			optimistic := []int{}
+			for i := range unchoked {
+				optimistic = append(optimistic, i)
+			}
+			if len(test.wantOptimistic) == 0 {
+				if len(optimistic) != 0 {
+					t.Errorf("leechers %v unchoked as well, want none", optimistic)
+				}
+				return
+			}
+			if len(optimistic) != 1 || !slices.Contains(test.wantOptimistic, optimistic[0]) {
+				t.Fatalf("leechers %v unchoked as well, want one of %v", optimistic, test.wantOptimistic)
+			}
+			stack.mtx.Lock()
+			picked := stack.seeders[0].optimistic
+			stack.mtx.Unlock()
+			if picked != leechers[optimistic[0]] {
+				t.Errorf("seeder's optimistic unchoke isn't the unchoked leecher %d", optimistic[0])
+			}
+
+			// The same rates again keep everyone where they are until the optimistic unchoke moves on
+			transfer(leechers, test.leechers, test.downloading)
+			stack.chokeRound(false)
+			stack.mtx.Lock()
+			kept := stack.seeders[0].optimistic
+			stack.mtx.Unlock()
+			if kept != picked {
+				t.Error("optimistic unchoke moved on before it was time to rotate it")
+			}
+			for _, i := range append(test.wantUnchoked, optimistic[0]) {
+				if leechers[i].conn.isChoking() {
+					t.Errorf("leecher %d choked in the next round, want it to stay unchoked", i)
+				}
+			}
+		})
+	}
+}
+
+func TestUnchokeIfSlotFree(t *testing.T) {
+	tests := []struct {
+		name     string
+		unchoked int // Leechers of the torrent that are unchoked already
+		slots    int
+		want     bool
+	}{
+		{name: "free slot", unchoked: UPLOAD_SLOTS - 1, want: true},
+		{name: "every slot taken", unchoked: UPLOAD_SLOTS, want: false},
+		{name: "no one unchoked", unchoked: 0, want: true},
+		{name: "fewer upload slots", unchoked: 2, slots: 2, want: false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			stack, leechers := newTestLeechers(make([]testLeecher, test.unchoked+1), false)
+			stack.SetUploadSlots(test.slots)
+			for _, leecher := range leechers[:test.unchoked] {
+				leecher.conn.setChoking(false)
+			}
+
+			newcomer := leechers[test.unchoked]
+			err := stack.unchokeIfSlotFree(stack.seeders[0].infoHash, newcomer)
+			if err != nil {
+				t.Fatalf("unchokeIfSlotFree() error = %v", err)
+			}
+			if got := !newcomer.conn.isChoking(); got != test.want {
+				t.Errorf("newcomer unchoked = %v, want %v", got, test.want)
+			}
+		})
+	}
+}
@@ -16,6 +16,16 @@ func UnmarshalTorrent(data []byte) (*Torrent, error) {
         return nil, fmt.Errorf("failed to decode torrent file: %v", err)
     }
 
+    // Keep the original bytes of the info dictionary for the info_hash
+    var raw struct {
+        Info bencode.RawMessage `bencode:"info"`
+    }
+    err = bencode.NewDecoder(bytes.NewReader(data)).Decode(&raw)
+    if err != nil {
+        return nil, fmt.Errorf("failed to decode info dictionary: %v", err)
+    }
+    torrent.RawInfo = raw.Info
+
     return &torrent, nil
 }
 
@@ -0,0 +1,766 @@
+package torrent
+
+import (
+	"bittorrent/pkg/trackingserver"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"strconv"
+	"sync"
+)
+
+// MAX_PEER_CONNECTIONS caps how many peers a single download talks to at once
+const MAX_PEER_CONNECTIONS = 30
+
+// A piece that fails its hash check is thrown away and downloaded again, but a peer that sent us
+// MAX_HASH_FAILURES bad pieces is disconnected, since it is most likely corrupt or malicious
+const MAX_HASH_FAILURES = 3
+
+// MAX_OUTSTANDING_REQUESTS is how many block requests we keep in flight to each peer unless told otherwise
+const MAX_OUTSTANDING_REQUESTS = 10
+
+// DownloadOptions tunes how a download runs, the zero value uses the defaults
+type DownloadOptions struct {
+	Picker                 PiecePicker // Decides which piece to download next, RarestFirstPicker if nil
+	MaxOutstandingRequests int         // Block requests kept in flight to each peer, MAX_OUTSTANDING_REQUESTS if 0
+}
+
+// downloadManager connects to many peers at once and hands pieces out to one worker goroutine per peer,
+// writing the verified pieces into a single disk-backed piece store. Each worker only claims pieces that
+// its peer actually has, and the picker chooses between them. The manager keeps count of which blocks have
+// been requested, and once every block we still need has been requested from some peer, the download goes into
+// endgame mode. Every unchoked peer then gets asked for every outstanding block of the pieces it has, and the
+// duplicate requests are cancelled as soon as a block arrives, so a slow peer can't hold up the end of the download.
+type downloadManager struct {
+	torrent  Torrent
+	infoHash []byte
+	stack    *SeederStack     // Incoming leechers are told about new pieces through the stack
+	picker   PiecePicker      // Chooses which piece a worker claims next
+	pipeline int              // How many block requests each worker keeps in flight
+	results  chan pieceResult // Verified pieces coming back from the workers
+	done     chan struct{}    // Closed once the download finishes so idle workers can exit
+
+	mtx          sync.Mutex
+	peers        []*peerConn              // Every peer we are connected to, so they can be told about new pieces
+	bitfield     []byte                   // The pieces we have
+	inProgress   []bool                   // Pieces a worker has claimed but not delivered yet
+	active       map[uint32]*partialPiece // The pieces that are in progress, so endgame workers can join them
+	endgame      bool                     // Set once every block we still need has been requested at least once
+	availability []int                    // How many of the peers we are connected to have each piece
+	partial      map[uint32]*partialPiece // Pieces a worker gave up on part way through, keeping the blocks it got
+	changed      chan struct{}            // Closed and replaced whenever a claimed piece is handed back or endgame mode starts
+	arrived      chan struct{}            // Closed and replaced whenever a block arrives that other workers have requested too
+	storage      *pieceStorage            // The piece store, written straight to disk
+	resume       *ResumeData              // Persisted every time a piece is stored
+	announce     *announceState           // Counts the bytes we download for the trackers
+}
+
+// pieceResult is a piece that a worker downloaded and verified
+type pieceResult struct {
+	index uint32
+	data  []byte
+}
+
+// DownloadFromSeeders downloads a torrent to savePath, which is the file itself for single-file torrents and the
+// directory to put the files in for multi-file torrents. Files keep PART_SUFFIX until the download completes.
+// If an earlier download to savePath was interrupted, its pieces are re-verified and only the missing ones are downloaded.
+// While downloading, the torrent is registered with seederStack so other peers can fetch the pieces we already have.
+func DownloadFromSeeders(seederStack *SeederStack, peers []trackingserver.Peer, torrent Torrent, savePath string, peerID string, options DownloadOptions) (string, error) {
+	totalPieces := uint32(torrent.Info.NumPieces())
+
+	infoHash, err := torrent.HashInfo()
+	if err != nil {
+		return "", err
+	}
+
+	storage, err := openStorage(savePath, &torrent.Info)
+	if err != nil {
+		return "", fmt.Errorf("failed to open storage: %v", err)
+	}
+
+	resume := &ResumeData{
+		InfoHash:    infoHash,
+		SavePath:    savePath,
+		PieceLength: torrent.Info.PieceLength,
+		Bitfield:    make([]byte, (totalPieces+7)/8), // Make a bitfield to track the pieces that we have
+	}
+
+	// Pick up where an earlier download left off, trusting only the pieces that still hash correctly
+	previous, err := loadResumeData(savePath)
+	if err != nil {
+		log.Println("Ignoring resume data:", err)
+	} else if previous != nil && previous.matches(infoHash, &torrent.Info) {
+		resume.Bitfield = verifyPieces(storage, torrent, previous.Bitfield)
+	}
+
+	picker := options.Picker
+	if picker == nil {
+		picker = RarestFirstPicker{}
+	}
+	pipeline := options.MaxOutstandingRequests
+	if pipeline <= 0 {
+		pipeline = MAX_OUTSTANDING_REQUESTS
+	}
+
+	manager := &downloadManager{
+		torrent:      torrent,
+		infoHash:     infoHash,
+		stack:        seederStack,
+		picker:       picker,
+		pipeline:     pipeline,
+		results:      make(chan pieceResult, totalPieces),
+		done:         make(chan struct{}),
+		bitfield:     resume.Bitfield,
+		inProgress:   make([]bool, totalPieces),
+		availability: make([]int, totalPieces),
+		partial:      make(map[uint32]*partialPiece),
+		active:       make(map[uint32]*partialPiece),
+		changed:      make(chan struct{}),
+		arrived:      make(chan struct{}),
+		storage:      storage,
+		resume:       resume,
+	}
+	log.Println("Resuming with", totalPieces-uint32(manager.missingPieces()), "/", totalPieces, "pieces")
+
+	err = resume.save()
+	if err != nil {
+		storage.Close()
+		return "", fmt.Errorf("failed to save resume data: %v", err)
+	}
+
+	// Serve the pieces we have to other peers while we download the rest
+	seederStack.mtx.Lock()
+	seederPort := seederStack.port
+	seederStack.mtx.Unlock()
+	state, fresh := seederStack.addSeeder(Seeder{
+		addr:              &net.TCPAddr{IP: net.ParseIP("127.0.0.1"), Port: seederPort},
+		infoHash:          infoHash,
+		peerID:            []byte(peerID),
+		filepath:          savePath,
+		info:              torrent.Info,
+		connectedLeechers: []*Leecher{},
+		download:          manager,
+		trackers:          torrent.Trackers(),
+	})
+	manager.announce = state
+	if fresh {
+		go seederStack.startAnnouncing(infoHash, state)
+	}
+
+	// Trackers are only told about downloads that finish while we are running
+	downloading := manager.missingPieces() > 0
+
+	err = manager.run(uniquePeers(peers), peerID)
+	if err != nil {
+		// Leave the partial files behind so the download isn't thrown away
+		seederStack.removeSeeder(infoHash)
+		storage.Close()
+		return "", err
+	}
+
+	err = storage.Complete()
+	if err != nil {
+		seederStack.removeSeeder(infoHash)
+		return "", fmt.Errorf("failed to finish download: %v", err)
+	}
+
+	err = resume.remove()
+	if err != nil {
+		log.Println("Error removing resume data:", err)
+	}
+
+	if downloading {
+		state.complete()
+	}
+
+	return savePath, nil
+}
+
+// uniquePeers drops repeated peers, since the tracker can return the same peer more than once
+func uniquePeers(peers []trackingserver.Peer) []trackingserver.Peer {
+	seen := make(map[string]bool)
+	unique := make([]trackingserver.Peer, 0, len(peers))
+	for _, peer := range peers {
+		addr := net.JoinHostPort(peer.IP, strconv.Itoa(peer.Port))
+		if seen[addr] {
+			continue
+		}
+		seen[addr] = true
+		unique = append(unique, peer)
+	}
+	return unique
+}
+
+// missingPieces counts the pieces we don't have yet
+func (m *downloadManager) missingPieces() int {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+
+	missing := 0
+	for pieceIndex := uint32(0); pieceIndex < uint32(len(m.inProgress)); pieceIndex++ {
+		if !hasPiece(m.bitfield, pieceIndex) {
+			missing++
+		}
+	}
+	return missing
+}
+
+// bytesLeft counts the bytes of the pieces we don't have yet
+func (m *downloadManager) bytesLeft() int64 {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+
+	var left int64
+	for pieceIndex := uint32(0); pieceIndex < uint32(len(m.inProgress)); pieceIndex++ {
+		if !hasPiece(m.bitfield, pieceIndex) {
+			_, pieceLength := m.torrent.Info.pieceBounds(pieceIndex)
+			left += pieceLength
+		}
+	}
+	return left
+}
+
+// havePieces returns a copy of our bitfield, for sending to other peers
+func (m *downloadManager) havePieces() []byte {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+
+	bitfield := make([]byte, len(m.bitfield))
+	copy(bitfield, m.bitfield)
+	return bitfield
+}
+
+// hasPiece reports whether the piece has been verified and written to storage
+func (m *downloadManager) hasPiece(pieceIndex uint32) bool {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	return hasPiece(m.bitfield, pieceIndex)
+}
+
+// run starts a worker for every peer and collects pieces until the download is complete or every worker has given up
+func (m *downloadManager) run(peers []trackingserver.Peer, peerID string) error {
+	if len(peers) > MAX_PEER_CONNECTIONS {
+		peers = peers[:MAX_PEER_CONNECTIONS]
+	}
+
+	// Count what is left before the workers start taking pieces
+	totalPieces := m.torrent.Info.NumPieces()
+	remaining := m.missingPieces()
+
+	var wg sync.WaitGroup
+	for _, peer := range peers {
+		wg.Add(1)
+		go func(peer trackingserver.Peer) {
+			defer wg.Done()
+			err := m.peerWorker(peer, peerID)
+			if err != nil {
+				log.Println("Peer", peer.IP, peer.Port, "stopped:", err)
+			}
+		}(peer)
+	}
+
+	// Lets us notice when every worker has exited
+	workersDone := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(workersDone)
+	}()
+	defer close(m.done)
+
+	for remaining > 0 {
+		select {
+		case result := <-m.results:
+			stored, err := m.storePiece(result)
+			if err != nil {
+				return err
+			}
+			if stored {
+				remaining--
+				log.Println("Pieces downloaded: ", totalPieces-remaining, "/", totalPieces)
+			}
+		case <-workersDone:
+			// Workers may have delivered pieces right before exiting
+			for len(m.results) > 0 {
+				stored, err := m.storePiece(<-m.results)
+				if err != nil {
+					return err
+				}
+				if stored {
+					remaining--
+				}
+			}
+			if remaining > 0 {
+				return fmt.Errorf("failed to download from all seeders, %d pieces missing", remaining)
+			}
+		}
+	}
+
+	return nil
+}
+
+// storePiece writes a verified piece into the piece store, returning false if we already had it
+func (m *downloadManager) storePiece(result pieceResult) (bool, error) {
+	m.mtx.Lock()
+	m.inProgress[result.index] = false
+	delete(m.partial, result.index)
+	delete(m.active, result.index)
+	if hasPiece(m.bitfield, result.index) {
+		m.mtx.Unlock()
+		return false, nil
+	}
+
+	err := m.storage.WritePiece(result.index, result.data)
+	if err != nil {
+		m.mtx.Unlock()
+		return false, fmt.Errorf("failed to write piece %d: %v", result.index, err)
+	}
+	setPiece(m.bitfield, result.index)
+	m.announce.addDownloaded(int64(len(result.data)))
+	m.stack.metrics.add(func(c *stackCounters) {
+		c.downloaded += int64(len(result.data))
+		c.piecesStored++
+	})
+
+	// The bitfield is shared with the resume data, so this records the new piece
+	err = m.resume.save()
+	if err != nil {
+		log.Println("Error saving resume data:", err)
+	}
+	m.mtx.Unlock()
+
+	// Let every peer know that we have the piece now. The connections we dialed are registered with the
+	// stack as well, so this reaches both the peers we download from and the ones downloading from us.
+	m.stack.broadcastHave(m.infoHash, result.index)
+
+	return true, nil
+}
+
+// claimPiece lets the picker choose one of the pieces that the peer has and that nobody else is working on,
+// picking up the blocks we already have if the piece was started before. In endgame mode it joins a piece
+// that other workers are already on instead, leaving out the ones in the worker's pipeline, and outside of it
+// a full pipeline doesn't get another piece. If there isn't one, it returns a channel that is closed once a
+// claimed piece gets handed back or endgame mode starts.
+func (m *downloadManager) claimPiece(peer *peerConn, pipeline *peerPipeline) (*partialPiece, <-chan struct{}) {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+
+	state := &PickState{
+		Candidates:   []uint32{},
+		Availability: m.availability,
+		Partial:      make([]bool, len(m.inProgress)),
+		Completed:    len(m.inProgress),
+	}
+	for pieceIndex := uint32(0); pieceIndex < uint32(len(m.inProgress)); pieceIndex++ {
+		if hasPiece(m.bitfield, pieceIndex) {
+			continue
+		}
+		state.Completed--
+		if m.inProgress[pieceIndex] || !peer.hasPiece(pieceIndex) {
+			continue
+		}
+		state.Candidates = append(state.Candidates, pieceIndex)
+		state.Partial[pieceIndex] = m.partial[pieceIndex] != nil
+	}
+	if len(state.Candidates) == 0 || pipeline.full() {
+		piece := m.endgamePiece(peer, pipeline)
+		if piece == nil {
+			return nil, m.changed
+		}
+		piece.workers++
+		return piece, nil
+	}
+
+	pieceIndex := m.picker.Pick(state)
+	m.inProgress[pieceIndex] = true
+
+	piece, ok := m.partial[pieceIndex]
+	if ok {
+		delete(m.partial, pieceIndex)
+	} else {
+		piece = newPartialPiece(&m.torrent.Info, pieceIndex)
+	}
+	piece.workers = 1
+	m.active[pieceIndex] = piece
+	return piece, nil
+}
+
+// endgamePiece finds a piece in progress for a worker to join, once every block we still need has been requested.
+// Pieces with the fewest workers come first, so the duplicate requests get spread out. The caller must hold m.mtx.
+func (m *downloadManager) endgamePiece(peer *peerConn, pipeline *peerPipeline) *partialPiece {
+	if m.unrequestedLeft() {
+		return nil
+	}
+
+	var best *partialPiece
+	for pieceIndex, piece := range m.active {
+		if piece.delivered || !peer.hasPiece(pieceIndex) || pipeline.holds(piece) {
+			continue
+		}
+		if best == nil || piece.workers < best.workers || (piece.workers == best.workers && piece.index < best.index) {
+			best = piece
+		}
+	}
+
+	return best
+}
+
+// unrequestedLeft reports whether any block we still need hasn't been requested from a peer yet, either because
+// nobody has claimed its piece or because the worker on it hasn't got to it. The caller must hold m.mtx.
+func (m *downloadManager) unrequestedLeft() bool {
+	for pieceIndex := uint32(0); pieceIndex < uint32(len(m.inProgress)); pieceIndex++ {
+		if !hasPiece(m.bitfield, pieceIndex) && !m.inProgress[pieceIndex] {
+			return true
+		}
+	}
+	for _, piece := range m.active {
+		for i, requested := range piece.requested {
+			if requested == 0 && !piece.hasBlock(i) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// nextRequests picks the blocks of the worker's pieces that it should request next and counts them as requested.
+// Normally it picks blocks nobody has requested, until the worker's pipeline is full. In endgame mode it picks every
+// block of the worker's pieces that hasn't arrived and that the worker hasn't requested yet, however many other
+// workers are waiting on it, so the last blocks come from whichever peer is quickest.
+func (m *downloadManager) nextRequests(pipeline *peerPipeline) []block {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+
+	endgame := !m.unrequestedLeft()
+	room := m.pipeline - len(pipeline.requested)
+	blocks := []block{}
+	for _, piece := range pipeline.pieces {
+		for i, b := range m.torrent.Info.pieceBlocks(piece.index) {
+			if !endgame && room <= 0 {
+				break
+			}
+			if _, ok := pipeline.requested[b]; ok || piece.hasBlock(i) || (!endgame && piece.requested[i] > 0) {
+				continue
+			}
+			piece.requested[i]++
+			blocks = append(blocks, b)
+			room--
+		}
+	}
+
+	if !endgame && len(blocks) > 0 && !m.unrequestedLeft() {
+		// Wake the idle workers so they can join in
+		if !m.endgame {
+			log.Println("Entering endgame mode")
+			m.endgame = true
+		}
+		close(m.changed)
+		m.changed = make(chan struct{})
+	}
+	return blocks
+}
+
+// unrequest counts a block as no longer requested by a worker, because it arrived, the request was cancelled or the
+// peer choked us
+func (m *downloadManager) unrequest(piece *partialPiece, b block) {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	piece.requested[b.begin/BLOCK_SIZE]--
+}
+
+// releasePiece hands a claimed piece back so another worker can pick it up, keeping any blocks it got.
+// Nothing changes while other workers are still on the piece.
+func (m *downloadManager) releasePiece(piece *partialPiece) {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+
+	piece.workers--
+	if piece.workers > 0 || piece.delivered {
+		return
+	}
+
+	m.inProgress[piece.index] = false
+	delete(m.active, piece.index)
+	if piece.hasBlocks() {
+		m.partial[piece.index] = piece
+	}
+	close(m.changed)
+	m.changed = make(chan struct{})
+}
+
+// deliverPiece is called by every worker that finishes downloading a piece, and returns true for just one of them
+// so the piece is only checked and stored once when several workers are on it in endgame mode
+func (m *downloadManager) deliverPiece(piece *partialPiece) bool {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+
+	piece.workers--
+	if piece.delivered {
+		return false
+	}
+	piece.delivered = true
+	return true
+}
+
+// addBlock puts a block a worker received into its piece. If other workers still have requests out for the
+// block in endgame mode, they get woken up so they can cancel them.
+func (m *downloadManager) addBlock(piece *partialPiece, i int, data []byte) {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+
+	if piece.addBlock(i, data) && piece.requested[i] > 0 {
+		close(m.arrived)
+		m.arrived = make(chan struct{})
+	}
+}
+
+// blockArrived returns a channel that is closed the next time a block arrives that other workers have requested too
+func (m *downloadManager) blockArrived() <-chan struct{} {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	return m.arrived
+}
+
+// discardPiece throws a piece that failed its hash check away so it gets downloaded again from scratch,
+// since we can't tell which of its blocks was bad
+func (m *downloadManager) discardPiece(piece *partialPiece) {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+
+	m.inProgress[piece.index] = false
+	delete(m.active, piece.index)
+	close(m.changed)
+	m.changed = make(chan struct{})
+}
+
+// peerHas counts pieces that a peer has towards their availability
+func (m *downloadManager) peerHas(pieceIndices []uint32) {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+
+	for _, pieceIndex := range pieceIndices {
+		m.availability[pieceIndex]++
+	}
+}
+
+// interestedIn reports whether the peer has any piece that we still need
+func (m *downloadManager) interestedIn(peer *peerConn) bool {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+
+	for pieceIndex := uint32(0); pieceIndex < uint32(len(m.inProgress)); pieceIndex++ {
+		if !hasPiece(m.bitfield, pieceIndex) && peer.hasPiece(pieceIndex) {
+			return true
+		}
+	}
+	return false
+}
+
+// peerWorker downloads pieces from a single peer, claiming pieces the peer has until there are none left.
+// If the peer fails, the pieces it was working on are handed back for the other workers.
+func (m *downloadManager) peerWorker(peer trackingserver.Peer, peerID string) error {
+	conn, err := connectToPeer(peer, m.torrent, peerID)
+	if err != nil {
+		if errors.Is(err, errHandshakeFailed) {
+			m.stack.metrics.add(func(c *stackCounters) { c.outgoingHandshakeFailures++ })
+		}
+		return err
+	}
+	defer conn.Close()
+
+	// Availability is only counted for the peers we are connected to
+	conn.onHave = m.peerHas
+	m.addPeer(conn)
+	defer m.removePeer(conn)
+
+	// Unblock any read that is still waiting on this peer once the download is over
+	workerDone := make(chan struct{})
+	defer close(workerDone)
+
+	// The peer can download from us over the same connection, which also gives it a reason to keep unchoking us
+	err = m.uploadOver(conn, []byte(peer.PeerID), workerDone)
+	if err != nil {
+		return err
+	}
+
+	go func() {
+		select {
+		case <-m.done:
+			conn.Close()
+		case <-workerDone:
+		}
+	}()
+	go conn.keepAlive(workerDone)
+
+	// Messages are read on their own goroutine so we can wait on the peer and the other workers at the same time
+	messages := make(chan *Message)
+	readErr := make(chan error, 1)
+	go conn.readLoop(messages, readErr, workerDone)
+
+	numPieces := m.torrent.Info.NumPieces()
+	hashFailures := 0
+	pipeline := newPeerPipeline(conn, m)
+
+	// Hand back what we were still downloading so the other workers can finish it
+	defer pipeline.drop()
+	for {
+		arrived := m.blockArrived()
+
+		// Cancel the requests for blocks that another peer has already sent us
+		err = pipeline.cancelReceived()
+		if err != nil {
+			return err
+		}
+
+		for _, piece := range pipeline.finished() {
+			// In endgame mode another worker on the same piece may be handing it in already
+			if !m.deliverPiece(piece) {
+				continue
+			}
+
+			// Validate the piece data
+			valid, err := validatePiece(m.torrent, piece.index, piece.data)
+			if err != nil || !valid {
+				log.Println("Piece", piece.index, "failed validation")
+				m.discardPiece(piece)
+				m.stack.metrics.add(func(c *stackCounters) { c.hashFailures++ })
+
+				// One bad piece can be a fluke, so the piece is just downloaded again
+				hashFailures++
+				if hashFailures >= MAX_HASH_FAILURES {
+					return fmt.Errorf("%d pieces failed validation", hashFailures)
+				}
+				continue
+			}
+
+			m.results <- pieceResult{piece.index, piece.data}
+		}
+
+		var changed <-chan struct{}
+		if conn.isChoked() {
+			pipeline.drop()
+		} else {
+			// Top the pipeline back up, taking on the next piece as soon as every block of the ones we have is
+			// requested. In endgame mode this asks the peer for every block of its pieces that we are still missing.
+			for {
+				err = pipeline.fill()
+				if err != nil {
+					return err
+				}
+
+				var piece *partialPiece
+				piece, changed = m.claimPiece(conn, pipeline)
+				if piece == nil {
+					break
+				}
+				pipeline.add(piece)
+
+				// Tell the peer we want its pieces
+				err = conn.setInterested(true)
+				if err != nil {
+					return err
+				}
+			}
+		}
+
+		if len(pipeline.pieces) == 0 {
+			// Nothing to ask this peer for right now, wait for it to get a new piece or for a piece to be handed back
+			err = conn.setInterested(m.interestedIn(conn))
+			if err != nil {
+				return err
+			}
+		}
+
+		select {
+		case message := <-messages:
+			if message.Length == 0 || message.ID != Piece {
+				err = handleSeederMessage(conn, message, numPieces)
+				if err != nil {
+					return err
+				}
+				continue
+			}
+
+			piece, i, blockData, err := pipeline.receive(message)
+			if err != nil {
+				return err
+			}
+			if piece != nil {
+				m.addBlock(piece, i, blockData)
+			}
+		case err := <-readErr:
+			return err
+		case <-changed:
+		case <-arrived:
+		case <-m.done:
+			return nil
+		}
+	}
+}
+
+// uploadOver serves the peer's requests over a connection we dialed, the same way as the connections leechers open to
+// us. The peer gets our bitfield first and is then registered with the stack, which sends it have messages and lets
+// the choker rank it, until done is closed.
+func (m *downloadManager) uploadOver(conn *peerConn, peerID []byte, done <-chan struct{}) error {
+	sent := m.havePieces()
+	err := conn.send(newBitfieldMessage(sent))
+	if err != nil {
+		return err
+	}
+
+	leecher := &Leecher{
+		infoHash: m.infoHash,
+		peerID:   peerID,
+		conn:     conn,
+		wake:     make(chan struct{}, 1),
+	}
+	seeder, ok := m.stack.addLeecher(m.infoHash, leecher)
+	if !ok {
+		// The torrent was removed, the download is about to stop
+		return nil
+	}
+	conn.onUpload = func(message *Message) error {
+		return m.stack.handleUploadMessage(m.infoHash, leecher, message)
+	}
+	go seeder.serveRequests(leecher, done)
+	go func() {
+		<-done
+		m.stack.removeLeecher(m.infoHash, leecher)
+	}()
+
+	// Pieces stored while we were registering weren't broadcast to this peer yet
+	have := m.havePieces()
+	for pieceIndex := uint32(0); pieceIndex < uint32(m.torrent.Info.NumPieces()); pieceIndex++ {
+		if hasPiece(have, pieceIndex) && !hasPiece(sent, pieceIndex) {
+			err = conn.send(newHaveMessage(pieceIndex))
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (m *downloadManager) addPeer(peer *peerConn) {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	m.peers = append(m.peers, peer)
+}
+
+func (m *downloadManager) removePeer(peer *peerConn) {
+	pieceIndices := peer.pieces()
+
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+
+	// The peer's pieces aren't available from it anymore
+	for _, pieceIndex := range pieceIndices {
+		m.availability[pieceIndex]--
+	}
+	for i, p := range m.peers {
+		if p == peer {
+			m.peers = append(m.peers[:i], m.peers[i+1:]...)
+			return
+		}
+	}
+}
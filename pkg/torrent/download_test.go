@@ -0,0 +1,255 @@
+package torrent
+
+import (
+	"bittorrent/pkg/trackingserver"
+	"bytes"
+	"crypto/sha1"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// newTestTorrent writes the files of a torrent to path and hashes them into pieces of pieceLength, returning the
+// torrent along with its data. A single file without path segments makes a single-file torrent.
+func newTestTorrent(t *testing.T, path string, files []TorrentFile, pieceLength int) (Torrent, []byte) {
+	t.Helper()
+
+	data := writeTestFiles(t, path, files)
+	info := TorrentInfo{Name: filepath.Base(path), PieceLength: pieceLength}
+	if len(files) == 1 && len(files[0].Path) == 0 {
+		info.Length = files[0].Length
+	} else {
+		info.Files = files
+	}
+	for start := 0; start < len(data); start += pieceLength {
+		pieceHash := sha1.Sum(data[start:min(start+pieceLength, len(data))])
+		info.Pieces = append(info.Pieces, pieceHash[:]...)
+	}
+
+	return Torrent{Info: info}, data
+}
+
+// startTestSeeder seeds the torrent from the files at path on a SeederStack of its own, accepting connections on a
+// free loopback port the same way Listen does, and returns the peer to download from
+func startTestSeeder(t *testing.T, torrent Torrent, path string, peerID string) (*SeederStack, trackingserver.Peer) {
+	t.Helper()
+
+	infoHash, err := torrent.HashInfo()
+	if err != nil {
+		t.Fatalf("HashInfo() error = %v", err)
+	}
+	stack := &SeederStack{}
+	stack.addSeeder(Seeder{
+		infoHash:          infoHash,
+		peerID:            []byte(peerID),
+		filepath:          path,
+		info:              torrent.Info,
+		connectedLeechers: []*Leecher{},
+	})
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("error listening: %v", err)
+	}
+	t.Cleanup(func() {
+		listener.Close()
+		stack.removeSeeder(infoHash)
+	})
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go stack.handleConn(&Leecher{conn: newPeerConn(conn), wake: make(chan struct{}, 1)})
+		}
+	}()
+
+	return stack, trackingserver.Peer{PeerID: peerID, IP: "127.0.0.1", Port: listener.Addr().(*net.TCPAddr).Port}
+}
+
+// readTestDownload reads back the files of a finished download in torrent order
+func readTestDownload(t *testing.T, savePath string, info *TorrentInfo) []byte {
+	t.Helper()
+
+	entries, err := info.fileEntries(savePath)
+	if err != nil {
+		t.Fatalf("fileEntries() error = %v", err)
+	}
+	data := []byte{}
+	for _, entry := range entries {
+		content, err := os.ReadFile(entry.path)
+		if err != nil {
+			t.Fatalf("error reading downloaded file: %v", err)
+		}
+		data = append(data, content...)
+	}
+	return data
+}
+
+func TestDownloadFromSeeders(t *testing.T) {
+	tests := []struct {
+		name        string
+		files       []TorrentFile
+		pieceLength int
+		seeders     int
+	}{
+		{
+			name:        "one seeder",
+			files:       []TorrentFile{{Length: 5*BLOCK_SIZE + 100}},
+			pieceLength: BLOCK_SIZE,
+			seeders:     1,
+		},
+		{
+			name:        "three seeders",
+			files:       []TorrentFile{{Length: 20*BLOCK_SIZE + 100}},
+			pieceLength: BLOCK_SIZE,
+			seeders:     3,
+		},
+		{
+			name:        "pieces of several blocks from two seeders",
+			files:       []TorrentFile{{Length: 9*BLOCK_SIZE + 100}},
+			pieceLength: 4 * BLOCK_SIZE,
+			seeders:     2,
+		},
+		{
+			name: "multi-file torrent from two seeders",
+			files: []TorrentFile{
+				{Length: BLOCK_SIZE + 10, Path: []string{"a"}},
+				{Length: 3, Path: []string{"b"}},
+				{Length: 3 * BLOCK_SIZE, Path: []string{"sub", "c"}},
+			},
+			pieceLength: 2 * BLOCK_SIZE,
+			seeders:     2,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			dir := t.TempDir()
+			torrent, data := newTestTorrent(t, filepath.Join(dir, "seeded"), test.files, test.pieceLength)
+
+			peers := []trackingserver.Peer{}
+			for i := 0; i < test.seeders; i++ {
+				_, peer := startTestSeeder(t, torrent, filepath.Join(dir, "seeded"), fmt.Sprintf("-TEST-seeder-%07d", i))
+				peers = append(peers, peer)
+			}
+
+			stack := &SeederStack{}
+			defer stack.StopAll()
+			savePath := filepath.Join(dir, "downloaded")
+			got, err := DownloadFromSeeders(stack, peers, torrent, savePath, "-TEST-leecher-000001", DownloadOptions{})
+			if err != nil {
+				t.Fatalf("DownloadFromSeeders() error = %v", err)
+			}
+			if got != savePath {
+				t.Errorf("DownloadFromSeeders() = %s, want %s", got, savePath)
+			}
+
+			if !bytes.Equal(readTestDownload(t, savePath, &torrent.Info), data) {
+				t.Error("downloaded data doesn't match what was seeded")
+			}
+			if _, err := os.Stat(savePath + RESUME_SUFFIX); !os.IsNotExist(err) {
+				t.Errorf("resume file left behind after the download, stat error = %v", err)
+			}
+			if m := stack.metrics.snapshot(); m.piecesStored != int64(torrent.Info.NumPieces()) || m.hashFailures != 0 {
+				t.Errorf("stored %d pieces with %d hash failures, want %d and 0", m.piecesStored, m.hashFailures, torrent.Info.NumPieces())
+			}
+		})
+	}
+}
+
+func TestDownloadCorruptPiece(t *testing.T) {
+	const corruptPiece = 2
+
+	tests := []struct {
+		name         string
+		goodSeeder   bool // Whether a seeder with the right data is there too
+		wantErr      bool
+		wantFailures int // Hash failures, -1 if it depends on which seeder piece 2 comes from
+	}{
+		{
+			// Every copy of the piece is bad, so it is fetched again until the peer gets dropped
+			name:         "only a corrupt seeder",
+			wantErr:      true,
+			wantFailures: MAX_HASH_FAILURES,
+		},
+		{
+			name:         "corrupt seeder alongside a good one",
+			goodSeeder:   true,
+			wantFailures: -1,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			dir := t.TempDir()
+			torrent, data := newTestTorrent(t, filepath.Join(dir, "seeded"), []TorrentFile{{Length: 6 * BLOCK_SIZE}}, BLOCK_SIZE)
+
+			// The corrupt seeder serves a copy with one byte of the piece flipped
+			corrupt := append([]byte{}, data...)
+			corrupt[corruptPiece*BLOCK_SIZE+100] ^= 0xff
+			err := os.WriteFile(filepath.Join(dir, "corrupt"), corrupt, 0644)
+			if err != nil {
+				t.Fatalf("error writing corrupt copy: %v", err)
+			}
+			corruptStack, corruptPeer := startTestSeeder(t, torrent, filepath.Join(dir, "corrupt"), "-TEST-corrupt-000001")
+
+			peers := []trackingserver.Peer{corruptPeer}
+			if test.goodSeeder {
+				_, peer := startTestSeeder(t, torrent, filepath.Join(dir, "seeded"), "-TEST-seeder-0000001")
+				peers = append(peers, peer)
+			}
+
+			stack := &SeederStack{}
+			defer stack.StopAll()
+			savePath := filepath.Join(dir, "downloaded")
+			_, err = DownloadFromSeeders(stack, peers, torrent, savePath, "-TEST-leecher-000001", DownloadOptions{})
+			if (err != nil) != test.wantErr {
+				t.Fatalf("DownloadFromSeeders() error = %v, wantErr %v", err, test.wantErr)
+			}
+
+			m := stack.metrics.snapshot()
+			if test.wantFailures >= 0 && m.hashFailures != int64(test.wantFailures) {
+				t.Errorf("%d hash failures, want %d", m.hashFailures, test.wantFailures)
+			}
+			if m.hashFailures > MAX_HASH_FAILURES {
+				t.Errorf("%d hash failures, the corrupt seeder should have been dropped after %d", m.hashFailures, MAX_HASH_FAILURES)
+			}
+
+			if test.wantErr {
+				// The good pieces are kept for a later attempt, the bad one isn't
+				resume, err := loadResumeData(savePath)
+				if err != nil || resume == nil {
+					t.Fatalf("loadResumeData() = %v, %v, want the resume data", resume, err)
+				}
+				for pieceIndex := uint32(0); pieceIndex < uint32(torrent.Info.NumPieces()); pieceIndex++ {
+					if hasPiece(resume.Bitfield, pieceIndex) != (pieceIndex != corruptPiece) {
+						t.Errorf("resume data has piece %d = %v, want %v", pieceIndex, hasPiece(resume.Bitfield, pieceIndex), pieceIndex != corruptPiece)
+					}
+				}
+
+				// The download hung up on the corrupt seeder, which notices once it reads from the closed connection
+				leechers := func() int {
+					corruptStack.mtx.Lock()
+					defer corruptStack.mtx.Unlock()
+					return len(corruptStack.seeders[0].connectedLeechers)
+				}
+				for start := time.Now(); leechers() > 0 && time.Since(start) < time.Second; time.Sleep(10 * time.Millisecond) {
+				}
+				if n := leechers(); n != 0 {
+					t.Errorf("corrupt seeder still has %d leechers", n)
+				}
+				return
+			}
+
+			if !bytes.Equal(readTestDownload(t, savePath, &torrent.Info), data) {
+				t.Error("downloaded data doesn't match what was seeded")
+			}
+		})
+	}
+}
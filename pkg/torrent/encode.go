@@ -2,9 +2,7 @@ package torrent
 
 import (
 	"bytes"
-	"crypto/sha1"
 	"fmt"
-	"io"
 	"net"
 	"os"
 	"strings"
@@ -12,62 +10,120 @@ import (
 	"github.com/zeebo/bencode"
 )
 
-const PIECE_SIZE = 16 * 1024 // 16 KB
+// Piece lengths are always a power of two between these bounds
+const (
+	MIN_PIECE_LENGTH   = 16 * 1024        // 16 KB
+	MAX_PIECE_LENGTH   = 16 * 1024 * 1024 // 16 MB
+	TARGET_PIECE_COUNT = 1500             // Roughly how many pieces ChoosePieceLength aims for
+)
 
-func CreateTorrentFile(seederStack *SeederStack, filePath string, peerID string) ([]byte, error) {
-	// Open the file
-	file, err := os.Open(filePath)
-	if err != nil {
-		return nil, err
+// ChoosePieceLength picks the smallest power of two piece length that keeps the torrent at or under TARGET_PIECE_COUNT pieces
+func ChoosePieceLength(totalLength int64) int {
+	pieceLength := MIN_PIECE_LENGTH
+	for pieceLength < MAX_PIECE_LENGTH && totalLength > int64(pieceLength)*TARGET_PIECE_COUNT {
+		pieceLength *= 2
+	}
+	return pieceLength
+}
+
+// validPieceLength checks that a requested piece length is a power of two within the supported bounds
+func validPieceLength(pieceLength int) bool {
+	return pieceLength >= MIN_PIECE_LENGTH && pieceLength <= MAX_PIECE_LENGTH && pieceLength&(pieceLength-1) == 0
+}
+
+// buildAnnounceList drops empty tiers and trackers from an announce-list. Clients that support announce-list ignore
+// announce, so our own tracker goes in as the first tier if it isn't already there, since that is where we seed.
+// Private torrents are only shared through the trackers they were made for, so they are left as they are.
+func buildAnnounceList(announceList [][]string, private bool) [][]string {
+	tiers := [][]string{}
+	hasTracker := false
+	for _, tier := range announceList {
+		trackers := []string{}
+		for _, tracker := range tier {
+			tracker = strings.TrimSpace(tracker)
+			if tracker == "" {
+				continue
+			}
+			hasTracker = hasTracker || tracker == TrackerAddr
+			trackers = append(trackers, tracker)
+		}
+		if len(trackers) > 0 {
+			tiers = append(tiers, trackers)
+		}
+	}
+
+	if len(tiers) == 0 {
+		return nil
+	}
+	if !hasTracker && !private {
+		tiers = append([][]string{{TrackerAddr}}, tiers...)
+	}
+	return tiers
+}
+
+// CreateTorrentFile creates a torrent for a single file or, if filePath is a directory, for every file inside of it.
+// A pieceLength of 0 picks one based on the size of the data. announceList adds tiers of backup trackers (BEP 12).
+// Private torrents are announced only to announceList, which has to hold the private tracker's announce URL with its passkey.
+func CreateTorrentFile(seederStack *SeederStack, filePath string, peerID string, pieceLength int, announceList [][]string, private bool) ([]byte, error) {
+	if pieceLength != 0 && !validPieceLength(pieceLength) {
+		return nil, fmt.Errorf("piece length must be a power of two between %d and %d, got %d", MIN_PIECE_LENGTH, MAX_PIECE_LENGTH, pieceLength)
+	}
+
+	tiers := buildAnnounceList(announceList, private)
+	announce := TrackerAddr
+	if private {
+		if len(tiers) == 0 {
+			return nil, fmt.Errorf("private torrents need the announce URL of their tracker")
+		}
+		announce = tiers[0][0]
 	}
-	defer file.Close()
 
 	// Get file info
-	fileInfo, err := file.Stat()
+	fileInfo, err := os.Stat(filePath)
 	if err != nil {
 		return nil, err
 	}
 
-	// Calculate the SHA-1 hash of the file
-	// Reset the file offset to the beginning
-	file.Seek(0, 0)
+	// Normalize the path and extract the file name, Path wasnt working for some reason
+	normalizedPath := strings.TrimRight(strings.ReplaceAll(filePath, "\\", "/"), "/")
+	lastSlashIndex := strings.LastIndex(normalizedPath, "/")
+	fileName := normalizedPath[lastSlashIndex+1:]
 
-	// Prepare to read the file in pieces
-	pieces := make([]byte, 0)
-	buf := make([]byte, PIECE_SIZE)
+	info := TorrentInfo{
+		Name: fileName,
+	}
+	if private {
+		info.Private = 1
+	}
 
-	for {
-		n, err := file.Read(buf)
-		if err != nil && err != io.EOF {
+	// Directories become multi-file torrents, with every file inside of them hashed as one stream
+	paths := []string{filePath}
+	if fileInfo.IsDir() {
+		paths, info.Files, err = collectFiles(filePath)
+		if err != nil {
 			return nil, err
 		}
-		if n == 0 {
-			break
-		}
-
-		// Compute the SHA-1 hash of the current piece
-		hasher := sha1.New()
-		hasher.Write(buf[:n])
-		pieceHash := hasher.Sum(nil)
+	} else {
+		info.Length = fileInfo.Size()
+	}
 
-		// Append the piece hash to the pieces slice
-		pieces = append(pieces, pieceHash...)
+	// Pick a piece length now that we know how much data there is
+	if pieceLength == 0 {
+		pieceLength = ChoosePieceLength(info.TotalLength())
 	}
+	info.PieceLength = pieceLength
 
-	// Normalize the path and extract the file name, Path wasnt working for some reason
-	normalizedPath := strings.ReplaceAll(filePath, "\\", "/")
-	lastSlashIndex := strings.LastIndex(normalizedPath, "/")
-	fileName := normalizedPath[lastSlashIndex+1:]
+	// Calculate the SHA-1 hash of every piece
+	info.Pieces, err = hashPieces(paths, info.PieceLength) // Store the raw binary hash
+	if err != nil {
+		return nil, err
+	}
 
 	// Define the torrent metadata
 	torrent := Torrent{
-		Announce: TrackerAddr, 
-		Info: TorrentInfo{
-			Name:        fileName,
-			Length:      fileInfo.Size(),
-			PieceLength: PIECE_SIZE, // 16 KB piece size
-			Pieces:      pieces,     // Store the raw binary hash
-		},
+		Announce:     announce,
+		AnnounceList: tiers,
+		Info:         info,
 	}
 
 	// Encode the torrent metadata to bencode format in-memory
@@ -77,7 +133,7 @@ func CreateTorrentFile(seederStack *SeederStack, filePath string, peerID string)
 		return nil, err
 	}
 
-	// Adds to seeder stack and sends POST request to tracker
+	// Adds to seeder stack and announces it to the trackers
 	seederStack.mtx.Lock()
 	seederPort := seederStack.port
 	seederStack.mtx.Unlock()
@@ -94,7 +150,9 @@ func CreateTorrentFile(seederStack *SeederStack, filePath string, peerID string)
 		infoHash:          hashInfo,
 		peerID:            []byte(peerID),
 		filepath:          filePath,
-		connectedLeechers: []Leecher{},
+		info:              info,
+		connectedLeechers: []*Leecher{},
+		trackers:          torrent.Trackers(),
 	})
 	if err != nil {
 		/* This error means that if we couldn't upload to the tracker server,
@@ -0,0 +1,158 @@
+package torrent
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestChoosePieceLength(t *testing.T) {
+	tests := []struct {
+		name        string
+		totalLength int64
+		want        int
+	}{
+		{"empty", 0, MIN_PIECE_LENGTH},
+		{"small file", 1000, MIN_PIECE_LENGTH},
+		{"target count of the smallest pieces", MIN_PIECE_LENGTH * TARGET_PIECE_COUNT, MIN_PIECE_LENGTH},
+		{"one byte over the target", MIN_PIECE_LENGTH*TARGET_PIECE_COUNT + 1, 2 * MIN_PIECE_LENGTH},
+		{"a gigabyte", 1 << 30, 1 << 20},
+		{"target count of the largest pieces", MAX_PIECE_LENGTH * TARGET_PIECE_COUNT, MAX_PIECE_LENGTH},
+		{"more than the largest pieces can keep under the target", MAX_PIECE_LENGTH*TARGET_PIECE_COUNT*4 + 1, MAX_PIECE_LENGTH},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got := ChoosePieceLength(test.totalLength)
+			if got != test.want {
+				t.Errorf("ChoosePieceLength(%d) = %d, want %d", test.totalLength, got, test.want)
+			}
+			if !validPieceLength(got) {
+				t.Errorf("ChoosePieceLength(%d) = %d, which validPieceLength rejects", test.totalLength, got)
+			}
+		})
+	}
+}
+
+func TestValidPieceLength(t *testing.T) {
+	tests := []struct {
+		pieceLength int
+		want        bool
+	}{
+		{MIN_PIECE_LENGTH, true},
+		{MAX_PIECE_LENGTH, true},
+		{256 * 1024, true},
+		{MIN_PIECE_LENGTH / 2, false},
+		{MAX_PIECE_LENGTH * 2, false},
+		{0, false},
+		{-MIN_PIECE_LENGTH, false},
+		{MIN_PIECE_LENGTH + 1, false},
+		{3 * MIN_PIECE_LENGTH, false},
+	}
+
+	for _, test := range tests {
+		got := validPieceLength(test.pieceLength)
+		if got != test.want {
+			t.Errorf("validPieceLength(%d) = %v, want %v", test.pieceLength, got, test.want)
+		}
+	}
+}
+
+func TestCreateTorrentFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "file")
+	err := os.WriteFile(path, make([]byte, 5*MIN_PIECE_LENGTH+1), 0644)
+	if err != nil {
+		t.Fatalf("error writing file: %v", err)
+	}
+
+	backup := "udp://backup.example:6969/announce"
+	private := "http://private.example/announce/passkey"
+
+	tests := []struct {
+		name             string
+		pieceLength      int
+		announceList     [][]string
+		private          bool
+		wantPieceLength  int
+		wantAnnounce     string
+		wantAnnounceList [][]string
+		wantErr          bool
+	}{
+		{
+			name:            "piece length picked from the size",
+			pieceLength:     0,
+			wantPieceLength: MIN_PIECE_LENGTH,
+			wantAnnounce:    TrackerAddr,
+		},
+		{
+			name:            "piece length given",
+			pieceLength:     2 * MIN_PIECE_LENGTH,
+			wantPieceLength: 2 * MIN_PIECE_LENGTH,
+			wantAnnounce:    TrackerAddr,
+		},
+		{name: "piece length below the minimum", pieceLength: MIN_PIECE_LENGTH / 2, wantErr: true},
+		{name: "piece length above the maximum", pieceLength: MAX_PIECE_LENGTH * 2, wantErr: true},
+		{name: "piece length not a power of two", pieceLength: 3 * MIN_PIECE_LENGTH, wantErr: true},
+		{name: "negative piece length", pieceLength: -1, wantErr: true},
+		{
+			name:             "backup trackers go after ours",
+			announceList:     [][]string{{backup, " "}, {}},
+			wantPieceLength:  MIN_PIECE_LENGTH,
+			wantAnnounce:     TrackerAddr,
+			wantAnnounceList: [][]string{{TrackerAddr}, {backup}},
+		},
+		{
+			name:             "our tracker in a later tier stays where it is",
+			announceList:     [][]string{{backup}, {TrackerAddr}},
+			wantPieceLength:  MIN_PIECE_LENGTH,
+			wantAnnounce:     TrackerAddr,
+			wantAnnounceList: [][]string{{backup}, {TrackerAddr}},
+		},
+		{
+			name:             "private torrent announces to its own tracker",
+			announceList:     [][]string{{private}, {backup}},
+			private:          true,
+			wantPieceLength:  MIN_PIECE_LENGTH,
+			wantAnnounce:     private,
+			wantAnnounceList: [][]string{{private}, {backup}},
+		},
+		{name: "private torrent without a tracker", private: true, wantErr: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			stack := &SeederStack{}
+			defer stack.StopAll()
+
+			data, err := CreateTorrentFile(stack, path, "-TEST-creator-000001", test.pieceLength, test.announceList, test.private)
+			if (err != nil) != test.wantErr {
+				t.Fatalf("CreateTorrentFile() error = %v, wantErr %v", err, test.wantErr)
+			}
+			if test.wantErr {
+				return
+			}
+
+			torrent, err := UnmarshalTorrent(data)
+			if err != nil {
+				t.Fatalf("UnmarshalTorrent() error = %v", err)
+			}
+			if torrent.Info.PieceLength != test.wantPieceLength {
+				t.Errorf("piece length = %d, want %d", torrent.Info.PieceLength, test.wantPieceLength)
+			}
+			wantPieces := (5*MIN_PIECE_LENGTH + test.wantPieceLength) / test.wantPieceLength
+			if len(torrent.Info.Pieces) != 20*wantPieces {
+				t.Errorf("got %d piece hashes, want %d", len(torrent.Info.Pieces)/20, wantPieces)
+			}
+			if torrent.Announce != test.wantAnnounce {
+				t.Errorf("announce = %q, want %q", torrent.Announce, test.wantAnnounce)
+			}
+			if !reflect.DeepEqual(torrent.AnnounceList, test.wantAnnounceList) {
+				t.Errorf("announce-list = %v, want %v", torrent.AnnounceList, test.wantAnnounceList)
+			}
+			if (torrent.Info.Private == 1) != test.private {
+				t.Errorf("private = %d, want %v", torrent.Info.Private, test.private)
+			}
+		})
+	}
+}
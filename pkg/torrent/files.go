@@ -0,0 +1,224 @@
+package torrent
+
+import (
+	"crypto/sha1"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Pieces are hashed over the concatenation of every file in the torrent, so a piece can start in one file and end
+// in the next. These helpers map a piece onto the files it covers so both sides can read and write it.
+
+// fileEntry is a file of the torrent on disk, along with where it starts in the concatenated torrent data
+type fileEntry struct {
+	path   string
+	length int64
+	offset int64
+}
+
+// fileSpan is the part of a single file covered by a piece
+type fileSpan struct {
+	path        string
+	fileOffset  int64 // Where the span starts in the file
+	pieceOffset int64 // Where the span starts in the piece
+	length      int64
+}
+
+// fileEntries lays out the torrent's files under root. For single-file torrents root is the file itself,
+// for multi-file torrents it is the directory holding the files list.
+func (info *TorrentInfo) fileEntries(root string) ([]fileEntry, error) {
+	if !info.IsMultiFile() {
+		return []fileEntry{{path: root, length: info.Length, offset: 0}}, nil
+	}
+
+	entries := make([]fileEntry, 0, len(info.Files))
+	var offset int64
+	for _, file := range info.Files {
+		if len(file.Path) == 0 {
+			return nil, fmt.Errorf("file entry with empty path")
+		}
+		// Don't let a torrent write outside of its directory
+		for _, segment := range file.Path {
+			if segment == "" || segment == "." || segment == ".." || strings.ContainsAny(segment, "/\\") {
+				return nil, fmt.Errorf("invalid path segment %q", segment)
+			}
+		}
+
+		entries = append(entries, fileEntry{
+			path:   filepath.Join(append([]string{root}, file.Path...)...),
+			length: file.Length,
+			offset: offset,
+		})
+		offset += file.Length
+	}
+
+	return entries, nil
+}
+
+// pieceBounds returns the offset of a piece in the concatenated data and its actual length (the last piece is usually shorter)
+func (info *TorrentInfo) pieceBounds(pieceIndex uint32) (int64, int64) {
+	start := int64(pieceIndex) * int64(info.PieceLength)
+	end := start + int64(info.PieceLength)
+	if total := info.TotalLength(); end > total {
+		end = total
+	}
+	if start > end {
+		return start, 0
+	}
+	return start, end - start
+}
+
+// pieceSpans maps a piece onto the files that it covers
+func (info *TorrentInfo) pieceSpans(root string, pieceIndex uint32) ([]fileSpan, error) {
+	_, pieceLength := info.pieceBounds(pieceIndex)
+	return info.blockSpans(root, pieceIndex, 0, pieceLength)
+}
+
+// blockSpans maps part of a piece, starting at begin, onto the files that it covers.
+// The pieceOffset of each span is relative to begin.
+func (info *TorrentInfo) blockSpans(root string, pieceIndex uint32, begin int64, length int64) ([]fileSpan, error) {
+	if int(pieceIndex) >= info.NumPieces() {
+		return nil, fmt.Errorf("piece index %d out of range", pieceIndex)
+	}
+
+	pieceStart, pieceLength := info.pieceBounds(pieceIndex)
+	if begin < 0 || length < 0 || begin+length > pieceLength {
+		return nil, fmt.Errorf("block %d+%d out of range for piece %d", begin, length, pieceIndex)
+	}
+
+	entries, err := info.fileEntries(root)
+	if err != nil {
+		return nil, err
+	}
+
+	blockStart := pieceStart + begin
+	blockEnd := blockStart + length
+
+	spans := make([]fileSpan, 0, 1)
+	for _, entry := range entries {
+		entryEnd := entry.offset + entry.length
+		if entryEnd <= blockStart || entry.offset >= blockEnd {
+			continue
+		}
+
+		start := max(blockStart, entry.offset)
+		end := min(blockEnd, entryEnd)
+		spans = append(spans, fileSpan{
+			path:        entry.path,
+			fileOffset:  start - entry.offset,
+			pieceOffset: start - blockStart,
+			length:      end - start,
+		})
+	}
+
+	return spans, nil
+}
+
+// readBlock reads length bytes of a piece, starting at begin, from the torrent's files under root
+func readBlock(root string, info *TorrentInfo, pieceIndex uint32, begin int64, length int64) ([]byte, error) {
+	spans, err := info.blockSpans(root, pieceIndex, begin, length)
+	if err != nil {
+		return nil, err
+	}
+
+	buf := make([]byte, length)
+	for _, span := range spans {
+		file, err := os.Open(span.path)
+		if err != nil {
+			return nil, err
+		}
+		_, err = file.ReadAt(buf[span.pieceOffset:span.pieceOffset+span.length], span.fileOffset)
+		file.Close()
+		if err != nil && err != io.EOF {
+			return nil, err
+		}
+	}
+
+	return buf, nil
+}
+
+// collectFiles walks a directory and returns its regular files in lexical order, along with their torrent path segments
+func collectFiles(root string) ([]string, []TorrentFile, error) {
+	paths := make([]string, 0)
+	files := make([]TorrentFile, 0)
+
+	err := filepath.WalkDir(root, func(path string, d os.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if !d.Type().IsRegular() {
+			return nil
+		}
+
+		fileInfo, err := d.Info()
+		if err != nil {
+			return err
+		}
+		relPath, err := filepath.Rel(root, path)
+		if err != nil {
+			return err
+		}
+
+		paths = append(paths, path)
+		files = append(files, TorrentFile{
+			Length: fileInfo.Size(),
+			Path:   strings.Split(filepath.ToSlash(relPath), "/"),
+		})
+		return nil
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if len(files) == 0 {
+		return nil, nil, fmt.Errorf("no files found in %s", root)
+	}
+
+	return paths, files, nil
+}
+
+// hashPieces computes the SHA-1 hash of every piece of the concatenated files, in order
+func hashPieces(paths []string, pieceLength int) ([]byte, error) {
+	pieces := make([]byte, 0)
+	buf := make([]byte, pieceLength)
+	filled := 0
+
+	for _, path := range paths {
+		file, err := os.Open(path)
+		if err != nil {
+			return nil, err
+		}
+
+		for {
+			n, err := io.ReadFull(file, buf[filled:])
+			filled += n
+
+			// A piece is complete, hash it and start the next one
+			if filled == pieceLength {
+				pieceHash := sha1.Sum(buf)
+				pieces = append(pieces, pieceHash[:]...)
+				filled = 0
+			}
+
+			if err == io.EOF || err == io.ErrUnexpectedEOF {
+				break
+			}
+			if err != nil {
+				file.Close()
+				return nil, err
+			}
+		}
+		file.Close()
+	}
+
+	// Hash the last, shorter piece
+	if filled > 0 {
+		pieceHash := sha1.Sum(buf[:filled])
+		pieces = append(pieces, pieceHash[:]...)
+	}
+
+	return pieces, nil
+}
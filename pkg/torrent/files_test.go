@@ -0,0 +1,326 @@
+package torrent
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// multiFileInfo is a torrent of two files, 10 and 25 bytes long, in pieces of 16 bytes. Piece 0 ends 6 bytes into
+// the second file and the last piece is only 3 bytes long.
+func multiFileInfo() *TorrentInfo {
+	return &TorrentInfo{
+		Name:        "dir",
+		PieceLength: 16,
+		Pieces:      make([]byte, 3*20),
+		Files: []TorrentFile{
+			{Length: 10, Path: []string{"a"}},
+			{Length: 25, Path: []string{"sub", "c"}},
+		},
+	}
+}
+
+func TestFileEntries(t *testing.T) {
+	tests := []struct {
+		name    string
+		info    *TorrentInfo
+		want    []fileEntry
+		wantErr bool
+	}{
+		{
+			name: "single file",
+			info: &TorrentInfo{Name: "f", Length: 35, PieceLength: 16},
+			want: []fileEntry{{path: "root", length: 35, offset: 0}},
+		},
+		{
+			name: "multi file",
+			info: multiFileInfo(),
+			want: []fileEntry{
+				{path: filepath.Join("root", "a"), length: 10, offset: 0},
+				{path: filepath.Join("root", "sub", "c"), length: 25, offset: 10},
+			},
+		},
+		{
+			name:    "empty path",
+			info:    &TorrentInfo{Files: []TorrentFile{{Length: 1, Path: []string{}}}},
+			wantErr: true,
+		},
+		{
+			name:    "parent directory",
+			info:    &TorrentInfo{Files: []TorrentFile{{Length: 1, Path: []string{"..", "escape"}}}},
+			wantErr: true,
+		},
+		{
+			name:    "separator in segment",
+			info:    &TorrentInfo{Files: []TorrentFile{{Length: 1, Path: []string{"a/b"}}}},
+			wantErr: true,
+		},
+		{
+			name:    "empty segment",
+			info:    &TorrentInfo{Files: []TorrentFile{{Length: 1, Path: []string{"a", ""}}}},
+			wantErr: true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			entries, err := test.info.fileEntries("root")
+			if (err != nil) != test.wantErr {
+				t.Fatalf("fileEntries() error = %v, wantErr %v", err, test.wantErr)
+			}
+			if !test.wantErr && !reflect.DeepEqual(entries, test.want) {
+				t.Errorf("fileEntries() = %+v, want %+v", entries, test.want)
+			}
+		})
+	}
+}
+
+func TestPieceBounds(t *testing.T) {
+	info := &TorrentInfo{Length: 35, PieceLength: 16, Pieces: make([]byte, 3*20)}
+
+	tests := []struct {
+		pieceIndex uint32
+		wantStart  int64
+		wantLength int64
+	}{
+		{0, 0, 16},
+		{1, 16, 16},
+		{2, 32, 3}, // The last piece is cut short
+		{3, 48, 0}, // Past the end
+		{10, 160, 0},
+	}
+
+	for _, test := range tests {
+		start, length := info.pieceBounds(test.pieceIndex)
+		if start != test.wantStart || length != test.wantLength {
+			t.Errorf("pieceBounds(%d) = %d, %d, want %d, %d", test.pieceIndex, start, length, test.wantStart, test.wantLength)
+		}
+	}
+}
+
+func TestBlockSpans(t *testing.T) {
+	a := filepath.Join("root", "a")
+	c := filepath.Join("root", "sub", "c")
+
+	tests := []struct {
+		name       string
+		pieceIndex uint32
+		begin      int64
+		length     int64
+		want       []fileSpan
+		wantErr    bool
+	}{
+		{
+			name:       "piece across two files",
+			pieceIndex: 0, begin: 0, length: 16,
+			want: []fileSpan{
+				{path: a, fileOffset: 0, pieceOffset: 0, length: 10},
+				{path: c, fileOffset: 0, pieceOffset: 10, length: 6},
+			},
+		},
+		{
+			name:       "piece inside one file",
+			pieceIndex: 1, begin: 0, length: 16,
+			want: []fileSpan{{path: c, fileOffset: 6, pieceOffset: 0, length: 16}},
+		},
+		{
+			name:       "short last piece",
+			pieceIndex: 2, begin: 0, length: 3,
+			want: []fileSpan{{path: c, fileOffset: 22, pieceOffset: 0, length: 3}},
+		},
+		{
+			name:       "block across the file boundary",
+			pieceIndex: 0, begin: 8, length: 4,
+			want: []fileSpan{
+				{path: a, fileOffset: 8, pieceOffset: 0, length: 2},
+				{path: c, fileOffset: 0, pieceOffset: 2, length: 2},
+			},
+		},
+		{
+			name:       "block at the end of a piece",
+			pieceIndex: 1, begin: 12, length: 4,
+			want: []fileSpan{{path: c, fileOffset: 18, pieceOffset: 0, length: 4}},
+		},
+		{
+			name:       "piece out of range",
+			pieceIndex: 3, begin: 0, length: 1,
+			wantErr: true,
+		},
+		{
+			name:       "block past the end of the piece",
+			pieceIndex: 2, begin: 0, length: 4,
+			wantErr: true,
+		},
+		{
+			name:       "negative begin",
+			pieceIndex: 0, begin: -1, length: 1,
+			wantErr: true,
+		},
+	}
+
+	info := multiFileInfo()
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			spans, err := info.blockSpans("root", test.pieceIndex, test.begin, test.length)
+			if (err != nil) != test.wantErr {
+				t.Fatalf("blockSpans() error = %v, wantErr %v", err, test.wantErr)
+			}
+			if !test.wantErr && !reflect.DeepEqual(spans, test.want) {
+				t.Errorf("blockSpans() = %+v, want %+v", spans, test.want)
+			}
+		})
+	}
+}
+
+// writeTestFiles writes files of the given lengths under root, filled with random bytes so no two pieces are
+// the same, and returns the concatenated data. A file without path segments is written to root itself.
+func writeTestFiles(t *testing.T, root string, files []TorrentFile) []byte {
+	t.Helper()
+
+	random := rand.New(rand.NewSource(int64(len(files))))
+	data := []byte{}
+	for _, file := range files {
+		content := make([]byte, file.Length)
+		random.Read(content)
+		data = append(data, content...)
+
+		path := filepath.Join(append([]string{root}, file.Path...)...)
+		err := os.MkdirAll(filepath.Dir(path), 0755)
+		if err != nil {
+			t.Fatalf("error creating directory: %v", err)
+		}
+		err = os.WriteFile(path, content, 0644)
+		if err != nil {
+			t.Fatalf("error writing %s: %v", path, err)
+		}
+	}
+	return data
+}
+
+// testDirFiles are the files of a directory torrent. With pieces of 16 bytes, piece 0 covers all three files,
+// piece 1 ends 2 bytes into sub/c and the last piece is only 6 bytes long.
+var testDirFiles = []TorrentFile{
+	{Length: 10, Path: []string{"a"}},
+	{Length: 20, Path: []string{"b"}},
+	{Length: 8, Path: []string{"sub", "c"}},
+}
+
+func TestCollectAndHashFiles(t *testing.T) {
+	root := t.TempDir()
+	data := writeTestFiles(t, root, testDirFiles)
+
+	paths, files, err := collectFiles(root)
+	if err != nil {
+		t.Fatalf("collectFiles() error = %v", err)
+	}
+	wantPaths := []string{filepath.Join(root, "a"), filepath.Join(root, "b"), filepath.Join(root, "sub", "c")}
+	if !reflect.DeepEqual(paths, wantPaths) {
+		t.Errorf("collectFiles() paths = %v, want %v", paths, wantPaths)
+	}
+	if !reflect.DeepEqual(files, testDirFiles) {
+		t.Errorf("collectFiles() files = %+v, want %+v", files, testDirFiles)
+	}
+
+	tests := []struct {
+		name        string
+		pieceLength int
+		wantPieces  [][]byte // The data of every piece
+	}{
+		{
+			name:        "pieces across file boundaries",
+			pieceLength: 16,
+			wantPieces:  [][]byte{data[0:16], data[16:32], data[32:38]},
+		},
+		{
+			name:        "pieces that end on a file boundary",
+			pieceLength: 10,
+			wantPieces:  [][]byte{data[0:10], data[10:20], data[20:30], data[30:38]},
+		},
+		{
+			name:        "one piece for everything",
+			pieceLength: 64,
+			wantPieces:  [][]byte{data},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			want := []byte{}
+			for _, piece := range test.wantPieces {
+				pieceHash := sha1.Sum(piece)
+				want = append(want, pieceHash[:]...)
+			}
+
+			pieces, err := hashPieces(paths, test.pieceLength)
+			if err != nil {
+				t.Fatalf("hashPieces() error = %v", err)
+			}
+			if !bytes.Equal(pieces, want) {
+				t.Errorf("hashPieces() = %x, want %x", pieces, want)
+			}
+		})
+	}
+
+	t.Run("empty directory", func(t *testing.T) {
+		_, _, err := collectFiles(t.TempDir())
+		if err == nil {
+			t.Error("collectFiles() succeeded, want an error")
+		}
+	})
+}
+
+func TestReadBlock(t *testing.T) {
+	root := t.TempDir()
+	data := writeTestFiles(t, root, testDirFiles)
+
+	pieces, err := hashPieces([]string{filepath.Join(root, "a"), filepath.Join(root, "b"), filepath.Join(root, "sub", "c")}, 16)
+	if err != nil {
+		t.Fatalf("hashPieces() error = %v", err)
+	}
+	info := &TorrentInfo{Name: "dir", PieceLength: 16, Pieces: pieces, Files: testDirFiles}
+
+	tests := []struct {
+		name       string
+		pieceIndex uint32
+		begin      int64
+		length     int64
+		want       []byte
+		wantErr    bool
+	}{
+		{name: "piece across three files", pieceIndex: 0, begin: 0, length: 16, want: data[0:16]},
+		{name: "block across a file boundary", pieceIndex: 0, begin: 8, length: 4, want: data[8:12]},
+		{name: "block at the end of a file", pieceIndex: 1, begin: 10, length: 4, want: data[26:30]},
+		{name: "short last piece", pieceIndex: 2, begin: 0, length: 6, want: data[32:38]},
+		{name: "past the end of the last piece", pieceIndex: 2, begin: 0, length: 16, wantErr: true},
+		{name: "piece out of range", pieceIndex: 3, begin: 0, length: 1, wantErr: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got, err := readBlock(root, info, test.pieceIndex, test.begin, test.length)
+			if (err != nil) != test.wantErr {
+				t.Fatalf("readBlock() error = %v, wantErr %v", err, test.wantErr)
+			}
+			if !test.wantErr && !bytes.Equal(got, test.want) {
+				t.Errorf("readBlock() = %v, want %v", got, test.want)
+			}
+		})
+	}
+
+	// Whole pieces read back from the files hash to what the torrent says
+	for pieceIndex := uint32(0); pieceIndex < uint32(info.NumPieces()); pieceIndex++ {
+		_, pieceLength := info.pieceBounds(pieceIndex)
+		piece, err := readBlock(root, info, pieceIndex, 0, pieceLength)
+		if err != nil {
+			t.Fatalf("readBlock() of piece %d error = %v", pieceIndex, err)
+		}
+		valid, err := validatePiece(Torrent{Info: *info}, pieceIndex, piece)
+		if err != nil || !valid {
+			t.Errorf("validatePiece(%d) = %v, %v, want true", pieceIndex, valid, err)
+		}
+	}
+}
@@ -6,107 +6,43 @@ import (
 	"crypto/sha1"
 	"encoding/binary"
 	"fmt"
+	"io"
 	"log"
 	"net"
+	"strconv"
+	"sync"
+	"time"
 )
 
-func DownloadFromSeeders(peers []trackingserver.Peer, torrent Torrent, totalPieces uint32) ([]byte, error) {
-	// Make a bitfield to track the pieces that we have
-	bitfield := make([]byte, (totalPieces+7)/8)
+// How long we wait for a peer to accept our connection
+const DIAL_TIMEOUT = 5 * time.Second
 
-	// Iterate through the list of peers, downloading as many pieces from each and moving on if one fails
-	for _, peer := range peers {
-		downloadedData, err := downloadFromSeeder(peer, torrent, bitfield)
-		if err != nil {
-			continue
-		} else {
-			return downloadedData, nil
-		}
-	}
-
-	return nil, fmt.Errorf("failed to download from all seeders")
-}
-
-func downloadFromSeeder(peer trackingserver.Peer, torrent Torrent, bitfield []byte) ([]byte, error) {
+// connectToPeer dials a peer and exchanges handshakes for the torrent
+func connectToPeer(peer trackingserver.Peer, torrent Torrent, peerID string) (*peerConn, error) {
 	// Connect to the peer
-	conn, err := net.Dial("tcp", fmt.Sprintf("%s:%d", peer.IP, peer.Port))
+	conn, err := net.DialTimeout("tcp", net.JoinHostPort(peer.IP, strconv.Itoa(peer.Port)), DIAL_TIMEOUT)
 	if err != nil {
 		return nil, fmt.Errorf("failed to connect to peer: %v", err)
 	}
-	defer conn.Close()
 
 	fmt.Println("Connected to seeder")
 	// Send the handshake message
-	err = sendHandshakeToSeeder(conn, torrent, peer.PeerID)
+	err = sendHandshakeToSeeder(conn, torrent, peerID)
 	if err != nil {
-		return nil, err
+		conn.Close()
+		return nil, fmt.Errorf("%w: %v", errHandshakeFailed, err)
 	}
 
 	fmt.Println("Handshake sent")
 	// Receive the handshake message
 	err = receiveHandshakeFromSeeder(conn, torrent)
 	if err != nil {
-		return nil, err
+		conn.Close()
+		return nil, fmt.Errorf("%w: %v", errHandshakeFailed, err)
 	}
 
 	fmt.Println("Handshake received")
-	// Start downloading pieces
-	totalPieces := len(torrent.Info.Pieces) / 20 // Each piece hash is 20 bytes
-	downloadedData := make([]byte, 0)
-
-	log.Println("Total pieces: ", totalPieces)
-	for pieceIndex := uint32(0); pieceIndex < uint32(totalPieces); pieceIndex++ {
-		// Check if we already have the piece
-		if hasPiece(bitfield, pieceIndex) {
-			log.Println("Already have piece: ", pieceIndex+1, "/", totalPieces)
-			continue
-		}
-
-		// Send a request message for the piece
-		err = sendRequest(conn, pieceIndex)
-		if err != nil {
-			return nil, err
-		}
-
-		// Receive the piece data
-		pieceData, pieceIndexR, err := receivePiece(conn)
-		if err != nil {
-			return nil, err
-		} else if pieceIndexR != pieceIndex {
-			log.Println("received piece index %d, expected %d", pieceIndexR, pieceIndex)
-			return nil, fmt.Errorf("received piece index %d, expected %d", pieceIndexR, pieceIndex)
-		}
-
-		log.Println("Piece received: ", pieceIndex, "/", totalPieces)
-		//log.Println("Piece data: ", string(pieceData))
-
-		log.Println("Piece data length: ", len(pieceData))
-
-		// Validate the piece data
-		valid, err := validatePiece(torrent, pieceIndex, pieceData)
-		if err != nil || !valid {
-			log.Println("Piece failed validation")
-			return nil, fmt.Errorf("piece %d failed validation", pieceIndex)
-		}
-
-		log.Println("Piece validated: ", pieceIndex+1, "/", totalPieces)
-
-		// Update the bitfield
-		setPiece(bitfield, pieceIndex)
-
-		// Append the piece data
-		downloadedData = append(downloadedData, pieceData...)
-
-		log.Println("Pieces downloaded: ", pieceIndex+1, "/", totalPieces)
-	}
-
-	// Write the downloaded data to disk
-	// err = os.WriteFile("downloaded_file", downloadedData, 0644)
-	// if err != nil {
-	// 	return err
-	// }
-
-	return downloadedData, nil
+	return newPeerConn(conn), nil
 }
 
 func sendHandshakeToSeeder(conn net.Conn, torrent Torrent, pi string) error {
@@ -138,7 +74,8 @@ func sendHandshakeToSeeder(conn net.Conn, torrent Torrent, pi string) error {
 func receiveHandshakeFromSeeder(conn net.Conn, torrent Torrent) error {
 	// Receive the handshake message
 	buf := make([]byte, 68)
-	_, err := conn.Read(buf)
+	conn.SetReadDeadline(time.Now().Add(PEER_TIMEOUT))
+	_, err := io.ReadFull(conn, buf)
 	if err != nil {
 		return fmt.Errorf("failed to read handshake: %v", err)
 	}
@@ -161,81 +98,302 @@ func receiveHandshakeFromSeeder(conn net.Conn, torrent Torrent) error {
 	return nil
 }
 
-func sendRequest(conn net.Conn, pieceIndex uint32) error {
-	fmt.Println("PieceIndex:", pieceIndex)
-	// Create the request message
-	message := Message{
-		Length:  13,
-		ID:      6,
-		Payload: make([]byte, 12),
-	}
-	// Set the piece index, begin, and length
-	pieceIndexBytes := uint32ToBytes(pieceIndex)
-	copy(message.Payload[0:4], pieceIndexBytes)
-	copy(message.Payload[4:8], uint32ToBytes(0))           // begin
-	copy(message.Payload[8:12], uint32ToBytes(PIECE_SIZE)) // length
-
-	// Marshal the message
-	fmt.Println("About to send request", message)
-	msgBytes, err := message.Marshal()
-	if err != nil {
-		return fmt.Errorf("failed to marshal request message: %v", err)
+// block is a chunk of a piece, which is what actually gets requested and sent over the wire
+type block struct {
+	index  uint32
+	begin  uint32
+	length uint32
+}
+
+// pieceBlocks splits a piece into BLOCK_SIZE blocks, the last one holding whatever is left over
+func (info *TorrentInfo) pieceBlocks(pieceIndex uint32) []block {
+	_, pieceLength := info.pieceBounds(pieceIndex)
+
+	blocks := make([]block, 0, (pieceLength+BLOCK_SIZE-1)/BLOCK_SIZE)
+	for begin := int64(0); begin < pieceLength; begin += BLOCK_SIZE {
+		blocks = append(blocks, block{
+			index:  pieceIndex,
+			begin:  uint32(begin),
+			length: uint32(min(BLOCK_SIZE, pieceLength-begin)),
+		})
 	}
+	return blocks
+}
 
-	// Send the message
-	_, err = conn.Write(msgBytes)
-	if err != nil {
-		return fmt.Errorf("failed to send request message: %v", err)
+// partialPiece is a piece being put back together from its blocks. If a peer fails part way through a piece,
+// the blocks it did send are kept so another peer only has to send the rest. In endgame mode several workers
+// download the same piece at once, so the blocks are shared between them.
+type partialPiece struct {
+	index uint32
+
+	mtx      sync.Mutex
+	data     []byte
+	received []bool // Which of the piece's blocks are already in data
+
+	requested []int // How many workers have a request out for each block, guarded by the download manager
+	workers   int   // How many workers are downloading the piece, guarded by the download manager
+	delivered bool  // Set once a worker has taken the finished piece to be checked, guarded by the download manager
+}
+
+func newPartialPiece(info *TorrentInfo, pieceIndex uint32) *partialPiece {
+	_, pieceLength := info.pieceBounds(pieceIndex)
+	numBlocks := len(info.pieceBlocks(pieceIndex))
+	return &partialPiece{
+		index:     pieceIndex,
+		data:      make([]byte, pieceLength),
+		received:  make([]bool, numBlocks),
+		requested: make([]int, numBlocks),
+	}
+}
+
+// complete reports whether every block of the piece has been received
+func (p *partialPiece) complete() bool {
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+
+	for _, received := range p.received {
+		if !received {
+			return false
+		}
+	}
+	return true
+}
+
+// hasBlocks reports whether any block of the piece has been received
+func (p *partialPiece) hasBlocks() bool {
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+
+	for _, received := range p.received {
+		if received {
+			return true
+		}
+	}
+	return false
+}
+
+// hasBlock reports whether a block of the piece has been received, from any peer
+func (p *partialPiece) hasBlock(i int) bool {
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+	return p.received[i]
+}
+
+// addBlock puts a block into its place in the piece, returning false if another peer got it to us first
+func (p *partialPiece) addBlock(i int, data []byte) bool {
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+
+	if p.received[i] {
+		return false
+	}
+	copy(p.data[i*BLOCK_SIZE:], data)
+	p.received[i] = true
+	return true
+}
+
+// peerPipeline is the block requests a worker has in flight to its peer, kept full so the peer never sits idle
+// waiting on our next request. The requests aren't tied to a single piece, the blocks of the next piece get
+// requested while the ones of the last piece are still on their way, so the pipeline doesn't drain at every piece
+// boundary. The download manager picks which blocks get requested and keeps count of who requested what.
+type peerPipeline struct {
+	peer      *peerConn
+	manager   *downloadManager
+	pieces    []*partialPiece         // The pieces we are downloading from the peer, in the order we took them on
+	requested map[block]*partialPiece // Requests the peer still owes us a block for, with the piece they are part of
+}
+
+func newPeerPipeline(peer *peerConn, manager *downloadManager) *peerPipeline {
+	return &peerPipeline{
+		peer:      peer,
+		manager:   manager,
+		pieces:    []*partialPiece{},
+		requested: make(map[block]*partialPiece),
+	}
+}
+
+// add takes on another piece, its blocks get requested after the ones of the pieces we already have
+func (p *peerPipeline) add(piece *partialPiece) {
+	p.pieces = append(p.pieces, piece)
+}
+
+// holds reports whether we are downloading the piece from the peer
+func (p *peerPipeline) holds(piece *partialPiece) bool {
+	for _, held := range p.pieces {
+		if held == piece {
+			return true
+		}
+	}
+	return false
+}
+
+// piece finds the piece with the index among the ones we are downloading, or returns nil
+func (p *peerPipeline) piece(pieceIndex uint32) *partialPiece {
+	for _, piece := range p.pieces {
+		if piece.index == pieceIndex {
+			return piece
+		}
 	}
 	return nil
 }
 
-func receivePiece(conn net.Conn) ([]byte, uint32, error) {
-	// Read the message
-	buf := make([]byte, 4)
-	_, err := conn.Read(buf)
+// full reports whether as many requests as the pipeline allows are in flight
+func (p *peerPipeline) full() bool {
+	return len(p.requested) >= p.manager.pipeline
+}
 
-	length := binary.BigEndian.Uint32(buf)
-	fmt.Println("Received length:", length)
-	if err != nil {
-		return nil, 0, fmt.Errorf("failed to read message length: %v", err)
+// fill requests the blocks of our pieces that the download manager picks for the peer next
+func (p *peerPipeline) fill() error {
+	blocks := p.manager.nextRequests(p)
+
+	// Every block is recorded before any is sent, so they all get handed back if sending fails
+	for _, b := range blocks {
+		p.requested[b] = p.piece(b.index)
 	}
+	for _, b := range blocks {
+		err := sendRequest(p.peer, b)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
 
-	buf2 := make([]byte, length)
-	_, err = conn.Read(buf2)
-	if err != nil {
-		return nil, 0, fmt.Errorf("failed to read message: %v", err)
+// cancelReceived cancels the requests for blocks that another peer has already sent us, in endgame mode
+func (p *peerPipeline) cancelReceived() error {
+	for b, piece := range p.requested {
+		if !piece.hasBlock(int(b.begin / BLOCK_SIZE)) {
+			continue
+		}
+		delete(p.requested, b)
+		p.manager.unrequest(piece, b)
+
+		err := p.peer.send(newCancelMessage(b))
+		if err != nil {
+			return err
+		}
 	}
+	return nil
+}
 
-	buf = append(buf, buf2...)
+// drop forgets every request and hands every piece back to the download manager, for when the peer chokes us
+// or goes away. Choking throws away every request the peer hadn't answered yet, and the pieces are better off
+// with a worker that can request them.
+func (p *peerPipeline) drop() {
+	for b, piece := range p.requested {
+		p.manager.unrequest(piece, b)
+	}
+	clear(p.requested)
 
-	// Unmarshal the message
-	message, err := UnmarshalMessage(buf)
+	for _, piece := range p.pieces {
+		p.manager.releasePiece(piece)
+	}
+	p.pieces = p.pieces[:0]
+}
+
+// receive matches a block the peer sent up with the piece it belongs to, returning a nil piece for blocks of
+// pieces we aren't downloading from the peer anymore. Blocks can come back in any order.
+func (p *peerPipeline) receive(message *Message) (*partialPiece, int, []byte, error) {
+	pieceIndex, begin, blockData, err := message.parsePiece()
 	if err != nil {
-		return nil, 0, fmt.Errorf("failed to unmarshal message: %v", err)
+		return nil, 0, nil, err
+	}
+	piece := p.piece(pieceIndex)
+	if piece == nil {
+		// Most likely a block that was in flight when its piece got finished or handed back
+		log.Printf("ignoring unexpected block %d+%d", pieceIndex, begin)
+		return nil, 0, nil, nil
+	}
+	blocks := p.manager.torrent.Info.pieceBlocks(pieceIndex)
+	i, ok := blockAt(blocks, begin)
+	if !ok {
+		log.Printf("ignoring block %d+%d that doesn't line up with a block of the piece", pieceIndex, begin)
+		return nil, 0, nil, nil
+	}
+	if uint32(len(blockData)) != blocks[i].length {
+		return nil, 0, nil, fmt.Errorf("received block of length %d, expected %d", len(blockData), blocks[i].length)
+	}
+
+	if _, ok := p.requested[blocks[i]]; ok {
+		delete(p.requested, blocks[i])
+		p.manager.unrequest(piece, blocks[i])
+	}
+	return piece, i, blockData, nil
+}
+
+// finished takes the pieces that every block has been received for off the pipeline
+func (p *peerPipeline) finished() []*partialPiece {
+	finished := []*partialPiece{}
+	pieces := p.pieces[:0]
+	for _, piece := range p.pieces {
+		if piece.complete() {
+			finished = append(finished, piece)
+		} else {
+			pieces = append(pieces, piece)
+		}
+	}
+	p.pieces = pieces
+	return finished
+}
+
+// blockAt finds which block of a piece starts at begin
+func blockAt(blocks []block, begin uint32) (int, bool) {
+	if begin%BLOCK_SIZE != 0 {
+		return 0, false
 	}
+	i := int(begin / BLOCK_SIZE)
+	if i >= len(blocks) {
+		return 0, false
+	}
+	return i, true
+}
 
-	fmt.Println("Received message:", message)
-	fmt.Println("Received message bytes:", string(message.Payload))
+// handleSeederMessage applies a message from a peer we are downloading from that isn't a block we are waiting on
+func handleSeederMessage(peer *peerConn, message *Message, numPieces int) error {
+	// Keep-alives only exist to stop the connection from timing out
+	if message.Length == 0 {
+		return nil
+	}
+	if peer.handleStateMessage(message) {
+		if peer.onUpload != nil {
+			return peer.onUpload(message)
+		}
+		return nil
+	}
 
-	// Check the message ID
-	if message.ID != 7 {
-		return nil, 0, fmt.Errorf("unexpected message ID: %d", message.ID)
+	// Have and bitfield messages tell us which pieces we can ask the peer for
+	handled, err := peer.handleAvailability(message, numPieces)
+	if handled {
+		return err
 	}
 
-	// Get the piece index
-	pieceIndex := uint32(binary.BigEndian.Uint32(message.Payload[0:4]))
+	switch message.ID {
+	case Request, Cancel:
+		// The peer is downloading from us over the same connection
+		if peer.onUpload != nil {
+			return peer.onUpload(message)
+		}
+	case Piece:
+		// A block we stopped waiting for, e.g. one that arrived after we were choked
+	default:
+		log.Println("Unknown message ID from seeder:", message.ID)
+	}
+	return nil
+}
 
-	return message.Payload[4:], pieceIndex, nil
+func sendRequest(peer *peerConn, b block) error {
+	// Send the request message for the piece index, begin, and length
+	err := peer.send(newRequestMessage(b))
+	if err != nil {
+		return fmt.Errorf("failed to send request message: %v", err)
+	}
+	return nil
 }
 
 func validatePiece(torrent Torrent, pieceIndex uint32, pieceData []byte) (bool, error) {
 	// Calculate the SHA-1 hash of the piece data
 	hash := sha1.Sum(pieceData)
 
-	fmt.Println("Hash:", hash)
-	fmt.Println("Expected Hash:", torrent.Info.Pieces[pieceIndex*20:(pieceIndex+1)*20])
-
 	// Get the expected hash from the torrent metadata
 	expectedHash := torrent.Info.Pieces[pieceIndex*20 : (pieceIndex+1)*20]
 
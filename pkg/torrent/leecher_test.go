@@ -0,0 +1,409 @@
+package torrent
+
+import (
+	"bytes"
+	"net"
+	"reflect"
+	"sync"
+	"testing"
+)
+
+// recordConn is a connection that keeps everything written to it, so tests can see what a peer was sent
+type recordConn struct {
+	net.Conn
+	mtx     sync.Mutex
+	written bytes.Buffer
+}
+
+func (c *recordConn) Write(b []byte) (int, error) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	return c.written.Write(b)
+}
+
+func (c *recordConn) Close() error {
+	return nil
+}
+
+// sent returns the blocks of every message with the ID, request or cancel, that was written to the connection
+func (c *recordConn) sent(t *testing.T, id int8) []block {
+	t.Helper()
+
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+
+	blocks := []block{}
+	r := bytes.NewReader(c.written.Bytes())
+	for r.Len() > 0 {
+		message, err := readMessage(r)
+		if err != nil {
+			t.Fatalf("readMessage() error = %v", err)
+		}
+		if message.ID != id {
+			continue
+		}
+		b, err := message.parseBlock()
+		if err != nil {
+			t.Fatalf("parseBlock() error = %v", err)
+		}
+		blocks = append(blocks, b)
+	}
+	return blocks
+}
+
+// newTestManager builds a download manager without storage for a torrent of numPieces pieces of pieceLength,
+// picking pieces in order so tests know which ones get claimed
+func newTestManager(numPieces int, pieceLength int, pipeline int) *downloadManager {
+	info := TorrentInfo{
+		Name:        "test",
+		Length:      int64(numPieces * pieceLength),
+		PieceLength: pieceLength,
+		Pieces:      make([]byte, 20*numPieces),
+	}
+	return &downloadManager{
+		torrent:      Torrent{Info: info},
+		picker:       SequentialPicker{},
+		pipeline:     pipeline,
+		bitfield:     make([]byte, (numPieces+7)/8),
+		inProgress:   make([]bool, numPieces),
+		availability: make([]int, numPieces),
+		partial:      make(map[uint32]*partialPiece),
+		active:       make(map[uint32]*partialPiece),
+		changed:      make(chan struct{}),
+		arrived:      make(chan struct{}),
+	}
+}
+
+// newTestPipeline is the pipeline of a worker whose peer unchoked us and has the pieces, along with the
+// connection that records what the peer gets sent
+func newTestPipeline(m *downloadManager, pieces []uint32) (*peerPipeline, *recordConn) {
+	conn := &recordConn{}
+	peer := newPeerConn(conn)
+	peer.peerChoking = false
+	peer.bitfield = make([]byte, len(m.bitfield))
+	for _, pieceIndex := range pieces {
+		setPiece(peer.bitfield, pieceIndex)
+	}
+	return newPeerPipeline(peer, m), conn
+}
+
+// allPieces lists the indices of every piece of a torrent
+func allPieces(numPieces int) []uint32 {
+	pieces := []uint32{}
+	for pieceIndex := uint32(0); pieceIndex < uint32(numPieces); pieceIndex++ {
+		pieces = append(pieces, pieceIndex)
+	}
+	return pieces
+}
+
+// fillPipeline tops up a worker's pipeline the way peerWorker does, taking on pieces until the manager has none
+// left for it
+func fillPipeline(t *testing.T, m *downloadManager, pipeline *peerPipeline) {
+	t.Helper()
+
+	for {
+		err := pipeline.fill()
+		if err != nil {
+			t.Fatalf("fill() error = %v", err)
+		}
+		piece, _ := m.claimPiece(pipeline.peer, pipeline)
+		if piece == nil {
+			return
+		}
+		pipeline.add(piece)
+	}
+}
+
+// receiveBlock hands a worker a block from its peer, the way peerWorker does
+func receiveBlock(t *testing.T, m *downloadManager, pipeline *peerPipeline, b block) {
+	t.Helper()
+
+	piece, i, data, err := pipeline.receive(newPieceMessage(b.index, b.begin, make([]byte, b.length)))
+	if err != nil {
+		t.Fatalf("receive() error = %v", err)
+	}
+	if piece != nil {
+		m.addBlock(piece, i, data)
+	}
+}
+
+func TestPipelineDepth(t *testing.T) {
+	tests := []struct {
+		name         string
+		numPieces    int
+		pieceLength  int
+		depth        int
+		wantRequests int
+		wantPieces   int // Pieces the worker takes on to fill its pipeline
+		wantRefill   int // Requests in flight once the first block arrives and the pipeline is topped up again
+	}{
+		{
+			name:         "requests run on into the next piece",
+			numPieces:    5,
+			pieceLength:  4 * BLOCK_SIZE,
+			depth:        MAX_OUTSTANDING_REQUESTS,
+			wantRequests: MAX_OUTSTANDING_REQUESTS,
+			wantPieces:   3,
+			wantRefill:   MAX_OUTSTANDING_REQUESTS,
+		},
+		{
+			name:         "depth of one",
+			numPieces:    3,
+			pieceLength:  4 * BLOCK_SIZE,
+			depth:        1,
+			wantRequests: 1,
+			wantPieces:   1,
+			wantRefill:   1,
+		},
+		{
+			name:         "depth ending on a piece boundary",
+			numPieces:    3,
+			pieceLength:  4 * BLOCK_SIZE,
+			depth:        8,
+			wantRequests: 8,
+			wantPieces:   2,
+			wantRefill:   8,
+		},
+		{
+			name:         "fewer blocks than the depth",
+			numPieces:    2,
+			pieceLength:  4 * BLOCK_SIZE,
+			depth:        MAX_OUTSTANDING_REQUESTS,
+			wantRequests: 8,
+			wantPieces:   2,
+			wantRefill:   7,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			m := newTestManager(test.numPieces, test.pieceLength, test.depth)
+			pipeline, conn := newTestPipeline(m, allPieces(test.numPieces))
+
+			fillPipeline(t, m, pipeline)
+			if len(pipeline.requested) != test.wantRequests {
+				t.Errorf("%d requests in flight, want %d", len(pipeline.requested), test.wantRequests)
+			}
+			if len(pipeline.pieces) != test.wantPieces {
+				t.Errorf("worker took on %d pieces, want %d", len(pipeline.pieces), test.wantPieces)
+			}
+
+			// Every block is only requested once, in order
+			sent := conn.sent(t, Request)
+			if len(sent) != test.wantRequests {
+				t.Fatalf("sent %d requests, want %d", len(sent), test.wantRequests)
+			}
+			for i, b := range sent {
+				want := block{index: uint32(i * BLOCK_SIZE / test.pieceLength), begin: uint32(i * BLOCK_SIZE % test.pieceLength), length: BLOCK_SIZE}
+				if b != want {
+					t.Errorf("request %d = %+v, want %+v", i, b, want)
+				}
+			}
+
+			receiveBlock(t, m, pipeline, sent[0])
+			fillPipeline(t, m, pipeline)
+			if len(pipeline.requested) != test.wantRefill {
+				t.Errorf("%d requests in flight after a block arrived, want %d", len(pipeline.requested), test.wantRefill)
+			}
+		})
+	}
+}
+
+func TestPipelineDrop(t *testing.T) {
+	// Three pieces of four blocks, with a pipeline that holds the first two
+	const numPieces = 3
+	const pieceLength = 4 * BLOCK_SIZE
+
+	tests := []struct {
+		name        string
+		received    []block // Blocks that arrive before the peer chokes us
+		wantPartial []uint32
+	}{
+		{
+			name:        "nothing received",
+			received:    []block{},
+			wantPartial: []uint32{},
+		},
+		{
+			name:        "a block of the first piece",
+			received:    []block{{0, BLOCK_SIZE, BLOCK_SIZE}},
+			wantPartial: []uint32{0},
+		},
+		{
+			name:        "blocks of both pieces",
+			received:    []block{{0, 0, BLOCK_SIZE}, {1, 3 * BLOCK_SIZE, BLOCK_SIZE}},
+			wantPartial: []uint32{0, 1},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			m := newTestManager(numPieces, pieceLength, 8)
+			pipeline, _ := newTestPipeline(m, allPieces(numPieces))
+			fillPipeline(t, m, pipeline)
+			pieces := append([]*partialPiece{}, pipeline.pieces...)
+
+			for _, b := range test.received {
+				receiveBlock(t, m, pipeline, b)
+			}
+			changed := m.changed
+			pipeline.drop()
+
+			if len(pipeline.requested) != 0 || len(pipeline.pieces) != 0 {
+				t.Errorf("pipeline still has %d requests and %d pieces after drop()", len(pipeline.requested), len(pipeline.pieces))
+			}
+			for _, piece := range pieces {
+				for i, requested := range piece.requested {
+					if requested != 0 {
+						t.Errorf("block %d of piece %d counted as requested %d times after drop()", i, piece.index, requested)
+					}
+				}
+				if m.inProgress[piece.index] || m.active[piece.index] != nil {
+					t.Errorf("piece %d still in progress after drop()", piece.index)
+				}
+			}
+			partial := []uint32{}
+			for pieceIndex := uint32(0); pieceIndex < numPieces; pieceIndex++ {
+				if m.partial[pieceIndex] != nil {
+					partial = append(partial, pieceIndex)
+				}
+			}
+			if !reflect.DeepEqual(partial, test.wantPartial) {
+				t.Errorf("partial pieces = %v, want %v", partial, test.wantPartial)
+			}
+			select {
+			case <-changed:
+			default:
+				t.Error("idle workers weren't woken up when the pieces were handed back")
+			}
+
+			// Another worker picks the pieces up and only asks for the blocks that are still missing
+			other, conn := newTestPipeline(m, allPieces(numPieces))
+			fillPipeline(t, m, other)
+			for _, b := range conn.sent(t, Request) {
+				for _, received := range test.received {
+					if b == received {
+						t.Errorf("block %+v requested again after it arrived", b)
+					}
+				}
+			}
+			if want := 8; len(other.requested) != want {
+				t.Errorf("other worker has %d requests in flight, want %d", len(other.requested), want)
+			}
+		})
+	}
+}
+
+func TestEndgame(t *testing.T) {
+	// Two pieces of two blocks, which the first worker requests all of
+	const numPieces = 2
+	const pieceLength = 2 * BLOCK_SIZE
+	first := block{0, 0, BLOCK_SIZE}
+
+	tests := []struct {
+		name           string
+		othersHave     [][]uint32 // The pieces the peer of every other worker has
+		wantDuplicates []int      // The requests every other worker sends for blocks the first worker requested already
+	}{
+		{
+			name:           "one other worker",
+			othersHave:     [][]uint32{{0, 1}},
+			wantDuplicates: []int{4},
+		},
+		{
+			name:           "two other workers",
+			othersHave:     [][]uint32{{0, 1}, {0, 1}},
+			wantDuplicates: []int{4, 4},
+		},
+		{
+			name:           "other worker's peer only has the second piece",
+			othersHave:     [][]uint32{{1}},
+			wantDuplicates: []int{2},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			m := newTestManager(numPieces, pieceLength, MAX_OUTSTANDING_REQUESTS)
+			firstPipeline, _ := newTestPipeline(m, allPieces(numPieces))
+			changed := m.changed
+			fillPipeline(t, m, firstPipeline)
+
+			// Requesting the last block starts endgame mode and wakes the idle workers
+			if !m.endgame {
+				t.Fatal("not in endgame mode once every block was requested")
+			}
+			select {
+			case <-changed:
+			default:
+				t.Error("idle workers weren't woken up when endgame mode started")
+			}
+
+			pipelines := []*peerPipeline{}
+			conns := []*recordConn{}
+			for i, have := range test.othersHave {
+				pipeline, conn := newTestPipeline(m, have)
+				fillPipeline(t, m, pipeline)
+				if got := len(conn.sent(t, Request)); got != test.wantDuplicates[i] {
+					t.Errorf("worker %d sent %d duplicate requests, want %d", i+1, got, test.wantDuplicates[i])
+				}
+				pipelines = append(pipelines, pipeline)
+				conns = append(conns, conn)
+			}
+
+			// A block from the first worker's peer gets the duplicate requests for it cancelled
+			arrived := m.blockArrived()
+			receiveBlock(t, m, firstPipeline, first)
+			select {
+			case <-arrived:
+			default:
+				if pipelines[0].piece(0) != nil {
+					t.Error("workers weren't woken up when a block they requested arrived")
+				}
+			}
+			for i, pipeline := range pipelines {
+				err := pipeline.cancelReceived()
+				if err != nil {
+					t.Fatalf("cancelReceived() error = %v", err)
+				}
+				cancels := conns[i].sent(t, Cancel)
+				if pipeline.piece(0) == nil {
+					if len(cancels) != 0 {
+						t.Errorf("worker %d cancelled %v for a piece it isn't on", i+1, cancels)
+					}
+					continue
+				}
+				if len(cancels) != 1 || cancels[0] != first {
+					t.Errorf("worker %d cancelled %v, want just %+v", i+1, cancels, first)
+				}
+				if _, ok := pipeline.requested[first]; ok {
+					t.Errorf("worker %d still counts %+v as requested", i+1, first)
+				}
+			}
+			if requested := firstPipeline.piece(0).requested[0]; requested != 0 {
+				t.Errorf("block counted as requested %d times after it arrived, want 0", requested)
+			}
+
+			// Only one of the workers on a finished piece gets to deliver it
+			for _, pipeline := range append([]*peerPipeline{firstPipeline}, pipelines...) {
+				if pipeline.piece(0) != nil {
+					receiveBlock(t, m, pipeline, block{0, BLOCK_SIZE, BLOCK_SIZE})
+				}
+			}
+			delivered := 0
+			for _, pipeline := range append([]*peerPipeline{firstPipeline}, pipelines...) {
+				for _, piece := range pipeline.finished() {
+					if piece.index != 0 {
+						t.Errorf("piece %d finished, want only piece 0", piece.index)
+					}
+					if m.deliverPiece(piece) {
+						delivered++
+					}
+				}
+			}
+			if delivered != 1 {
+				t.Errorf("piece 0 delivered %d times, want once", delivered)
+			}
+		})
+	}
+}
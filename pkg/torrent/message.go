@@ -0,0 +1,171 @@
+package torrent
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+)
+
+// Peer wire message IDs (BEP 3). Keep-alives have no ID at all, just a zero length prefix.
+const (
+	Choke         int8 = 0
+	Unchoke       int8 = 1
+	Interested    int8 = 2
+	NotInterested int8 = 3
+	Have          int8 = 4
+	Bitfield      int8 = 5
+	Request       int8 = 6
+	Piece         int8 = 7
+	Cancel        int8 = 8
+)
+
+// MAX_MESSAGE_LENGTH is the largest message we accept, a piece message of MAX_BLOCK_SIZE plus its header
+// leaves plenty of room for the bitfield of any reasonable torrent
+const MAX_MESSAGE_LENGTH = MAX_BLOCK_SIZE + 1024
+
+type Message struct {
+	Length  uint32
+	ID      int8
+	Payload []byte
+}
+
+// newMessage builds a message, setting its length from the payload (1 byte for the ID + the payload)
+func newMessage(id int8, payload []byte) *Message {
+	return &Message{
+		Length:  uint32(1 + len(payload)),
+		ID:      id,
+		Payload: payload,
+	}
+}
+
+// newKeepAliveMessage is a message with a length of zero and nothing else
+func newKeepAliveMessage() *Message {
+	return &Message{Length: 0}
+}
+
+func newHaveMessage(pieceIndex uint32) *Message {
+	return newMessage(Have, uint32ToBytes(pieceIndex))
+}
+
+func newBitfieldMessage(bitfield []byte) *Message {
+	payload := make([]byte, len(bitfield))
+	copy(payload, bitfield)
+	return newMessage(Bitfield, payload)
+}
+
+// newRequestMessage and newCancelMessage share a payload of piece index, begin and length
+func newRequestMessage(b block) *Message {
+	return newMessage(Request, blockPayload(b))
+}
+
+func newCancelMessage(b block) *Message {
+	return newMessage(Cancel, blockPayload(b))
+}
+
+// newPieceMessage carries a block, its payload is the piece index, begin and then the block itself
+func newPieceMessage(pieceIndex uint32, begin uint32, data []byte) *Message {
+	payload := make([]byte, 8, 8+len(data))
+	binary.BigEndian.PutUint32(payload[0:4], pieceIndex)
+	binary.BigEndian.PutUint32(payload[4:8], begin)
+	return newMessage(Piece, append(payload, data...))
+}
+
+func blockPayload(b block) []byte {
+	payload := make([]byte, 12)
+	binary.BigEndian.PutUint32(payload[0:4], b.index)
+	binary.BigEndian.PutUint32(payload[4:8], b.begin)
+	binary.BigEndian.PutUint32(payload[8:12], b.length)
+	return payload
+}
+
+// parseBlock reads the piece index, begin and length out of a request or cancel message
+func (m *Message) parseBlock() (block, error) {
+	if len(m.Payload) != 12 {
+		return block{}, fmt.Errorf("invalid block payload length %d", len(m.Payload))
+	}
+	return block{
+		index:  binary.BigEndian.Uint32(m.Payload[0:4]),
+		begin:  binary.BigEndian.Uint32(m.Payload[4:8]),
+		length: binary.BigEndian.Uint32(m.Payload[8:12]),
+	}, nil
+}
+
+// parseHave reads the piece index out of a have message
+func (m *Message) parseHave() (uint32, error) {
+	if len(m.Payload) != 4 {
+		return 0, fmt.Errorf("invalid have payload length %d", len(m.Payload))
+	}
+	return binary.BigEndian.Uint32(m.Payload), nil
+}
+
+// parsePiece reads the piece index, begin and the block out of a piece message
+func (m *Message) parsePiece() (uint32, uint32, []byte, error) {
+	if len(m.Payload) < 8 {
+		return 0, 0, nil, fmt.Errorf("piece message too short")
+	}
+	return binary.BigEndian.Uint32(m.Payload[0:4]), binary.BigEndian.Uint32(m.Payload[4:8]), m.Payload[8:], nil
+}
+
+func (m *Message) Marshal() ([]byte, error) {
+	// Keep-alives are just the zero length prefix
+	if m.Length == 0 {
+		return make([]byte, 4), nil
+	}
+
+	// Marshal the message
+	buf := make([]byte, 5+len(m.Payload))
+	buf[0] = byte(m.Length >> 24)
+	buf[1] = byte(m.Length >> 16)
+	buf[2] = byte(m.Length >> 8)
+	buf[3] = byte(m.Length)
+	buf[4] = byte(m.ID)
+	copy(buf[5:], m.Payload)
+
+	return buf, nil
+}
+
+func UnmarshalMessage(buf []byte) (*Message, error) {
+	if len(buf) < 4 {
+		return nil, fmt.Errorf("message too short")
+	}
+
+	length := uint32(buf[0])<<24 | uint32(buf[1])<<16 | uint32(buf[2])<<8 | uint32(buf[3])
+	if length == 0 {
+		return newKeepAliveMessage(), nil
+	}
+	if len(buf) < 5 || uint32(len(buf)-4) != length {
+		return nil, fmt.Errorf("message length %d does not match %d bytes", length, len(buf)-4)
+	}
+
+	// Unmarshal the message
+	m := Message{
+		length,
+		int8(buf[4]),
+		buf[5:],
+	}
+
+	return &m, nil
+}
+
+// readMessage reads one whole message off of a connection, keep-alives come back with a Length of 0
+func readMessage(r io.Reader) (*Message, error) {
+	buf := make([]byte, 4)
+	_, err := io.ReadFull(r, buf)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read message length: %v", err)
+	}
+
+	length := binary.BigEndian.Uint32(buf)
+	if length > MAX_MESSAGE_LENGTH {
+		return nil, fmt.Errorf("message length %d too large", length)
+	}
+
+	// Pieces can be much larger than a single TCP read, so keep reading until we have all of it
+	buf2 := make([]byte, length)
+	_, err = io.ReadFull(r, buf2)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read message: %v", err)
+	}
+
+	return UnmarshalMessage(append(buf, buf2...))
+}
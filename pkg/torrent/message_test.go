@@ -0,0 +1,139 @@
+package torrent
+
+import (
+	"bytes"
+	"encoding/binary"
+	"reflect"
+	"testing"
+)
+
+func TestMessageRoundTrip(t *testing.T) {
+	tests := []struct {
+		name    string
+		message *Message
+		wire    []byte
+	}{
+		{"keep-alive", newKeepAliveMessage(), []byte{0, 0, 0, 0}},
+		{"choke", newMessage(Choke, nil), []byte{0, 0, 0, 1, 0}},
+		{"unchoke", newMessage(Unchoke, nil), []byte{0, 0, 0, 1, 1}},
+		{"interested", newMessage(Interested, nil), []byte{0, 0, 0, 1, 2}},
+		{"not interested", newMessage(NotInterested, nil), []byte{0, 0, 0, 1, 3}},
+		{"have", newHaveMessage(258), []byte{0, 0, 0, 5, 4, 0, 0, 1, 2}},
+		{"bitfield", newBitfieldMessage([]byte{0xa0, 0x01}), []byte{0, 0, 0, 3, 5, 0xa0, 0x01}},
+		{
+			"request",
+			newRequestMessage(block{index: 1, begin: 0x4000, length: 0x4000}),
+			[]byte{0, 0, 0, 13, 6, 0, 0, 0, 1, 0, 0, 0x40, 0, 0, 0, 0x40, 0},
+		},
+		{
+			"piece",
+			newPieceMessage(2, 16, []byte("data")),
+			[]byte{0, 0, 0, 13, 7, 0, 0, 0, 2, 0, 0, 0, 16, 'd', 'a', 't', 'a'},
+		},
+		{
+			"cancel",
+			newCancelMessage(block{index: 3, begin: 0, length: 100}),
+			[]byte{0, 0, 0, 13, 8, 0, 0, 0, 3, 0, 0, 0, 0, 0, 0, 0, 100},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			wire, err := test.message.Marshal()
+			if err != nil {
+				t.Fatalf("Marshal() error = %v", err)
+			}
+			if !bytes.Equal(wire, test.wire) {
+				t.Fatalf("Marshal() = %v, want %v", wire, test.wire)
+			}
+
+			message, err := readMessage(bytes.NewReader(wire))
+			if err != nil {
+				t.Fatalf("readMessage() error = %v", err)
+			}
+			if message.Length != test.message.Length || message.ID != test.message.ID || !bytes.Equal(message.Payload, test.message.Payload) {
+				t.Errorf("readMessage() = %+v, want %+v", message, test.message)
+			}
+		})
+	}
+}
+
+func TestUnmarshalMessageErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		buf  []byte
+	}{
+		{"no length", []byte{0, 0}},
+		{"length without an ID", []byte{0, 0, 0, 1}},
+		{"payload shorter than the length", []byte{0, 0, 0, 5, 4, 0, 0}},
+		{"payload longer than the length", []byte{0, 0, 0, 1, 1, 0}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, err := UnmarshalMessage(test.buf)
+			if err == nil {
+				t.Errorf("UnmarshalMessage(%v) succeeded, want an error", test.buf)
+			}
+		})
+	}
+}
+
+func TestReadMessageErrors(t *testing.T) {
+	tooLong := binary.BigEndian.AppendUint32(nil, MAX_MESSAGE_LENGTH+1)
+
+	tests := []struct {
+		name string
+		wire []byte
+	}{
+		{"empty", []byte{}},
+		{"cut off length", []byte{0, 0}},
+		{"cut off payload", []byte{0, 0, 0, 5, 4, 0}},
+		{"too long", tooLong},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, err := readMessage(bytes.NewReader(test.wire))
+			if err == nil {
+				t.Errorf("readMessage(%v) succeeded, want an error", test.wire)
+			}
+		})
+	}
+}
+
+func TestParsePayloads(t *testing.T) {
+	t.Run("block", func(t *testing.T) {
+		want := block{index: 7, begin: 32768, length: 16384}
+		got, err := newRequestMessage(want).parseBlock()
+		if err != nil || !reflect.DeepEqual(got, want) {
+			t.Errorf("parseBlock() = %+v, %v, want %+v", got, err, want)
+		}
+		_, err = newMessage(Request, []byte{0, 0, 0, 1}).parseBlock()
+		if err == nil {
+			t.Error("parseBlock() of a short payload succeeded")
+		}
+	})
+
+	t.Run("have", func(t *testing.T) {
+		got, err := newHaveMessage(9).parseHave()
+		if err != nil || got != 9 {
+			t.Errorf("parseHave() = %d, %v, want 9", got, err)
+		}
+		_, err = newMessage(Have, []byte{0, 0, 9}).parseHave()
+		if err == nil {
+			t.Error("parseHave() of a short payload succeeded")
+		}
+	})
+
+	t.Run("piece", func(t *testing.T) {
+		index, begin, data, err := newPieceMessage(4, 16384, []byte{1, 2, 3}).parsePiece()
+		if err != nil || index != 4 || begin != 16384 || !bytes.Equal(data, []byte{1, 2, 3}) {
+			t.Errorf("parsePiece() = %d, %d, %v, %v, want 4, 16384, [1 2 3]", index, begin, data, err)
+		}
+		_, _, _, err = newMessage(Piece, []byte{0, 0, 0, 4}).parsePiece()
+		if err == nil {
+			t.Error("parsePiece() of a short payload succeeded")
+		}
+	})
+}
@@ -0,0 +1,96 @@
+package torrent
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+
+	"bittorrent/pkg/metrics"
+)
+
+// errHandshakeFailed wraps the errors of a handshake with a peer we dialed, so they can be told apart from dial errors
+var errHandshakeFailed = errors.New("handshake failed")
+
+// stackMetrics counts what a SeederStack has done since it started. Its zero value is ready to use.
+type stackMetrics struct {
+	mtx      sync.Mutex
+	counters stackCounters
+}
+
+type stackCounters struct {
+	uploaded                  int64 // Bytes of blocks sent by sendPiece
+	blocksSent                int64
+	downloaded                int64 // Bytes of verified pieces stored
+	piecesStored              int64
+	hashFailures              int64 // Pieces that failed their hash check and were thrown away
+	incomingHandshakeFailures int64 // Failed handshakes with leechers that connected to us
+	outgoingHandshakeFailures int64 // Failed handshakes with peers we connected to
+}
+
+// add updates the counters under the lock
+func (m *stackMetrics) add(update func(c *stackCounters)) {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	update(&m.counters)
+}
+
+// snapshot returns a copy of the counters
+func (m *stackMetrics) snapshot() stackCounters {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	return m.counters
+}
+
+// ServeMetrics serves the stack's metrics on /metrics of port, it only returns if the port can't be listened on
+func (s *SeederStack) ServeMetrics(port int) {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", metrics.Handler(s.writeMetrics))
+
+	log.Printf("Serving metrics on port %d", port)
+	err := http.ListenAndServe(fmt.Sprintf(":%d", port), mux)
+	log.Println("Error serving metrics:", err)
+}
+
+// writeMetrics writes the stack's counters along with how many torrents and connections it has right now
+func (s *SeederStack) writeMetrics(mw *metrics.Writer) {
+	s.mtx.Lock()
+	seeding, downloading, incoming, outgoing := 0, 0, 0, 0
+	for _, seeder := range s.seeders {
+		incoming += len(seeder.connectedLeechers)
+		if seeder.download == nil {
+			seeding++
+			continue
+		}
+
+		// A finished download keeps its manager, but is only being seeded from then on
+		if seeder.download.missingPieces() > 0 {
+			downloading++
+		} else {
+			seeding++
+		}
+		seeder.download.mtx.Lock()
+		outgoing += len(seeder.download.peers)
+		seeder.download.mtx.Unlock()
+	}
+	s.mtx.Unlock()
+
+	m := s.metrics.snapshot()
+
+	mw.Family("client_torrents", metrics.GAUGE, "Torrents being served, by state.",
+		metrics.Labeled(float64(seeding), "state", "seeding"),
+		metrics.Labeled(float64(downloading), "state", "downloading"))
+	mw.Family("client_connections", metrics.GAUGE, "Open peer connections, by who dialed.",
+		metrics.Labeled(float64(incoming), "direction", "incoming"),
+		metrics.Labeled(float64(outgoing), "direction", "outgoing"))
+	mw.Family("client_uploaded_bytes_total", metrics.COUNTER, "Bytes of blocks sent to leechers.", metrics.Value(float64(m.uploaded)))
+	mw.Family("client_blocks_sent_total", metrics.COUNTER, "Blocks sent to leechers.", metrics.Value(float64(m.blocksSent)))
+	mw.Family("client_downloaded_bytes_total", metrics.COUNTER, "Bytes of verified pieces downloaded.", metrics.Value(float64(m.downloaded)))
+	mw.Family("client_pieces_stored_total", metrics.COUNTER, "Verified pieces downloaded.", metrics.Value(float64(m.piecesStored)))
+	mw.Family("client_piece_hash_failures_total", metrics.COUNTER, "Downloaded pieces that failed their hash check.",
+		metrics.Value(float64(m.hashFailures)))
+	mw.Family("client_handshake_failures_total", metrics.COUNTER, "Failed handshakes, by who dialed.",
+		metrics.Labeled(float64(m.incomingHandshakeFailures), "direction", "incoming"),
+		metrics.Labeled(float64(m.outgoingHandshakeFailures), "direction", "outgoing"))
+}
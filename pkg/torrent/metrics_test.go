@@ -0,0 +1,175 @@
+package torrent
+
+import (
+	"bittorrent/pkg/metrics"
+	"fmt"
+	"maps"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// scrapeMetrics fetches /metrics from handler and returns the kind of every family along with the value of every
+// series, keyed by its name and labels as they are written
+func scrapeMetrics(t *testing.T, handler http.Handler) (map[string]string, map[string]float64) {
+	t.Helper()
+
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("GET", "/metrics", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("GET /metrics status = %d, want %d", w.Code, http.StatusOK)
+	}
+	if contentType := w.Header().Get("Content-Type"); contentType != metrics.CONTENT_TYPE {
+		t.Errorf("GET /metrics Content-Type = %q, want %q", contentType, metrics.CONTENT_TYPE)
+	}
+
+	families := make(map[string]string)
+	samples := make(map[string]float64)
+	for _, line := range strings.Split(strings.TrimSpace(w.Body.String()), "\n") {
+		if strings.HasPrefix(line, "# TYPE ") {
+			fields := strings.Fields(line)
+			families[fields[2]] = fields[3]
+			continue
+		}
+		if strings.HasPrefix(line, "#") {
+			continue
+		}
+		i := strings.LastIndex(line, " ")
+		value, err := strconv.ParseFloat(line[i+1:], 64)
+		if err != nil {
+			t.Fatalf("series %q has value %q: %v", line[:i], line[i+1:], err)
+		}
+		samples[line[:i]] = value
+	}
+	return families, samples
+}
+
+func TestStackMetrics(t *testing.T) {
+	const (
+		SEEDING = iota
+		DOWNLOADING
+		FINISHED // Downloaded every piece, but still has its download manager
+	)
+	type testTorrent struct {
+		state    int
+		leechers int // Leechers that connected to us
+		peers    int // Peers the download connected to
+	}
+
+	wantFamilies := map[string]string{
+		"client_torrents":                  metrics.GAUGE,
+		"client_connections":               metrics.GAUGE,
+		"client_uploaded_bytes_total":      metrics.COUNTER,
+		"client_blocks_sent_total":         metrics.COUNTER,
+		"client_downloaded_bytes_total":    metrics.COUNTER,
+		"client_pieces_stored_total":       metrics.COUNTER,
+		"client_piece_hash_failures_total": metrics.COUNTER,
+		"client_handshake_failures_total":  metrics.COUNTER,
+	}
+	counters := stackCounters{
+		uploaded:                  3 * BLOCK_SIZE,
+		blocksSent:                3,
+		downloaded:                2 * BLOCK_SIZE,
+		piecesStored:              2,
+		hashFailures:              1,
+		incomingHandshakeFailures: 4,
+		outgoingHandshakeFailures: 5,
+	}
+	wantCounters := map[string]float64{
+		`client_uploaded_bytes_total`:                           3 * BLOCK_SIZE,
+		`client_blocks_sent_total`:                              3,
+		`client_downloaded_bytes_total`:                         2 * BLOCK_SIZE,
+		`client_pieces_stored_total`:                            2,
+		`client_piece_hash_failures_total`:                      1,
+		`client_handshake_failures_total{direction="incoming"}`: 4,
+		`client_handshake_failures_total{direction="outgoing"}`: 5,
+	}
+
+	tests := []struct {
+		name            string
+		torrents        []testTorrent
+		wantSeeding     int
+		wantDownloading int
+		wantIncoming    int
+		wantOutgoing    int
+	}{
+		{
+			name:     "nothing served",
+			torrents: []testTorrent{},
+		},
+		{
+			name:         "seeding",
+			torrents:     []testTorrent{{state: SEEDING, leechers: 2}},
+			wantSeeding:  1,
+			wantIncoming: 2,
+		},
+		{
+			name:            "downloading",
+			torrents:        []testTorrent{{state: DOWNLOADING, leechers: 1, peers: 3}},
+			wantDownloading: 1,
+			wantIncoming:    1,
+			wantOutgoing:    3,
+		},
+		{
+			name:         "finished download is seeding",
+			torrents:     []testTorrent{{state: FINISHED, leechers: 1, peers: 2}},
+			wantSeeding:  1,
+			wantIncoming: 1,
+			wantOutgoing: 2,
+		},
+		{
+			name: "mixed",
+			torrents: []testTorrent{
+				{state: SEEDING, leechers: 2},
+				{state: DOWNLOADING, leechers: 1, peers: 3},
+				{state: FINISHED, peers: 1},
+				{state: DOWNLOADING, peers: 2},
+			},
+			wantSeeding:     2,
+			wantDownloading: 2,
+			wantIncoming:    3,
+			wantOutgoing:    6,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			stack := &SeederStack{}
+			for i, torrent := range test.torrents {
+				seeder := Seeder{infoHash: []byte(fmt.Sprintf("metrics-test-hash-%02d", i)), connectedLeechers: []*Leecher{}}
+				for j := 0; j < torrent.leechers; j++ {
+					seeder.connectedLeechers = append(seeder.connectedLeechers, &Leecher{conn: newPeerConn(&recordConn{})})
+				}
+				if torrent.state != SEEDING {
+					seeder.download = newTestManager(2, BLOCK_SIZE, 1)
+					for j := 0; j < torrent.peers; j++ {
+						seeder.download.peers = append(seeder.download.peers, newPeerConn(&recordConn{}))
+					}
+					if torrent.state == FINISHED {
+						setPiece(seeder.download.bitfield, 0)
+						setPiece(seeder.download.bitfield, 1)
+					}
+				}
+				stack.addSeeder(seeder)
+			}
+			stack.metrics.add(func(c *stackCounters) { *c = counters })
+
+			want := maps.Clone(wantCounters)
+			want[`client_torrents{state="seeding"}`] = float64(test.wantSeeding)
+			want[`client_torrents{state="downloading"}`] = float64(test.wantDownloading)
+			want[`client_connections{direction="incoming"}`] = float64(test.wantIncoming)
+			want[`client_connections{direction="outgoing"}`] = float64(test.wantOutgoing)
+
+			families, got := scrapeMetrics(t, metrics.Handler(stack.writeMetrics))
+			if !reflect.DeepEqual(families, wantFamilies) {
+				t.Errorf("families = %v, want %v", families, wantFamilies)
+			}
+			if !reflect.DeepEqual(got, want) {
+				t.Errorf("series = %v, want %v", got, want)
+			}
+		})
+	}
+}
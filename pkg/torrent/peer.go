@@ -0,0 +1,292 @@
+package torrent
+
+import (
+	"fmt"
+	"net"
+	"sync"
+	"time"
+)
+
+// Peers send a keep-alive when they have had nothing else to say for KEEP_ALIVE_INTERVAL,
+// and a peer we haven't heard anything from in PEER_TIMEOUT is dropped
+const (
+	KEEP_ALIVE_INTERVAL = 2 * time.Minute
+	PEER_TIMEOUT        = 3 * time.Minute
+)
+
+// peerConn is a connection to a remote peer along with the BEP 3 state on both ends of it.
+// Every connection starts out choked and not interested in both directions.
+type peerConn struct {
+	conn     net.Conn
+	writeMtx sync.Mutex // Messages get written from more than one goroutine
+
+	mtx            sync.Mutex
+	amChoking      bool   // We are choking the peer, so we won't answer its requests
+	amInterested   bool   // We want pieces that the peer has
+	peerChoking    bool   // The peer is choking us, so it won't answer our requests
+	peerInterested bool   // The peer wants pieces that we have
+	bitfield       []byte // The pieces the peer has, from its bitfield and have messages
+	lastWrite      time.Time
+	downloaded     int64 // Bytes of blocks the peer has sent us
+	uploaded       int64 // Bytes of blocks we have sent the peer
+
+	onHave   func(pieceIndices []uint32)  // Called with the pieces the peer newly tells us it has, if set
+	onUpload func(message *Message) error // Called with the peer's state, request and cancel messages on connections we dialed, if set
+}
+
+func newPeerConn(conn net.Conn) *peerConn {
+	return &peerConn{
+		conn:        conn,
+		amChoking:   true,
+		peerChoking: true,
+		lastWrite:   time.Now(),
+	}
+}
+
+// send writes a single message to the peer
+func (p *peerConn) send(message *Message) error {
+	msgBytes, err := message.Marshal()
+	if err != nil {
+		return err
+	}
+
+	p.writeMtx.Lock()
+	defer p.writeMtx.Unlock()
+
+	_, err = p.conn.Write(msgBytes)
+	if err != nil {
+		return err
+	}
+
+	p.mtx.Lock()
+	p.lastWrite = time.Now()
+	if message.ID == Piece && message.Length > 0 {
+		p.uploaded += int64(len(message.Payload) - 8)
+	}
+	p.mtx.Unlock()
+	return nil
+}
+
+// readLoop reads messages from the peer and hands them over on messages until the connection fails or done is closed
+func (p *peerConn) readLoop(messages chan<- *Message, readErr chan<- error, done <-chan struct{}) {
+	for {
+		message, err := p.readMessage()
+		if err != nil {
+			readErr <- err
+			return
+		}
+
+		select {
+		case messages <- message:
+		case <-done:
+			return
+		}
+	}
+}
+
+// readMessage waits for the next message from the peer, giving up if it has been silent for PEER_TIMEOUT
+func (p *peerConn) readMessage() (*Message, error) {
+	p.conn.SetReadDeadline(time.Now().Add(PEER_TIMEOUT))
+	message, err := readMessage(p.conn)
+	if err != nil {
+		return nil, err
+	}
+
+	if message.ID == Piece && message.Length > 0 && len(message.Payload) >= 8 {
+		p.mtx.Lock()
+		p.downloaded += int64(len(message.Payload) - 8)
+		p.mtx.Unlock()
+	}
+	return message, nil
+}
+
+// transferred returns how many bytes of blocks have been downloaded from and uploaded to the peer so far
+func (p *peerConn) transferred() (int64, int64) {
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+	return p.downloaded, p.uploaded
+}
+
+// keepAlive sends a keep-alive whenever nothing else has been sent for KEEP_ALIVE_INTERVAL, until done is closed
+func (p *peerConn) keepAlive(done <-chan struct{}) {
+	ticker := time.NewTicker(KEEP_ALIVE_INTERVAL / 4)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+			p.mtx.Lock()
+			idle := time.Since(p.lastWrite)
+			p.mtx.Unlock()
+
+			if idle >= KEEP_ALIVE_INTERVAL {
+				if p.send(newKeepAliveMessage()) != nil {
+					return
+				}
+			}
+		}
+	}
+}
+
+// setChoking chokes or unchokes the peer, only sending a message if the state actually changes
+func (p *peerConn) setChoking(choking bool) error {
+	p.mtx.Lock()
+	changed := p.amChoking != choking
+	p.amChoking = choking
+	p.mtx.Unlock()
+
+	if !changed {
+		return nil
+	}
+	if choking {
+		return p.send(newMessage(Choke, nil))
+	}
+	return p.send(newMessage(Unchoke, nil))
+}
+
+// setInterested tells the peer whether we want anything from it, only sending a message if the state actually changes
+func (p *peerConn) setInterested(interested bool) error {
+	p.mtx.Lock()
+	changed := p.amInterested != interested
+	p.amInterested = interested
+	p.mtx.Unlock()
+
+	if !changed {
+		return nil
+	}
+	if interested {
+		return p.send(newMessage(Interested, nil))
+	}
+	return p.send(newMessage(NotInterested, nil))
+}
+
+// handleStateMessage applies choke, unchoke, interested and not interested messages from the peer,
+// returning false for any other kind of message
+func (p *peerConn) handleStateMessage(message *Message) bool {
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+
+	switch message.ID {
+	case Choke:
+		p.peerChoking = true
+	case Unchoke:
+		p.peerChoking = false
+	case Interested:
+		p.peerInterested = true
+	case NotInterested:
+		p.peerInterested = false
+	default:
+		return false
+	}
+	return true
+}
+
+// handleAvailability applies have and bitfield messages from the peer, returning false for any other kind of message
+func (p *peerConn) handleAvailability(message *Message, numPieces int) (bool, error) {
+	if message.ID != Have && message.ID != Bitfield {
+		return false, nil
+	}
+
+	newPieces, err := p.updateBitfield(message, numPieces)
+	if err != nil {
+		return true, err
+	}
+
+	// Called without holding the lock, since the callback takes locks of its own
+	if p.onHave != nil && len(newPieces) > 0 {
+		p.onHave(newPieces)
+	}
+	return true, nil
+}
+
+// updateBitfield applies a have or bitfield message to the peer's bitfield, returning the pieces it didn't have before
+func (p *peerConn) updateBitfield(message *Message, numPieces int) ([]uint32, error) {
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+
+	if p.bitfield == nil {
+		p.bitfield = make([]byte, (numPieces+7)/8)
+	}
+
+	newPieces := []uint32{}
+	if message.ID == Have {
+		pieceIndex, err := message.parseHave()
+		if err != nil {
+			return nil, err
+		}
+		if int(pieceIndex) >= numPieces {
+			return nil, fmt.Errorf("have for piece %d out of range", pieceIndex)
+		}
+		if !hasPiece(p.bitfield, pieceIndex) {
+			setPiece(p.bitfield, pieceIndex)
+			newPieces = append(newPieces, pieceIndex)
+		}
+		return newPieces, nil
+	}
+
+	if len(message.Payload) != len(p.bitfield) {
+		return nil, fmt.Errorf("invalid bitfield length %d", len(message.Payload))
+	}
+	// The spare bits at the end have to be cleared
+	for pieceIndex := numPieces; pieceIndex < len(p.bitfield)*8; pieceIndex++ {
+		if hasPiece(message.Payload, uint32(pieceIndex)) {
+			return nil, fmt.Errorf("bitfield has spare bits set")
+		}
+	}
+	for pieceIndex := uint32(0); pieceIndex < uint32(numPieces); pieceIndex++ {
+		if hasPiece(message.Payload, pieceIndex) && !hasPiece(p.bitfield, pieceIndex) {
+			setPiece(p.bitfield, pieceIndex)
+			newPieces = append(newPieces, pieceIndex)
+		}
+	}
+	return newPieces, nil
+}
+
+// hasPiece reports whether the peer has told us it has the piece
+func (p *peerConn) hasPiece(pieceIndex uint32) bool {
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+
+	if p.bitfield == nil || int(pieceIndex/8) >= len(p.bitfield) {
+		return false
+	}
+	return hasPiece(p.bitfield, pieceIndex)
+}
+
+// pieces lists every piece the peer has told us it has
+func (p *peerConn) pieces() []uint32 {
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+
+	pieceIndices := []uint32{}
+	for pieceIndex := uint32(0); pieceIndex < uint32(len(p.bitfield)*8); pieceIndex++ {
+		if hasPiece(p.bitfield, pieceIndex) {
+			pieceIndices = append(pieceIndices, pieceIndex)
+		}
+	}
+	return pieceIndices
+}
+
+func (p *peerConn) isChoked() bool {
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+	return p.peerChoking
+}
+
+func (p *peerConn) isChoking() bool {
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+	return p.amChoking
+}
+
+func (p *peerConn) isInterested() bool {
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+	return p.peerInterested
+}
+
+func (p *peerConn) Close() error {
+	return p.conn.Close()
+}
@@ -0,0 +1,102 @@
+package torrent
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestUpdateBitfield(t *testing.T) {
+	// 10 pieces take 2 bytes, leaving 6 spare bits at the end
+	const numPieces = 10
+
+	type step struct {
+		message *Message
+		want    []uint32 // The pieces the message newly tells us about
+		wantErr bool
+	}
+	tests := []struct {
+		name  string
+		steps []step
+		have  []uint32 // Every piece the peer has at the end
+	}{
+		{
+			name:  "bitfield",
+			steps: []step{{message: newBitfieldMessage([]byte{0xa0, 0x40}), want: []uint32{0, 2, 9}}},
+			have:  []uint32{0, 2, 9},
+		},
+		{
+			name:  "empty bitfield",
+			steps: []step{{message: newBitfieldMessage([]byte{0, 0}), want: []uint32{}}},
+		},
+		{
+			name:  "have",
+			steps: []step{{message: newHaveMessage(3), want: []uint32{3}}},
+			have:  []uint32{3},
+		},
+		{
+			name: "repeated have",
+			steps: []step{
+				{message: newHaveMessage(3), want: []uint32{3}},
+				{message: newHaveMessage(3), want: []uint32{}},
+			},
+			have: []uint32{3},
+		},
+		{
+			name: "bitfield after have",
+			steps: []step{
+				{message: newHaveMessage(2), want: []uint32{2}},
+				{message: newBitfieldMessage([]byte{0xa0, 0x00}), want: []uint32{0}},
+			},
+			have: []uint32{0, 2},
+		},
+		{
+			name:  "bitfield too short",
+			steps: []step{{message: newBitfieldMessage([]byte{0xff}), wantErr: true}},
+		},
+		{
+			name:  "bitfield too long",
+			steps: []step{{message: newBitfieldMessage([]byte{0xff, 0xc0, 0x00}), wantErr: true}},
+		},
+		{
+			name:  "spare bits set",
+			steps: []step{{message: newBitfieldMessage([]byte{0x00, 0x20}), wantErr: true}},
+		},
+		{
+			name:  "have out of range",
+			steps: []step{{message: newHaveMessage(numPieces), wantErr: true}},
+		},
+		{
+			name:  "have too short",
+			steps: []step{{message: newMessage(Have, []byte{0, 1}), wantErr: true}},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			peer := &peerConn{}
+			for i, step := range test.steps {
+				newPieces, err := peer.updateBitfield(step.message, numPieces)
+				if (err != nil) != step.wantErr {
+					t.Fatalf("step %d: updateBitfield() error = %v, wantErr %v", i, err, step.wantErr)
+				}
+				if !step.wantErr && !reflect.DeepEqual(newPieces, step.want) {
+					t.Errorf("step %d: updateBitfield() = %v, want %v", i, newPieces, step.want)
+				}
+			}
+
+			have := []uint32{}
+			for pieceIndex := uint32(0); pieceIndex < numPieces; pieceIndex++ {
+				if peer.hasPiece(pieceIndex) {
+					have = append(have, pieceIndex)
+				}
+			}
+			want := test.have
+			if want == nil {
+				want = []uint32{}
+			}
+			if !reflect.DeepEqual(have, want) {
+				t.Errorf("peer has %v, want %v", have, want)
+			}
+		})
+	}
+}
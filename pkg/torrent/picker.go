@@ -0,0 +1,70 @@
+package torrent
+
+import "math/rand"
+
+// RANDOM_FIRST_PIECES is how many pieces the rarest-first picker picks at random before it starts picking by rarity,
+// so a new download gets something to trade as quickly as possible
+const RANDOM_FIRST_PIECES = 4
+
+// PickState is everything a PiecePicker gets to choose from. The slices belong to the download and must not be kept.
+type PickState struct {
+	Candidates   []uint32 // Pieces the peer has that we still need and nobody is working on, in index order
+	Availability []int    // How many connected peers have each piece
+	Partial      []bool   // Pieces we already have some blocks of
+	Completed    int      // How many pieces we have so far
+}
+
+// PiecePicker decides which piece a peer worker downloads next. Pick is only ever called with at least one candidate.
+type PiecePicker interface {
+	Pick(state *PickState) uint32
+}
+
+// SequentialPicker downloads pieces in index order, which is handy for previewing a file while it downloads
+type SequentialPicker struct{}
+
+func (SequentialPicker) Pick(state *PickState) uint32 {
+	return state.Candidates[0]
+}
+
+// RarestFirstPicker downloads the pieces that the fewest peers have first, so they spread through the swarm before
+// the peers that have them leave. Pieces we already have blocks of always come first so they get finished, and the
+// first RANDOM_FIRST_PIECES pieces are picked at random since a rare piece is slower to get.
+type RarestFirstPicker struct{}
+
+func (RarestFirstPicker) Pick(state *PickState) uint32 {
+	// Finish partial pieces before starting new ones
+	partial := []uint32{}
+	for _, pieceIndex := range state.Candidates {
+		if state.Partial[pieceIndex] {
+			partial = append(partial, pieceIndex)
+		}
+	}
+	if len(partial) > 0 {
+		return rarest(partial, state.Availability)
+	}
+
+	if state.Completed < RANDOM_FIRST_PIECES {
+		return state.Candidates[rand.Intn(len(state.Candidates))]
+	}
+	return rarest(state.Candidates, state.Availability)
+}
+
+// rarest picks the piece with the lowest availability, breaking ties at random so peers don't all go for the same piece
+func rarest(pieces []uint32, availability []int) uint32 {
+	best := pieces[0]
+	ties := 1
+	for _, pieceIndex := range pieces[1:] {
+		switch {
+		case availability[pieceIndex] < availability[best]:
+			best = pieceIndex
+			ties = 1
+		case availability[pieceIndex] == availability[best]:
+			// Reservoir sampling keeps every tied piece equally likely
+			ties++
+			if rand.Intn(ties) == 0 {
+				best = pieceIndex
+			}
+		}
+	}
+	return best
+}
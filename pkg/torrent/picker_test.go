@@ -0,0 +1,125 @@
+package torrent
+
+import (
+	"testing"
+)
+
+func TestSequentialPicker(t *testing.T) {
+	tests := []struct {
+		name       string
+		candidates []uint32
+		want       uint32
+	}{
+		{"first piece", []uint32{0, 1, 2}, 0},
+		{"skips what we have", []uint32{3, 5, 9}, 3},
+		{"single candidate", []uint32{7}, 7},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			state := &PickState{
+				Candidates:   test.candidates,
+				Availability: make([]int, 10),
+				Partial:      make([]bool, 10),
+				Completed:    10,
+			}
+			got := SequentialPicker{}.Pick(state)
+			if got != test.want {
+				t.Errorf("Pick() = %d, want %d", got, test.want)
+			}
+		})
+	}
+}
+
+func TestRarestFirstPicker(t *testing.T) {
+	tests := []struct {
+		name         string
+		candidates   []uint32
+		availability []int
+		partial      []uint32
+		completed    int
+		want         []uint32 // Any of these is a valid pick
+	}{
+		{
+			name:         "rarest piece",
+			candidates:   []uint32{0, 1, 2, 3},
+			availability: []int{3, 1, 2, 5},
+			completed:    RANDOM_FIRST_PIECES,
+			want:         []uint32{1},
+		},
+		{
+			name:         "ties are broken at random",
+			candidates:   []uint32{0, 1, 2, 3},
+			availability: []int{2, 1, 4, 1},
+			completed:    RANDOM_FIRST_PIECES,
+			want:         []uint32{1, 3},
+		},
+		{
+			name:         "only pieces the peer has",
+			candidates:   []uint32{0, 2},
+			availability: []int{3, 1, 2, 5},
+			completed:    RANDOM_FIRST_PIECES,
+			want:         []uint32{2},
+		},
+		{
+			name:         "partial pieces come first",
+			candidates:   []uint32{0, 1, 2, 3},
+			availability: []int{3, 1, 2, 5},
+			partial:      []uint32{3},
+			completed:    RANDOM_FIRST_PIECES,
+			want:         []uint32{3},
+		},
+		{
+			name:         "rarest of the partial pieces",
+			candidates:   []uint32{0, 1, 2, 3},
+			availability: []int{3, 1, 2, 5},
+			partial:      []uint32{0, 2, 3},
+			completed:    RANDOM_FIRST_PIECES,
+			want:         []uint32{2},
+		},
+		{
+			name:         "random while starting out",
+			candidates:   []uint32{0, 1, 2, 3},
+			availability: []int{3, 1, 2, 5},
+			completed:    RANDOM_FIRST_PIECES - 1,
+			want:         []uint32{0, 1, 2, 3},
+		},
+		{
+			name:         "partial pieces come first while starting out",
+			candidates:   []uint32{0, 1, 2, 3},
+			availability: []int{3, 1, 2, 5},
+			partial:      []uint32{0},
+			completed:    0,
+			want:         []uint32{0},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			state := &PickState{
+				Candidates:   test.candidates,
+				Availability: test.availability,
+				Partial:      make([]bool, len(test.availability)),
+				Completed:    test.completed,
+			}
+			for _, pieceIndex := range test.partial {
+				state.Partial[pieceIndex] = true
+			}
+
+			// Picks can be random, so every valid piece should come up given enough tries and nothing else should
+			seen := make(map[uint32]bool)
+			for i := 0; i < 200; i++ {
+				seen[RarestFirstPicker{}.Pick(state)] = true
+			}
+			for _, pieceIndex := range test.want {
+				if !seen[pieceIndex] {
+					t.Errorf("Pick() never picked %d", pieceIndex)
+				}
+				delete(seen, pieceIndex)
+			}
+			for pieceIndex := range seen {
+				t.Errorf("Pick() picked %d, want one of %v", pieceIndex, test.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,101 @@
+package torrent
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"os"
+
+	"github.com/zeebo/bencode"
+)
+
+// RESUME_SUFFIX is added to the save path of a download for its fast-resume file, which sits next to the partial files
+const RESUME_SUFFIX = ".resume"
+
+// ResumeData is the fast-resume state of a download. It is rewritten every time a piece is stored,
+// so a download can continue where it left off after the client quits.
+type ResumeData struct {
+	InfoHash    []byte `bencode:"info_hash"`
+	SavePath    string `bencode:"save_path"`
+	PieceLength int    `bencode:"piece length"`
+	Bitfield    []byte `bencode:"bitfield"` // The pieces that were verified and written to the partial files
+}
+
+// loadResumeData reads the fast-resume file for savePath, returning nil if there isn't one
+func loadResumeData(savePath string) (*ResumeData, error) {
+	data, err := os.ReadFile(savePath + RESUME_SUFFIX)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var resume ResumeData
+	err = bencode.NewDecoder(bytes.NewReader(data)).Decode(&resume)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode resume data: %v", err)
+	}
+
+	return &resume, nil
+}
+
+// save writes the resume data to a temporary file first, so quitting mid-write never leaves a corrupt resume file
+func (r *ResumeData) save() error {
+	data, err := bencode.EncodeBytes(r)
+	if err != nil {
+		return err
+	}
+
+	path := r.SavePath + RESUME_SUFFIX
+	err = os.WriteFile(path+".tmp", data, 0644)
+	if err != nil {
+		return err
+	}
+	return os.Rename(path+".tmp", path)
+}
+
+// remove deletes the resume file once the download is complete
+func (r *ResumeData) remove() error {
+	err := os.Remove(r.SavePath + RESUME_SUFFIX)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+// matches checks that the resume data belongs to this torrent and can be trusted for it
+func (r *ResumeData) matches(infoHash []byte, info *TorrentInfo) bool {
+	return bytes.Equal(r.InfoHash, infoHash) &&
+		r.PieceLength == info.PieceLength &&
+		len(r.Bitfield) == (info.NumPieces()+7)/8
+}
+
+// verifyPieces re-checks every piece the resume data claims to have against Info.Pieces,
+// returning a bitfield of only the pieces that are actually intact on disk
+func verifyPieces(storage *pieceStorage, torrent Torrent, claimed []byte) []byte {
+	totalPieces := uint32(torrent.Info.NumPieces())
+	verified := make([]byte, (totalPieces+7)/8)
+
+	for pieceIndex := uint32(0); pieceIndex < totalPieces; pieceIndex++ {
+		if !hasPiece(claimed, pieceIndex) {
+			continue
+		}
+
+		_, pieceLength := torrent.Info.pieceBounds(pieceIndex)
+		pieceData, err := storage.ReadBlock(pieceIndex, 0, pieceLength)
+		if err != nil {
+			log.Println("Error reading piece", pieceIndex, "for resume:", err)
+			continue
+		}
+
+		valid, err := validatePiece(torrent, pieceIndex, pieceData)
+		if err != nil || !valid {
+			log.Println("Piece", pieceIndex, "failed validation on resume")
+			continue
+		}
+		setPiece(verified, pieceIndex)
+	}
+
+	return verified
+}
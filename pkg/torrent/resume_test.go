@@ -0,0 +1,164 @@
+package torrent
+
+import (
+	"bittorrent/pkg/trackingserver"
+	"bytes"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+)
+
+// startPartialSeeder seeds only some pieces of a torrent, like a peer that is still downloading it, and returns
+// its stack along with the peer to download from
+func startPartialSeeder(t *testing.T, torrent Torrent, data []byte, pieces []uint32) (*SeederStack, trackingserver.Peer) {
+	t.Helper()
+
+	numPieces := torrent.Info.NumPieces()
+	storage, err := openStorage(filepath.Join(t.TempDir(), "partial"), &torrent.Info)
+	if err != nil {
+		t.Fatalf("openStorage() error = %v", err)
+	}
+	t.Cleanup(func() { storage.Close() })
+
+	bitfield := make([]byte, (numPieces+7)/8)
+	for _, pieceIndex := range pieces {
+		start, pieceLength := torrent.Info.pieceBounds(pieceIndex)
+		err = storage.WritePiece(pieceIndex, data[start:start+pieceLength])
+		if err != nil {
+			t.Fatalf("WritePiece(%d) error = %v", pieceIndex, err)
+		}
+		setPiece(bitfield, pieceIndex)
+	}
+
+	stack, peer := startTestSeeder(t, torrent, storage.root, "-TEST-partial-000001")
+	stack.mtx.Lock()
+	stack.seeders[0].download = &downloadManager{
+		torrent:    torrent,
+		bitfield:   bitfield,
+		inProgress: make([]bool, numPieces),
+		storage:    storage,
+	}
+	stack.mtx.Unlock()
+	return stack, peer
+}
+
+func TestDownloadResume(t *testing.T) {
+	have := []uint32{0, 1, 4} // The pieces the first attempt gets before its peer leaves
+
+	tests := []struct {
+		name        string
+		change      func(t *testing.T, savePath string) // What happens to the interrupted download before it restarts
+		wantFetched int                                 // Pieces the second attempt has to download
+	}{
+		{
+			name:        "only the missing pieces",
+			change:      func(t *testing.T, savePath string) {},
+			wantFetched: 3,
+		},
+		{
+			name: "piece corrupted on disk after it was stored",
+			change: func(t *testing.T, savePath string) {
+				file, err := os.OpenFile(savePath+PART_SUFFIX, os.O_WRONLY, 0644)
+				if err != nil {
+					t.Fatalf("error opening partial file: %v", err)
+				}
+				defer file.Close()
+				_, err = file.WriteAt([]byte("corrupt"), BLOCK_SIZE+100) // Inside piece 1
+				if err != nil {
+					t.Fatalf("error corrupting partial file: %v", err)
+				}
+			},
+			wantFetched: 4,
+		},
+		{
+			name: "resume data with a different piece length",
+			change: func(t *testing.T, savePath string) {
+				resume, err := loadResumeData(savePath)
+				if err != nil || resume == nil {
+					t.Fatalf("loadResumeData() = %v, %v, want the resume data", resume, err)
+				}
+				resume.PieceLength *= 2
+				err = resume.save()
+				if err != nil {
+					t.Fatalf("error saving resume data: %v", err)
+				}
+			},
+			wantFetched: 6,
+		},
+		{
+			name: "resume file removed",
+			change: func(t *testing.T, savePath string) {
+				err := os.Remove(savePath + RESUME_SUFFIX)
+				if err != nil {
+					t.Fatalf("error removing resume data: %v", err)
+				}
+			},
+			wantFetched: 6,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			dir := t.TempDir()
+			torrent, data := newTestTorrent(t, filepath.Join(dir, "seeded"), []TorrentFile{{Length: 5*BLOCK_SIZE + 100}}, BLOCK_SIZE)
+			savePath := filepath.Join(dir, "downloaded")
+
+			// The first attempt stops part way, when its only peer leaves after sending the pieces it has
+			stack := &SeederStack{}
+			partialStack, partial := startPartialSeeder(t, torrent, data, have)
+			result := make(chan error, 1)
+			go func() {
+				_, err := DownloadFromSeeders(stack, []trackingserver.Peer{partial}, torrent, savePath, "-TEST-leecher-000001", DownloadOptions{})
+				result <- err
+			}()
+			for start := time.Now(); stack.metrics.snapshot().piecesStored < int64(len(have)); time.Sleep(10 * time.Millisecond) {
+				if time.Since(start) > 5*time.Second {
+					t.Fatalf("first attempt stored %d pieces, want %d", stack.metrics.snapshot().piecesStored, len(have))
+				}
+			}
+			infoHash, _ := torrent.HashInfo()
+			partialStack.removeSeeder(infoHash)
+			err := <-result
+			stack.StopAll()
+			if err == nil {
+				t.Fatal("first DownloadFromSeeders() succeeded without every piece")
+			}
+			resume, err := loadResumeData(savePath)
+			if err != nil || resume == nil {
+				t.Fatalf("loadResumeData() = %v, %v, want the resume data", resume, err)
+			}
+			for pieceIndex := uint32(0); pieceIndex < uint32(torrent.Info.NumPieces()); pieceIndex++ {
+				want := slices.Contains(have, pieceIndex)
+				if hasPiece(resume.Bitfield, pieceIndex) != want {
+					t.Errorf("resume data has piece %d = %v, want %v", pieceIndex, !want, want)
+				}
+			}
+
+			test.change(t, savePath)
+
+			// The second attempt has a seeder with everything, which only gets asked for what is still missing
+			stack = &SeederStack{}
+			defer stack.StopAll()
+			seeder, peer := startTestSeeder(t, torrent, filepath.Join(dir, "seeded"), "-TEST-seeder-0000001")
+			_, err = DownloadFromSeeders(stack, []trackingserver.Peer{peer}, torrent, savePath, "-TEST-leecher-000001", DownloadOptions{})
+			if err != nil {
+				t.Fatalf("DownloadFromSeeders() after restarting error = %v", err)
+			}
+
+			if sent := seeder.metrics.snapshot().blocksSent; sent != int64(test.wantFetched) {
+				t.Errorf("seeder sent %d blocks, want %d", sent, test.wantFetched)
+			}
+			if stored := stack.metrics.snapshot().piecesStored; stored != int64(test.wantFetched) {
+				t.Errorf("stored %d pieces, want %d", stored, test.wantFetched)
+			}
+			if !bytes.Equal(readTestDownload(t, savePath, &torrent.Info), data) {
+				t.Error("downloaded data doesn't match what was seeded")
+			}
+			if _, err := os.Stat(savePath + RESUME_SUFFIX); !os.IsNotExist(err) {
+				t.Errorf("resume file left behind after the download, stat error = %v", err)
+			}
+		})
+	}
+}
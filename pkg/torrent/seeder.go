@@ -7,17 +7,13 @@ import (
 	"io"
 	"log"
 	"net"
-	"net/http"
-	"os"
 	"strconv"
-	"strings"
 
 	// "strings"
 	"sync"
+	"time"
 
 	"bittorrent/pkg/trackingserver"
-
-	"github.com/zeebo/bencode"
 )
 
 // All the seeder needs to do is respond to requests for specific pieces of a file
@@ -28,77 +24,154 @@ type Seeder struct {
 	addr              net.Addr
 	infoHash          []byte
 	peerID            []byte
-	connectedLeechers []Leecher
-	filepath          string
+	connectedLeechers []*Leecher
+	filepath          string           // The file being seeded, or the directory holding the files of a multi-file torrent
+	info              TorrentInfo      // Needed to map pieces onto files
+	download          *downloadManager // Set while the torrent is still downloading, so only the pieces we have are served
+	optimistic        *Leecher         // The leecher the choker is currently unchoking optimistically
+	trackers          [][]string       // Tiers of trackers to announce to
+	announce          *announceState   // Set by the stack, shared by every seeder of the torrent
+	metrics           *stackMetrics    // Set by the stack, counts what every seeder sends
 }
 
 type Leecher struct {
 	infoHash []byte
 	peerID   []byte
-	bitfield []byte
-	tcpConn  net.Conn
+	conn     *peerConn // Also tracks the leecher's bitfield
+
+	mtx        sync.Mutex
+	requests   []block       // Requests we haven't served yet, a cancel removes them from here
+	wake       chan struct{} // Tells the upload loop that there are new requests
+	lastSample transferRate  // What the connection had transferred at the last choke round
 }
 
 type SeederStack struct {
-	mtx     sync.Mutex
-	seeders []Seeder
-	port    int
+	mtx         sync.Mutex
+	seeders     []Seeder
+	port        int
+	uploadSlots int       // Leechers unchoked per torrent by the choker, UPLOAD_SLOTS if 0
+	announcer   Announcer // Sends the announces of every torrent, nothing is announced if nil
+	metrics     stackMetrics
 }
 
 // Important Constants
 const TrackerAddr string = "http://20.121.67.21:80/announce"
+
 // const TrackerAddr string = "http://localhost:8080/announce"
 
-// Adds Seeder to SeederStack and sends POST request to tracker
+// Pieces are transferred in blocks, BLOCK_SIZE is what we request and MAX_BLOCK_SIZE is the most we will serve at once
+const (
+	BLOCK_SIZE     = 16 * 1024  // 16 KB
+	MAX_BLOCK_SIZE = 128 * 1024 // 128 KB
+)
+
+// MAX_QUEUED_REQUESTS caps how many requests a leecher can have waiting on us, since leechers pipeline their requests
+const MAX_QUEUED_REQUESTS = 250
+
+// AddSeeder starts serving a torrent and announces it to its trackers, which it keeps doing until the torrent is removed
 func (s *SeederStack) AddSeeder(seeder Seeder) error {
+	state, fresh := s.addSeeder(seeder)
+	if !fresh {
+		// Already being announced
+		return nil
+	}
+
+	announce, _ := s.trackerAnnounce(seeder.infoHash, trackingserver.STARTED)
+	interval, err := s.sendAnnounce(announce)
+	if err != nil {
+		// Nobody can find the torrent if the tracker doesn't know about it
+		s.removeSeeder(seeder.infoHash)
+		return err
+	}
+
+	go s.announceLoop(seeder.infoHash, state, interval)
+	return nil
+}
+
+// addSeeder starts serving a torrent without announcing it, replacing any seeder we already had for it.
+// It returns the torrent's announce state, and whether it is new, in which case the caller has to start announcing.
+func (s *SeederStack) addSeeder(seeder Seeder) (*announceState, bool) {
 	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	seeder.metrics = &s.metrics
+	for i := range s.seeders {
+		if bytes.Equal(s.seeders[i].infoHash, seeder.infoHash) {
+			seeder.connectedLeechers = append(seeder.connectedLeechers, s.seeders[i].connectedLeechers...)
+			seeder.announce = s.seeders[i].announce
+			s.seeders[i] = seeder
+			return seeder.announce, false
+		}
+	}
+	seeder.announce = newAnnounceState()
 	s.seeders = append(s.seeders, seeder)
-	s.mtx.Unlock()
+	return seeder.announce, true
+}
 
-	// Send a request to the tracker to announce the seeder
-	announce := trackingserver.AnnounceRequest{
-		InfoHash: seeder.infoHash,
-		PeerID:   seeder.peerID,
-		IP:       strings.Split(seeder.addr.String(), ":")[0], // Only want the IP address
-		Port:     s.port,
-		Event:    trackingserver.STARTED,
+// removeSeeder stops serving a torrent, disconnects its leechers and has the announce loop send the stopped announce
+func (s *SeederStack) removeSeeder(infoHash []byte) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	for i := range s.seeders {
+		if bytes.Equal(s.seeders[i].infoHash, infoHash) {
+			// Filled in now, since the loop can't look the seeder up once it is gone
+			select {
+			case s.seeders[i].announce.stop <- s.seeders[i].trackerAnnounce(s.port, trackingserver.STOPPED):
+			default:
+			}
+			for _, leecher := range s.seeders[i].connectedLeechers {
+				leecher.conn.Close()
+			}
+			s.seeders = append(s.seeders[:i], s.seeders[i+1:]...)
+			return
+		}
 	}
+}
 
-	// //debubg announce
-	// fmt.Println("InfoHash: ", announce.InfoHash)
-	// fmt.Println("PeerID: ", announce.PeerID)
-	// fmt.Println("IP: ", announce.IP)
-	// fmt.Println("Port: ", announce.Port)
-	// fmt.Println("Event: ", announce.Event)
-
-	var bencodedAnnounce bytes.Buffer
-	err := bencode.NewEncoder(&bencodedAnnounce).Encode(announce)
-	if err != nil {
-		return err
+// broadcastHave tells every leecher connected to us for a torrent that we have a new piece
+func (s *SeederStack) broadcastHave(infoHash []byte, pieceIndex uint32) {
+	s.mtx.Lock()
+	leechers := []*Leecher{}
+	for i := range s.seeders {
+		if bytes.Equal(s.seeders[i].infoHash, infoHash) {
+			leechers = append(leechers, s.seeders[i].connectedLeechers...)
+		}
 	}
+	s.mtx.Unlock()
 
-	response, err := http.Post(TrackerAddr, "application/x-bittorrent", &bencodedAnnounce)
-	if err != nil {
-		return err
+	for _, leecher := range leechers {
+		err := leecher.conn.send(newHaveMessage(pieceIndex))
+		if err != nil {
+			log.Println("Error sending have:", err)
+		}
 	}
-	defer response.Body.Close()
+}
 
-	// Read the response body to bytes
-	responseBytes, err := io.ReadAll(response.Body)
-	if err != nil {
-		return err
+// havePieces is the bitfield of the pieces this seeder can serve, everything unless the torrent is still downloading
+func (s *Seeder) havePieces() []byte {
+	if s.download != nil {
+		return s.download.havePieces()
 	}
 
-	// Decode the response
-	var decodedResponse map[string]interface{}
-	err = bencode.NewDecoder(bytes.NewReader(responseBytes)).Decode(&decodedResponse)
-	if err != nil {
-		return err
+	numPieces := s.info.NumPieces()
+	bitfield := make([]byte, (numPieces+7)/8)
+	for pieceIndex := 0; pieceIndex < numPieces; pieceIndex++ {
+		setPiece(bitfield, uint32(pieceIndex))
 	}
+	return bitfield
+}
 
-	fmt.Println("Decoded response:", decodedResponse)
+// readBlock reads a block we can serve, from the partial files if the torrent is still downloading
+func (s *Seeder) readBlock(pieceIndex uint32, begin int64, length int64) ([]byte, error) {
+	if s.download == nil {
+		return readBlock(s.filepath, &s.info, pieceIndex, begin, length)
+	}
 
-	return nil
+	if !s.download.hasPiece(pieceIndex) {
+		return nil, fmt.Errorf("we don't have piece %d", pieceIndex)
+	}
+	return s.download.storage.ReadBlock(pieceIndex, begin, length)
 }
 
 // In main, we should have a thread listening for new connections, that also has a SeederStack keeping track of all of the files that we are seeding
@@ -134,6 +207,9 @@ func (s *SeederStack) Listen(startPort int, maxRetries int) {
 
 	defer listener.Close()
 
+	// Decides which leechers we upload to
+	go s.runChoker()
+
 	fmt.Println("Listening on port", currentPort)
 
 	// Accept incoming connections
@@ -144,11 +220,9 @@ func (s *SeederStack) Listen(startPort int, maxRetries int) {
 			continue
 		}
 
-		leecher := Leecher{
-			nil,
-			nil,
-			nil,
-			tcpConn,
+		leecher := &Leecher{
+			conn: newPeerConn(tcpConn),
+			wake: make(chan struct{}, 1),
 		}
 
 		// Handle the connection
@@ -189,197 +263,282 @@ func UnmarshalHandshake(buf []byte) (*HandshakeMessage, error) {
 }
 
 // First, they exchange a handshake exchanging info_hash and peer_id
-func (s *SeederStack) handleConn(leecher Leecher) {
-	fmt.Println("Handling connection from", leecher.tcpConn.RemoteAddr())
+func (s *SeederStack) handleConn(leecher *Leecher) {
+	defer leecher.conn.Close()
+
+	fmt.Println("Handling connection from", leecher.conn.conn.RemoteAddr())
 	// Receive initial handshake
 	buf := make([]byte, 68)
-	leecher.tcpConn.Read(buf)
-	handshake := HandshakeMessage{
-		string(buf[:19]),
-		[20]byte{},
-		[20]byte{},
+	leecher.conn.conn.SetReadDeadline(time.Now().Add(PEER_TIMEOUT))
+	_, err := io.ReadFull(leecher.conn.conn, buf)
+	if err != nil {
+		log.Println("Error reading handshake:", err)
+		s.metrics.add(func(c *stackCounters) { c.incomingHandshakeFailures++ })
+		return
+	}
+	handshake, err := UnmarshalHandshake(buf)
+	if err != nil {
+		log.Println("Error unmarshalling handshake:", err)
+		s.metrics.add(func(c *stackCounters) { c.incomingHandshakeFailures++ })
+		return
 	}
-	copy(handshake.InfoHash[:], buf[28:48])
-	copy(handshake.PeerID[:], buf[48:68])
 
 	leecher.infoHash = handshake.InfoHash[:]
 	leecher.peerID = handshake.PeerID[:]
-	leecher.bitfield = make([]byte, 0)
 
 	// Find a seeder with the same info_hash
-	cseeder := Seeder{
-		nil,
-		nil,
-		nil,
-		nil,
-		"",
-	}
-
-	s.mtx.Lock()
-	for _, seeder := range s.seeders {
-		if bytes.Equal(seeder.infoHash, handshake.InfoHash[:]) {
-			// Add leecher to seeder's list of connected leechers
-			seeder.connectedLeechers = append(seeder.connectedLeechers, leecher)
-			cseeder = seeder
-			break
-		}
-	}
-	s.mtx.Unlock()
-
-	if cseeder.infoHash == nil {
+	cseeder, ok := s.addLeecher(handshake.InfoHash[:], leecher)
+	if !ok {
 		// No seeder found
 		log.Println("No seeder found for info_hash", handshake.InfoHash)
+		s.metrics.add(func(c *stackCounters) { c.incomingHandshakeFailures++ })
 		return
 	}
+	defer s.removeLeecher(cseeder.infoHash, leecher)
 
 	fmt.Println("Seeder found for info_hash", hex.EncodeToString(handshake.InfoHash[:]))
-
-
+	numPieces := cseeder.info.NumPieces()
 
 	// Send handshake response
 	handshakeResponse := HandshakeMessage{
 		"BitTorrent protocol",
 		handshake.InfoHash,
-		handshake.PeerID,
+		[20]byte{},
 	}
+	copy(handshakeResponse.PeerID[:], cseeder.peerID)
 	handshakeresponseBytes, err := handshakeResponse.Marshal()
 	if err != nil {
 		log.Println("Error marshalling handshake response:", err)
 		return
 	}
 	fmt.Println("Sending handshake response")
-	leecher.tcpConn.Write(handshakeresponseBytes)
+	leecher.conn.conn.Write(handshakeresponseBytes)
 	fmt.Println("Handshake response sent")
 
+	// Tell the leecher which pieces we have straight away, so it knows what it can ask for
+	err = leecher.conn.send(newBitfieldMessage(cseeder.havePieces()))
+	if err != nil {
+		log.Println("Error sending bitfield:", err)
+		return
+	}
+
+	// Requests are served from their own goroutine so that cancels can still reach the queue
+	done := make(chan struct{})
+	defer close(done)
+	go leecher.conn.keepAlive(done)
+	go cseeder.serveRequests(leecher, done)
+
 	// Now we handle the rest of the messages
-	var test = 0
 	for {
-		buf := make([]byte, 5)
-		leecher.tcpConn.Read(buf)
+		message, err := leecher.conn.readMessage()
+		if err != nil {
+			log.Println("Error reading message from leecher:", err)
+			return
+		}
 
-		length := uint32(buf[0])<<24 | uint32(buf[1])<<16 | uint32(buf[2])<<8 | uint32(buf[3])
-		buf2 := make([]byte, length)
-		leecher.tcpConn.Read(buf2)
+		// Keep-alives only exist to stop the connection from timing out
+		if message.Length == 0 {
+			continue
+		}
 
-		buf = append(buf, buf2...)
+		// Choke, unchoke, interested and not interested just update the connection's state
+		if leecher.conn.handleStateMessage(message) {
+			err = s.handleUploadMessage(cseeder.infoHash, leecher, message)
+			if err != nil {
+				log.Println("Error updating choke state:", err)
+				return
+			}
+			continue
+		}
 
-		// Unmarshal the message
-		message, err := UnmarshalMessage(buf)
+		// Have and bitfield messages tell us what the leecher already has
+		handled, err := leecher.conn.handleAvailability(message, numPieces)
 		if err != nil {
-			log.Println("Error unmarshalling message:", err)
+			log.Println("Invalid availability message:", err)
 			return
-		}	
-
-		if test < 5 {
-			fmt.Println("RECIEVED MESSAGE FROM LEECHER: ", message)
-			test++
+		}
+		if handled {
+			continue
 		}
 
-		// Here, we could stretch implement a switch statement to handle different types of messages that are in the actual protocol
-		// For now, we handle just one, the bitfield message
-		if message.ID == 5 {
-			// We don't handle this case in the end
-
-			// Handle bitfield message
-			// leecher.bitfield = buf[1:]
-			// cseeder.handleBitfield(leecher)
-		} else if message.ID == 6 {
-			// Handle request message
-			// The index is the first 4 bytes of the payload
-			pieceIndex := uint32(message.Payload[0])<<24 | uint32(message.Payload[1])<<16 | uint32(message.Payload[2])<<8 | uint32(message.Payload[3])
-
-			// cseeder.handleRequest(leecher, buf)
-			cseeder.sendPiece(pieceIndex, leecher)
+		switch message.ID {
+		case Request, Cancel:
+			err = s.handleUploadMessage(cseeder.infoHash, leecher, message)
+			if err != nil {
+				log.Println(err)
+				return
+			}
+		case Piece:
+			// We never request anything over incoming connections
+		default:
+			log.Println("Unknown message ID from leecher:", message.ID)
 		}
 	}
 }
 
-const (
-	Choke         int8 = 0
-	Unchoke       int8 = 1
-	Interested    int8 = 2
-	NotInterested int8 = 3
-	Bitfield      int8 = 5
-	Request       int8 = 6
-	Piece         int8 = 7
-)
+// addLeecher adds a leecher to the list of connected leechers of the seeder for infoHash, returning false if we
+// aren't serving the torrent
+func (s *SeederStack) addLeecher(infoHash []byte, leecher *Leecher) (Seeder, bool) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
 
-type Message struct {
-	Length  uint32
-	ID      int8
-	Payload []byte
+	for i := range s.seeders {
+		if bytes.Equal(s.seeders[i].infoHash, infoHash) {
+			s.seeders[i].connectedLeechers = append(s.seeders[i].connectedLeechers, leecher)
+			return s.seeders[i], true
+		}
+	}
+	return Seeder{}, false
 }
 
-func (m *Message) Marshal() ([]byte, error) {
-	// Marshal the message
-	buf := make([]byte, 5+len(m.Payload))
-	buf[0] = byte(m.Length >> 24)
-	buf[1] = byte(m.Length >> 16)
-	buf[2] = byte(m.Length >> 8)
-	buf[3] = byte(m.Length)
-	buf[4] = byte(m.ID)
-	copy(buf[5:], m.Payload)
-
-	return buf, nil
+// handleUploadMessage reacts to the messages a leecher sends about downloading from us, on connections in either
+// direction. Interested and not interested have already been applied by handleStateMessage, requests get queued
+// for the upload loop and cancels take them back off. Any other message is left alone.
+func (s *SeederStack) handleUploadMessage(infoHash []byte, leecher *Leecher, message *Message) error {
+	switch message.ID {
+	case Interested:
+		// The choker reranks everyone every CHOKE_INTERVAL, but a free slot can be used straight away
+		return s.unchokeIfSlotFree(infoHash, leecher)
+	case NotInterested:
+		return leecher.choke()
+	case Request:
+		// The payload is the piece index, the offset of the block within the piece and the length of the block
+		b, err := message.parseBlock()
+		if err != nil {
+			return fmt.Errorf("invalid request message: %v", err)
+		}
+		// Requests from choked leechers are ignored
+		if !leecher.conn.isChoking() {
+			leecher.queueRequest(b)
+		}
+	case Cancel:
+		b, err := message.parseBlock()
+		if err != nil {
+			return fmt.Errorf("invalid cancel message: %v", err)
+		}
+		leecher.cancelRequest(b)
+	}
+	return nil
 }
 
-func UnmarshalMessage(buf []byte) (*Message, error) {
-	// Unmarshal the message
-	m := Message{
-		uint32(buf[0])<<24 | uint32(buf[1])<<16 | uint32(buf[2])<<8 | uint32(buf[3]),
-		int8(buf[4]),
-		buf[5:],
-	}
+// removeLeecher drops a disconnected leecher from its seeder's list of connected leechers
+func (s *SeederStack) removeLeecher(infoHash []byte, leecher *Leecher) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
 
-	return &m, nil
+	for i := range s.seeders {
+		if !bytes.Equal(s.seeders[i].infoHash, infoHash) {
+			continue
+		}
+		leechers := s.seeders[i].connectedLeechers
+		for j, l := range leechers {
+			if l == leecher {
+				s.seeders[i].connectedLeechers = append(leechers[:j], leechers[j+1:]...)
+				return
+			}
+		}
+	}
 }
 
-// The seeder then responds by providing the pieces requested
-func (s *Seeder) sendPiece(pieceIndex uint32, leecher Leecher) {
-	// Open the file (we should keep open file and file descriptor in seeder struct)
-	file, err := os.Open(s.filepath)
-	// Seek to the correct position
-	offset := int64(pieceIndex * PIECE_SIZE)
-	if err != nil {
-		log.Println("Error opening file:", err)
+// queueRequest adds a request to the leecher's queue and wakes up the upload loop
+func (l *Leecher) queueRequest(b block) {
+	l.mtx.Lock()
+	if len(l.requests) >= MAX_QUEUED_REQUESTS {
+		l.mtx.Unlock()
+		log.Println("Dropping request, too many queued for leecher")
 		return
 	}
-	defer file.Close()
-	_, err = file.Seek(offset, 0)
-	if err != nil {
-		log.Println("Error seeking file:", err)
-		return
+	l.requests = append(l.requests, b)
+	l.mtx.Unlock()
+
+	select {
+	case l.wake <- struct{}{}:
+	default:
 	}
-	// Read the piece
-	buf := make([]byte, PIECE_SIZE)
-	n, err := file.Read(buf) // n is the actual number of bytes read
-	if err != nil && err != io.EOF {
-		log.Println("Error reading file:", err)
-		return
+}
+
+// cancelRequest removes a request from the queue if we haven't gotten to it yet
+func (l *Leecher) cancelRequest(b block) {
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+
+	for i, request := range l.requests {
+		if request == b {
+			l.requests = append(l.requests[:i], l.requests[i+1:]...)
+			return
+		}
 	}
-	buf = buf[:n] // Trim buf to the actual number of bytes read
+}
 
-	// We convert piece index to 4 bytes
-	pieceIndexBytes := uint32ToBytes(pieceIndex)
+// nextRequest takes the oldest request off of the queue
+func (l *Leecher) nextRequest() (block, bool) {
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
 
-	// Now set the message length correctly
-	message := Message{
-		Length:  uint32(n + 5), // 1 byte for the ID + 4 byte for the piece index + n bytes for the piece
-		ID:      7,
-		Payload: append(pieceIndexBytes, buf...),
+	if len(l.requests) == 0 {
+		return block{}, false
 	}
+	b := l.requests[0]
+	l.requests = l.requests[1:]
+	return b, true
+}
 
-	fmt.Println("Sending bytes: ", string(buf))
-	fmt.Println("Sending bytes: ", message)
+// choke chokes the leecher and throws away its pending requests, which choking implicitly cancels
+func (l *Leecher) choke() error {
+	l.mtx.Lock()
+	l.requests = nil
+	l.mtx.Unlock()
+
+	return l.conn.setChoking(true)
+}
 
-	// Marshal the message
-	msgBytes, err := message.Marshal()
+// serveRequests sends the blocks the leecher asked for, in order, until done is closed
+func (s *Seeder) serveRequests(leecher *Leecher, done <-chan struct{}) {
+	for {
+		select {
+		case <-done:
+			return
+		case <-leecher.wake:
+		}
+
+		for {
+			b, ok := leecher.nextRequest()
+			if !ok {
+				break
+			}
+
+			err := s.sendPiece(b.index, b.begin, b.length, leecher)
+			if err != nil {
+				log.Println("Error sending piece:", err)
+				leecher.conn.Close()
+				return
+			}
+		}
+	}
+}
+
+// The seeder then responds by providing the block of the piece requested
+func (s *Seeder) sendPiece(pieceIndex uint32, begin uint32, blockLength uint32, leecher *Leecher) error {
+	// Clients shouldn't ask for more than MAX_BLOCK_SIZE at once
+	if blockLength == 0 || blockLength > MAX_BLOCK_SIZE {
+		return fmt.Errorf("invalid block length requested: %d", blockLength)
+	}
+
+	// Read the block, which may cross file boundaries in multi-file torrents
+	buf, err := s.readBlock(pieceIndex, int64(begin), int64(blockLength))
 	if err != nil {
-		log.Println("Error marshalling piece message:", err)
-		return
+		return fmt.Errorf("error reading block: %v", err)
 	}
 
-	// Send the piece
-	fmt.Println("Sending piece", pieceIndex)
-	leecher.tcpConn.Write(msgBytes)
+	// Send the block
+	err = leecher.conn.send(newPieceMessage(pieceIndex, begin, buf))
+	if err != nil {
+		return err
+	}
+	s.announce.addUploaded(int64(len(buf)))
+	s.metrics.add(func(c *stackCounters) {
+		c.uploaded += int64(len(buf))
+		c.blocksSent++
+	})
+	return nil
 }
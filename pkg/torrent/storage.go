@@ -0,0 +1,165 @@
+package torrent
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// PART_SUFFIX is added to the name of every file that is still being downloaded
+const PART_SUFFIX = ".part"
+
+// pieceStorage is the disk-backed piece store of a download. Every file of the torrent is preallocated under
+// its final path plus PART_SUFFIX, pieces are written straight into place with WriteAt, and the files are
+// renamed to their final paths once the download completes.
+type pieceStorage struct {
+	mtx      sync.Mutex
+	root     string // Where the torrent ends up, the file itself or the directory for multi-file torrents
+	info     *TorrentInfo
+	entries  []fileEntry
+	files    map[string]*os.File // Open partial files, keyed by their final path
+	complete bool                // Set once the files have been moved to their final paths
+}
+
+// openStorage creates (or reopens) the partial files of a torrent under root and preallocates them to their full length
+func openStorage(root string, info *TorrentInfo) (*pieceStorage, error) {
+	entries, err := info.fileEntries(root)
+	if err != nil {
+		return nil, err
+	}
+
+	storage := &pieceStorage{
+		root:    root,
+		info:    info,
+		entries: entries,
+		files:   make(map[string]*os.File),
+	}
+
+	for _, entry := range entries {
+		err = os.MkdirAll(filepath.Dir(entry.path), 0755)
+		if err != nil {
+			storage.Close()
+			return nil, err
+		}
+
+		file, err := os.OpenFile(entry.path+PART_SUFFIX, os.O_RDWR|os.O_CREATE, 0644)
+		if err != nil {
+			storage.Close()
+			return nil, err
+		}
+		storage.files[entry.path] = file
+
+		// Preallocate the file so every piece can be written at its offset in any order
+		err = file.Truncate(entry.length)
+		if err != nil {
+			storage.Close()
+			return nil, err
+		}
+	}
+
+	return storage, nil
+}
+
+// WritePiece writes a verified piece into the files that it covers
+func (s *pieceStorage) WritePiece(pieceIndex uint32, data []byte) error {
+	_, pieceLength := s.info.pieceBounds(pieceIndex)
+	if int64(len(data)) != pieceLength {
+		return fmt.Errorf("piece %d has length %d, expected %d", pieceIndex, len(data), pieceLength)
+	}
+
+	spans, err := s.info.pieceSpans(s.root, pieceIndex)
+	if err != nil {
+		return err
+	}
+
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	for _, span := range spans {
+		file, ok := s.files[span.path]
+		if !ok {
+			return fmt.Errorf("storage for %s is closed", span.path)
+		}
+		_, err = file.WriteAt(data[span.pieceOffset:span.pieceOffset+span.length], span.fileOffset)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// ReadBlock reads length bytes of a piece, starting at begin, from the partial files
+func (s *pieceStorage) ReadBlock(pieceIndex uint32, begin int64, length int64) ([]byte, error) {
+	spans, err := s.info.blockSpans(s.root, pieceIndex, begin, length)
+	if err != nil {
+		return nil, err
+	}
+
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	// Finished downloads keep being seeded from the final files
+	if s.complete {
+		return readBlock(s.root, s.info, pieceIndex, begin, length)
+	}
+
+	buf := make([]byte, length)
+	for _, span := range spans {
+		file, ok := s.files[span.path]
+		if !ok {
+			return nil, fmt.Errorf("storage for %s is closed", span.path)
+		}
+		_, err = file.ReadAt(buf[span.pieceOffset:span.pieceOffset+span.length], span.fileOffset)
+		if err != nil && err != io.EOF {
+			return nil, err
+		}
+	}
+
+	return buf, nil
+}
+
+// Complete closes the partial files and moves them to their final paths. The lock is held the whole way through,
+// so a block being read for a leecher waits for the move and is then read from the final files.
+func (s *pieceStorage) Complete() error {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	err := s.closeFiles()
+	if err != nil {
+		return err
+	}
+
+	for _, entry := range s.entries {
+		err = os.Rename(entry.path+PART_SUFFIX, entry.path)
+		if err != nil {
+			return err
+		}
+	}
+
+	s.complete = true
+	return nil
+}
+
+// Close closes the partial files, leaving them on disk
+func (s *pieceStorage) Close() error {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	return s.closeFiles()
+}
+
+// closeFiles closes the partial files, the caller must hold s.mtx
+func (s *pieceStorage) closeFiles() error {
+	var firstErr error
+	for path, file := range s.files {
+		err := file.Close()
+		if err != nil && firstErr == nil {
+			firstErr = err
+		}
+		delete(s.files, path)
+	}
+
+	return firstErr
+}
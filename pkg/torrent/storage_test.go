@@ -0,0 +1,110 @@
+package torrent
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestPieceStorage(t *testing.T) {
+	root := filepath.Join(t.TempDir(), "dir")
+	files := []TorrentFile{
+		{Length: BLOCK_SIZE + 10, Path: []string{"a"}},
+		{Length: 3, Path: []string{"b"}},
+		{Length: 2 * BLOCK_SIZE, Path: []string{"sub", "c"}},
+	}
+	torrent, data := newTestTorrent(t, filepath.Join(t.TempDir(), "source"), files, 2*BLOCK_SIZE)
+	info := &torrent.Info
+
+	storage, err := openStorage(root, info)
+	if err != nil {
+		t.Fatalf("openStorage() error = %v", err)
+	}
+	defer storage.Close()
+
+	entries, err := info.fileEntries(root)
+	if err != nil {
+		t.Fatalf("fileEntries() error = %v", err)
+	}
+
+	// Every file is preallocated under its partial name, and nothing is at the final paths yet
+	for _, entry := range entries {
+		stat, err := os.Stat(entry.path + PART_SUFFIX)
+		if err != nil {
+			t.Fatalf("partial file missing: %v", err)
+		}
+		if stat.Size() != entry.length {
+			t.Errorf("%s is %d bytes, want %d", entry.path+PART_SUFFIX, stat.Size(), entry.length)
+		}
+		if _, err := os.Stat(entry.path); !os.IsNotExist(err) {
+			t.Errorf("%s exists before the download is complete, stat error = %v", entry.path, err)
+		}
+	}
+
+	err = storage.WritePiece(0, data[:10])
+	if err == nil {
+		t.Error("WritePiece() of a short piece succeeded, want an error")
+	}
+	for pieceIndex := uint32(0); pieceIndex < uint32(info.NumPieces()); pieceIndex++ {
+		start, pieceLength := info.pieceBounds(pieceIndex)
+		err = storage.WritePiece(pieceIndex, data[start:start+pieceLength])
+		if err != nil {
+			t.Fatalf("WritePiece(%d) error = %v", pieceIndex, err)
+		}
+	}
+
+	reads := []struct {
+		name       string
+		pieceIndex uint32
+		begin      int64
+		length     int64
+		wantErr    bool
+	}{
+		{name: "block inside a file", pieceIndex: 0, begin: 0, length: BLOCK_SIZE},
+		{name: "block across three files", pieceIndex: 0, begin: BLOCK_SIZE, length: BLOCK_SIZE},
+		{name: "short last piece", pieceIndex: 1, begin: 0, length: int64(len(data)) - 2*BLOCK_SIZE},
+		{name: "past the end of the last piece", pieceIndex: 1, begin: 0, length: 2 * BLOCK_SIZE, wantErr: true},
+		{name: "piece out of range", pieceIndex: 2, begin: 0, length: 1, wantErr: true},
+	}
+
+	// checkReads reads every block through the storage and compares it with the torrent's data
+	checkReads := func(t *testing.T) {
+		t.Helper()
+		for _, read := range reads {
+			got, err := storage.ReadBlock(read.pieceIndex, read.begin, read.length)
+			if (err != nil) != read.wantErr {
+				t.Errorf("%s: ReadBlock() error = %v, wantErr %v", read.name, err, read.wantErr)
+				continue
+			}
+			start, _ := info.pieceBounds(read.pieceIndex)
+			if !read.wantErr && !bytes.Equal(got, data[start+read.begin:start+read.begin+read.length]) {
+				t.Errorf("%s: ReadBlock() returned the wrong bytes", read.name)
+			}
+		}
+	}
+
+	t.Run("reads from the partial files", checkReads)
+
+	err = storage.Complete()
+	if err != nil {
+		t.Fatalf("Complete() error = %v", err)
+	}
+
+	// The partial files were renamed to their final paths
+	for _, entry := range entries {
+		if _, err := os.Stat(entry.path + PART_SUFFIX); !os.IsNotExist(err) {
+			t.Errorf("%s left behind after Complete(), stat error = %v", entry.path+PART_SUFFIX, err)
+		}
+	}
+	if !bytes.Equal(readTestDownload(t, root, info), data) {
+		t.Error("completed files don't match the written pieces")
+	}
+
+	t.Run("reads from the final files", checkReads)
+
+	err = storage.WritePiece(0, data[:2*BLOCK_SIZE])
+	if err == nil {
+		t.Error("WritePiece() after Complete() succeeded, want an error")
+	}
+}
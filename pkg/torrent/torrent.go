@@ -11,18 +11,53 @@ import (
 // type GenericTorrent map[string]interface{} // Handles optional fields when hashing
 
 type Torrent struct {
-	Announce string      `bencode:"announce"`
-	Info     TorrentInfo `bencode:"info"`
+	Announce     string      `bencode:"announce"`
+	AnnounceList [][]string  `bencode:"announce-list,omitempty"` // Tiers of trackers (BEP 12), clients that support it ignore Announce
+	Info         TorrentInfo `bencode:"info"`
+
+	// RawInfo is the info dictionary exactly as it was in the .torrent file. The info_hash is taken over these bytes,
+	// since re-encoding Info would drop any keys TorrentInfo doesn't have a field for.
+	RawInfo bencode.RawMessage `bencode:"-"`
 }
 
+// TorrentInfo is the info dictionary. Single-file torrents set Length, multi-file torrents set Files instead (BEP 3)
 type TorrentInfo struct {
-	Name        string `bencode:"name"`
-	Length      int64  `bencode:"length"`
-	PieceLength int    `bencode:"piece length"`
-	Pieces      []byte `bencode:"pieces"` // Use []byte for raw binary data
+	Name        string        `bencode:"name"`
+	Length      int64         `bencode:"length,omitempty"`
+	Files       []TorrentFile `bencode:"files,omitempty"`
+	PieceLength int           `bencode:"piece length"`
+	Pieces      []byte        `bencode:"pieces"`            // Use []byte for raw binary data
+	Private     int           `bencode:"private,omitempty"` // 1 if the torrent may only be shared through its own trackers (BEP 27)
+}
+
+// TorrentFile is a single entry in the files list of a multi-file torrent
+type TorrentFile struct {
+	Length int64    `bencode:"length"`
+	Path   []string `bencode:"path"` // Path segments relative to the torrent's directory, the last one is the file name
+}
+
+// Trackers returns the tiers of trackers to announce to, which is just Announce for torrents without an announce-list
+func (torrent *Torrent) Trackers() [][]string {
+	tiers := [][]string{}
+	for _, tier := range torrent.AnnounceList {
+		if len(tier) > 0 {
+			tiers = append(tiers, tier)
+		}
+	}
+	if len(tiers) == 0 && torrent.Announce != "" {
+		tiers = append(tiers, []string{torrent.Announce})
+	}
+	return tiers
 }
 
+// HashInfo returns the info_hash, the SHA-1 of the bencoded info dictionary. Torrents we create ourselves don't have
+// RawInfo, so their Info is encoded instead.
 func (torrent *Torrent) HashInfo() ([]byte, error) {
+	if len(torrent.RawInfo) > 0 {
+		hash := sha1.Sum(torrent.RawInfo)
+		return hash[:], nil
+	}
+
 	var buf bytes.Buffer
 	err := bencode.NewEncoder(&buf).Encode(torrent.Info)
 	if err != nil {
@@ -32,4 +67,27 @@ func (torrent *Torrent) HashInfo() ([]byte, error) {
 	hash := sha1.Sum(buf.Bytes())
 
 	return hash[:], nil
-}
\ No newline at end of file
+}
+
+// IsMultiFile reports whether the torrent uses the files list instead of a single length
+func (info *TorrentInfo) IsMultiFile() bool {
+	return len(info.Files) > 0
+}
+
+// TotalLength is the length of all of the torrent's data, summed across files for multi-file torrents
+func (info *TorrentInfo) TotalLength() int64 {
+	if !info.IsMultiFile() {
+		return info.Length
+	}
+
+	var total int64
+	for _, file := range info.Files {
+		total += file.Length
+	}
+	return total
+}
+
+// NumPieces is the number of pieces in the torrent, each piece hash is 20 bytes
+func (info *TorrentInfo) NumPieces() int {
+	return len(info.Pieces) / 20
+}
@@ -0,0 +1,327 @@
+package trackingserver
+
+import (
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+)
+
+// errBanned is the failure reason banned peers get back
+var errBanned = errors.New("banned from this tracker")
+
+// SwarmStats is the health of a single torrent, as the admin API shows it
+type SwarmStats struct {
+	InfoHash  string `json:"info_hash"` // Hex
+	Seeders   int    `json:"seeders"`
+	Leechers  int    `json:"leechers"`
+	Completed int    `json:"completed"`
+}
+
+// PeerInfo is a peer as the admin API shows it, with the binary peer_id as hex
+type PeerInfo struct {
+	PeerID       string    `json:"peer_id"`
+	IP           string    `json:"ip"`
+	Port         int       `json:"port"`
+	Seeder       bool      `json:"seeder"`
+	Uploaded     int64     `json:"uploaded"`
+	Downloaded   int64     `json:"downloaded"`
+	Left         int64     `json:"left"`
+	LastAnnounce time.Time `json:"last_announce"`
+}
+
+// TrackerStats are the totals over every torrent, leaving out peers that timed out
+type TrackerStats struct {
+	Torrents    int      `json:"torrents"`
+	Peers       int      `json:"peers"`
+	Seeders     int      `json:"seeders"`
+	Leechers    int      `json:"leechers"`
+	Completed   int      `json:"completed"`
+	BannedIPs   []string `json:"banned_ips"`
+	BannedPeers []string `json:"banned_peers"` // Hex peer_ids
+	Private     bool     `json:"private"`
+}
+
+// Ban is the body of a ban or unban, either field can be left out
+type Ban struct {
+	IP     string `json:"ip,omitempty"`
+	PeerID string `json:"peer_id,omitempty"` // Hex
+}
+
+// ListenAdmin serves the admin API on its own port, apart from the announce port so it can be kept off the internet.
+// Every request needs an "Authorization: Bearer <token>" header.
+//
+//	GET    /stats              totals over every torrent
+//	GET    /swarms             every torrent with its seeders and leechers
+//	GET    /swarms/<info_hash> the peers of a torrent
+//	DELETE /swarms/<info_hash> drops a torrent along with its peers and completed count
+//	GET    /bans               the banned IPs and peer_ids
+//	POST   /bans               bans an IP or peer_id, dropping its peers
+//	DELETE /bans               lifts a ban
+func (tracker *Tracker) ListenAdmin(port int, token string) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/stats", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
+			return
+		}
+		sendJSON(w, tracker.Stats())
+	})
+	mux.HandleFunc("/swarms", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
+			return
+		}
+		sendJSON(w, tracker.Swarms())
+	})
+	mux.HandleFunc("/swarms/", func(w http.ResponseWriter, r *http.Request) {
+		handleAdminSwarm(w, r, tracker)
+	})
+	mux.HandleFunc("/bans", func(w http.ResponseWriter, r *http.Request) {
+		handleAdminBans(w, r, tracker)
+	})
+
+	log.Print("\r\033[K", "Admin Server Started, Listening on ", port)
+	fmt.Print("> ")
+	log.Fatal(http.ListenAndServe(fmt.Sprintf(":%d", port), requireToken(token, mux)))
+}
+
+// requireToken turns away every request that doesn't carry the admin token
+func requireToken(token string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		given, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+
+		// Compare in constant time so the token can't be guessed a byte at a time
+		if !ok || subtle.ConstantTimeCompare([]byte(given), []byte(token)) != 1 {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// handleAdminSwarm shows or drops the torrent in /swarms/<info_hash>
+func handleAdminSwarm(w http.ResponseWriter, r *http.Request, tracker *Tracker) {
+	infoHash := strings.ToLower(strings.Trim(strings.TrimPrefix(r.URL.Path, "/swarms/"), "/"))
+	raw, err := hex.DecodeString(infoHash)
+	if err != nil || len(raw) != 20 {
+		http.Error(w, "info_hash must be 40 hex characters", http.StatusBadRequest)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		sendJSON(w, tracker.SwarmPeers(infoHash))
+	case http.MethodDelete:
+		removed := tracker.RemoveTorrent(infoHash)
+		fmt.Println("Admin removed torrent", infoHash, "with", removed, "peers")
+		sendJSON(w, map[string]int{"removed_peers": removed})
+	default:
+		http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
+	}
+}
+
+// handleAdminBans lists, adds or lifts bans
+func handleAdminBans(w http.ResponseWriter, r *http.Request, tracker *Tracker) {
+	if r.Method == http.MethodGet {
+		stats := tracker.Stats()
+		sendJSON(w, map[string][]string{"ips": stats.BannedIPs, "peer_ids": stats.BannedPeers})
+		return
+	}
+	if r.Method != http.MethodPost && r.Method != http.MethodDelete {
+		http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var ban Ban
+	err := json.NewDecoder(r.Body).Decode(&ban)
+	if err != nil {
+		http.Error(w, "Error decoding ban", http.StatusBadRequest)
+		return
+	}
+	peerID, err := hex.DecodeString(ban.PeerID)
+	if err != nil {
+		http.Error(w, "peer_id must be hex", http.StatusBadRequest)
+		return
+	}
+	if ban.IP == "" && len(peerID) == 0 {
+		http.Error(w, "Either ip or peer_id is needed", http.StatusBadRequest)
+		return
+	}
+
+	if r.Method == http.MethodDelete {
+		tracker.Unban(ban.IP, string(peerID))
+		fmt.Println("Admin lifted ban on", ban.IP, ban.PeerID)
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	removed := tracker.Ban(ban.IP, string(peerID))
+	fmt.Println("Admin banned", ban.IP, ban.PeerID, "dropping", removed, "peers")
+	sendJSON(w, map[string]int{"removed_peers": removed})
+}
+
+func sendJSON(w http.ResponseWriter, v any) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		http.Error(w, "Error encoding response", http.StatusInternalServerError)
+		log.Printf("Error marshalling admin response: %v", err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(data)
+}
+
+// Swarms returns every torrent with peers that haven't timed out, sorted by info_hash
+func (tracker *Tracker) Swarms() []SwarmStats {
+	swarms := []SwarmStats{}
+	for _, infoHash := range tracker.infoHashes() {
+		file := tracker.scrape(infoHash)
+		swarms = append(swarms, SwarmStats{
+			InfoHash:  infoHash,
+			Seeders:   file.Complete,
+			Leechers:  file.Incomplete,
+			Completed: file.Downloaded,
+		})
+	}
+	sort.Slice(swarms, func(i, j int) bool { return swarms[i].InfoHash < swarms[j].InfoHash })
+	return swarms
+}
+
+// SwarmPeers returns the peers of a hex info_hash that haven't timed out
+func (tracker *Tracker) SwarmPeers(infoHash string) []PeerInfo {
+	tracker.mtx.Lock()
+	defer tracker.mtx.Unlock()
+
+	peers := []PeerInfo{}
+	for _, peer := range tracker.peers[infoHash] {
+		if peer.expired() {
+			continue
+		}
+		peers = append(peers, PeerInfo{
+			PeerID:       hex.EncodeToString([]byte(peer.PeerID)),
+			IP:           peer.IP,
+			Port:         peer.Port,
+			Seeder:       peer.Seeder,
+			Uploaded:     peer.Uploaded,
+			Downloaded:   peer.Downloaded,
+			Left:         peer.Left,
+			LastAnnounce: peer.LastAnnounce,
+		})
+	}
+	sort.Slice(peers, func(i, j int) bool { return peers[i].PeerID < peers[j].PeerID })
+	return peers
+}
+
+// Stats returns the totals over every torrent
+func (tracker *Tracker) Stats() TrackerStats {
+	tracker.mtx.Lock()
+	defer tracker.mtx.Unlock()
+
+	stats := TrackerStats{BannedIPs: []string{}, BannedPeers: []string{}, Private: tracker.registry != nil}
+	for _, swarm := range tracker.peers {
+		live := false
+		for _, peer := range swarm {
+			if peer.expired() {
+				continue
+			}
+			live = true
+			if peer.Seeder {
+				stats.Seeders++
+			} else {
+				stats.Leechers++
+			}
+		}
+		if live {
+			stats.Torrents++
+		}
+	}
+	stats.Peers = stats.Seeders + stats.Leechers
+	for _, completed := range tracker.completed {
+		stats.Completed += completed
+	}
+	for ip := range tracker.bannedIPs {
+		stats.BannedIPs = append(stats.BannedIPs, ip)
+	}
+	for peerID := range tracker.bannedPeers {
+		stats.BannedPeers = append(stats.BannedPeers, hex.EncodeToString([]byte(peerID)))
+	}
+	sort.Strings(stats.BannedIPs)
+	sort.Strings(stats.BannedPeers)
+	return stats
+}
+
+// RemoveTorrent drops every peer of a hex info_hash and its completed count, returning how many peers it dropped.
+// A private tracker also stops tracking it, otherwise it comes back with the next announce.
+func (tracker *Tracker) RemoveTorrent(infoHash string) int {
+	tracker.mtx.Lock()
+	defer tracker.mtx.Unlock()
+
+	removed := 0
+	for peerID := range tracker.peers[infoHash] {
+		tracker.deletePeer(infoHash, peerID)
+		tracker.removePeer(infoHash, peerID)
+		removed++
+	}
+	if _, ok := tracker.completed[infoHash]; ok {
+		tracker.completed[infoHash] = 0
+		tracker.saveCompleted(infoHash)
+		delete(tracker.completed, infoHash)
+	}
+
+	if tracker.registry != nil {
+		err := tracker.registry.UnregisterTorrent(infoHash)
+		if err != nil {
+			log.Println("Error unregistering torrent:", err)
+		}
+	}
+	return removed
+}
+
+// Ban refuses every announce from an IP or peer_id from now on and drops their peers, returning how many it dropped.
+// Either can be empty. Bans only last until the tracker restarts.
+func (tracker *Tracker) Ban(ip string, peerID string) int {
+	tracker.mtx.Lock()
+	defer tracker.mtx.Unlock()
+
+	if ip != "" {
+		tracker.bannedIPs[ip] = true
+	}
+	if peerID != "" {
+		tracker.bannedPeers[peerID] = true
+	}
+
+	removed := 0
+	for infoHash, swarm := range tracker.peers {
+		for _, peer := range swarm {
+			if tracker.banned(peer.IP, peer.PeerID) {
+				tracker.deletePeer(infoHash, peer.PeerID)
+				tracker.removePeer(infoHash, peer.PeerID)
+				removed++
+			}
+		}
+	}
+	return removed
+}
+
+// Unban lifts the ban on an IP or peer_id, either can be empty
+func (tracker *Tracker) Unban(ip string, peerID string) {
+	tracker.mtx.Lock()
+	defer tracker.mtx.Unlock()
+
+	delete(tracker.bannedIPs, ip)
+	delete(tracker.bannedPeers, peerID)
+}
+
+// banned reports whether an IP or peer_id is banned, the caller must hold tracker.mtx
+func (tracker *Tracker) banned(ip string, peerID string) bool {
+	return tracker.bannedIPs[ip] || tracker.bannedPeers[peerID]
+}
@@ -0,0 +1,131 @@
+package trackingserver
+
+import (
+	"encoding/hex"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestRequireToken(t *testing.T) {
+	handler := requireToken("secret", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+
+	tests := []struct {
+		name          string
+		authorization string
+		want          int
+	}{
+		{name: "no header", authorization: "", want: http.StatusUnauthorized},
+		{name: "wrong token", authorization: "Bearer guess", want: http.StatusUnauthorized},
+		{name: "token prefix", authorization: "Bearer secre", want: http.StatusUnauthorized},
+		{name: "token without bearer", authorization: "secret", want: http.StatusUnauthorized},
+		{name: "basic auth", authorization: "Basic c2VjcmV0", want: http.StatusUnauthorized},
+		{name: "right token", authorization: "Bearer secret", want: http.StatusOK},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			r := httptest.NewRequest("GET", "/stats", nil)
+			if test.authorization != "" {
+				r.Header.Set("Authorization", test.authorization)
+			}
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, r)
+
+			if w.Code != test.want {
+				t.Errorf("status = %d, want %d", w.Code, test.want)
+			}
+			if w.Code == http.StatusUnauthorized && w.Header().Get("WWW-Authenticate") != "Bearer" {
+				t.Errorf("WWW-Authenticate = %q, want Bearer", w.Header().Get("WWW-Authenticate"))
+			}
+		})
+	}
+}
+
+func TestHandleAdminSwarm(t *testing.T) {
+	tests := []struct {
+		name        string
+		method      string
+		path        string
+		want        int
+		wantBody    string // Only checked if set
+		wantSeeders int    // Seeders left in the swarm afterwards
+	}{
+		{name: "peers", method: "GET", path: "/swarms/" + testInfoHash, want: http.StatusOK, wantBody: `"ip":"10.0.0.1"`, wantSeeders: 2},
+		{name: "upper case info_hash", method: "GET", path: "/swarms/" + strings.ToUpper(testInfoHash), want: http.StatusOK, wantBody: `"ip":"10.0.0.1"`, wantSeeders: 2},
+		{name: "unknown torrent", method: "GET", path: "/swarms/" + strings.Repeat("f", 40), want: http.StatusOK, wantBody: "[]", wantSeeders: 2},
+		{name: "remove", method: "DELETE", path: "/swarms/" + testInfoHash, want: http.StatusOK, wantBody: `{"removed_peers":2}`, wantSeeders: 0},
+		{name: "short info_hash", method: "GET", path: "/swarms/abcd", want: http.StatusBadRequest, wantSeeders: 2},
+		{name: "not hex", method: "GET", path: "/swarms/" + strings.Repeat("z", 40), want: http.StatusBadRequest, wantSeeders: 2},
+		{name: "wrong method", method: "POST", path: "/swarms/" + testInfoHash, want: http.StatusMethodNotAllowed, wantSeeders: 2},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			tracker := NewTracker()
+			addPeers(t, tracker, "seeder", 2, true)
+
+			r := httptest.NewRequest(test.method, test.path, nil)
+			w := httptest.NewRecorder()
+			handleAdminSwarm(w, r, tracker)
+
+			if w.Code != test.want {
+				t.Fatalf("status = %d, want %d", w.Code, test.want)
+			}
+			if test.wantBody != "" && !strings.Contains(w.Body.String(), test.wantBody) {
+				t.Errorf("body = %s, want it to contain %s", w.Body.String(), test.wantBody)
+			}
+			if seeders := tracker.Stats().Seeders; seeders != test.wantSeeders {
+				t.Errorf("tracker has %d seeders afterwards, want %d", seeders, test.wantSeeders)
+			}
+		})
+	}
+}
+
+func TestHandleAdminBans(t *testing.T) {
+	peerID := hex.EncodeToString([]byte("seeder-1"))
+
+	tests := []struct {
+		name       string
+		method     string
+		body       string
+		want       int
+		wantBanned bool // Whether seeder-1 on 10.0.0.2 is turned away afterwards
+		wantPeers  int  // Peers left in the swarm afterwards
+	}{
+		{name: "ban IP", method: "POST", body: `{"ip":"10.0.0.2"}`, want: http.StatusOK, wantBanned: true, wantPeers: 2},
+		{name: "ban peer_id", method: "POST", body: `{"peer_id":"` + peerID + `"}`, want: http.StatusOK, wantBanned: true, wantPeers: 2},
+		{name: "lift a ban that isn't there", method: "DELETE", body: `{"ip":"10.0.0.2"}`, want: http.StatusNoContent, wantPeers: 3},
+		{name: "empty ban", method: "POST", body: `{}`, want: http.StatusBadRequest, wantPeers: 3},
+		{name: "peer_id not hex", method: "POST", body: `{"peer_id":"zz"}`, want: http.StatusBadRequest, wantPeers: 3},
+		{name: "not JSON", method: "POST", body: `ip=10.0.0.2`, want: http.StatusBadRequest, wantPeers: 3},
+		{name: "list", method: "GET", want: http.StatusOK, wantPeers: 3},
+		{name: "wrong method", method: "PUT", body: `{"ip":"10.0.0.2"}`, want: http.StatusMethodNotAllowed, wantPeers: 3},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			tracker := NewTracker()
+			addPeers(t, tracker, "seeder", 3, true)
+
+			r := httptest.NewRequest(test.method, "/bans", strings.NewReader(test.body))
+			w := httptest.NewRecorder()
+			handleAdminBans(w, r, tracker)
+
+			if w.Code != test.want {
+				t.Fatalf("status = %d, want %d", w.Code, test.want)
+			}
+			if peers := tracker.Stats().Peers; peers != test.wantPeers {
+				t.Errorf("tracker has %d peers afterwards, want %d", peers, test.wantPeers)
+			}
+
+			_, err := tracker.announce(&Announce{InfoHash: testInfoHash, PeerID: "seeder-1", IP: "10.0.0.2", Port: 6881, Event: NONE, Left: 0})
+			if (err == errBanned) != test.wantBanned {
+				t.Errorf("announce() error = %v, wantBanned %v", err, test.wantBanned)
+			}
+		})
+	}
+}
@@ -4,17 +4,33 @@ import (
 	"encoding/hex"
 	"fmt"
 	"log"
+	"math/rand"
+	"net"
 	"net/http"
-	"net/url"
-	"strings"
+	"strconv"
 	"sync"
 	"time"
 
+	"bittorrent/pkg/metrics"
+
 	"github.com/zeebo/bencode"
 )
 
 const TIMEOUT = 2 * time.Minute
 
+// ANNOUNCE_INTERVAL is how often clients are asked to announce, well within TIMEOUT so they don't get dropped,
+// and MIN_ANNOUNCE_INTERVAL is the most often they should announce even when they want more peers
+const (
+	ANNOUNCE_INTERVAL     = 1 * time.Minute
+	MIN_ANNOUNCE_INTERVAL = 30 * time.Second
+)
+
+// Clients that don't send numwant get DEFAULT_NUMWANT peers, and nobody gets more than MAX_NUMWANT
+const (
+	DEFAULT_NUMWANT = 50
+	MAX_NUMWANT     = 200
+)
+
 // Announce is the message sent by the client to the tracking server to announce its presence.
 // InfoHash and PeerID MUST be sent as bytes by the client to be able to be correctly decoded by the server.
 // After decoding, the server will convert the bytes to string and create an Announce struct.
@@ -26,22 +42,37 @@ type AnnounceRequest struct {
 	Event    int    `bencode:"event"`     // The event of the announce message
 }
 type Announce struct {
-	InfoHash string `bencode:"info_hash"` // The info_hash of the file the client is downloading
-	PeerID   string `bencode:"peer_id"`   // The peer_id of the client
-	IP       string `bencode:"ip"`        // The IP address of the client
-	Port     int    `bencode:"port"`      // The port the client is listening on
-	Event    int    `bencode:"event"`     // The event of the announce message
+	InfoHash   string `bencode:"info_hash"`  // The info_hash of the file the client is downloading
+	PeerID     string `bencode:"peer_id"`    // The peer_id of the client
+	IP         string `bencode:"ip"`         // The IP address of the client
+	Port       int    `bencode:"port"`       // The port the client is listening on
+	Event      int    `bencode:"event"`      // The event of the announce message
+	Uploaded   int64  `bencode:"uploaded"`   // Bytes the client has uploaded since it started
+	Downloaded int64  `bencode:"downloaded"` // Bytes the client has downloaded since it started
+	Left       int64  `bencode:"left"`       // Bytes the client still needs, -1 if it didn't say
+	NumWant    int    `bencode:"numwant"`    // How many peers the client would like
+	Passkey    string `bencode:"passkey"`    // The passkey from the announce URL, only used by private trackers
 }
 
+// NONE is a regular announce made on the interval, which HTTP clients send as an empty or missing event
 const (
 	STARTED   = 0
 	STOPPED   = 1
 	COMPLETED = 2
+	NONE      = 3
 )
 
 // AnnounceResponse is the message sent by the tracking server to the client in response to an Announce message.
+// Use NewAnnounceResponse to build one and DecodePeers to read the peers back out.
+// Failed announces only have FailureReason set.
 type AnnounceResponse struct {
-	Peers []Peer `bencode:"peers"` // A list of peers that have the file the client is downloading
+	FailureReason string             `bencode:"failure reason,omitempty"` // Why the announce was rejected
+	Interval      int                `bencode:"interval,omitempty"`       // Seconds the client should wait between announces
+	MinInterval   int                `bencode:"min interval,omitempty"`   // Seconds the client must wait between announces
+	Complete      int                `bencode:"complete"`                 // How many seeders the torrent has
+	Incomplete    int                `bencode:"incomplete"`               // How many leechers the torrent has
+	Peers         bencode.RawMessage `bencode:"peers,omitempty"`          // A list of PeerDicts, or 6 bytes for every IPv4 peer when compact (BEP 23)
+	Peers6        []byte             `bencode:"peers6,omitempty"`         // 18 bytes for every IPv6 peer, only sent when compact
 }
 
 // Peer is a struct that represents a peer that has the file the client is downloading.
@@ -51,26 +82,140 @@ type Peer struct {
 	IP           string    `bencode:"ip"`            // The IP address of the peer
 	Port         int       `bencode:"port"`          // The port the peer is listening on
 	LastAnnounce time.Time `bencode:"last_announce"` // The time of the last announce message from the peer
+	Uploaded     int64     `bencode:"uploaded"`      // What the peer said it had uploaded in its last announce
+	Downloaded   int64     `bencode:"downloaded"`    // What the peer said it had downloaded in its last announce
+	Left         int64     `bencode:"left"`          // What the peer said it still needed in its last announce
 }
 
-// Tracker is a struct that represents a tracking server, keeping a map of info_hashes to a list of peers.
+// Tracker is a struct that represents a tracking server, keeping the peers of every info_hash keyed by peer_id.
+// Peers that stop announcing are dropped by a reaper that runs every REAP_INTERVAL.
 type Tracker struct {
-	mtx   sync.Mutex        // A mutex to protect the peers map
-	peers map[string][]Peer // A map of info_hashes to a list of peers
+	mtx       sync.Mutex                 // A mutex to protect the peers map
+	peers     map[string]map[string]Peer // A map of info_hashes to the peers, keyed by peer_id
+	completed map[string]int             // How many times each info_hash has been downloaded, reported by scrapes
+	store     PeerStore                  // Where the peers are saved so they survive a restart, nil to only keep them in memory
+	registry  *Registry                  // The users and torrents of a private tracker, nil for a public tracker
+
+	bannedIPs   map[string]bool // IPs the admin API banned, their announces are refused
+	bannedPeers map[string]bool // peer_ids the admin API banned
+	metrics     trackerMetrics  // Served on /metrics
 }
 
-// NewTracker is a function that creates a new tracking server.
+// NewTracker is a function that creates a new tracking server and starts its reaper.
 func NewTracker() *Tracker {
-	return &Tracker{
-		peers: make(map[string][]Peer),
+	// Without a store there is nothing to load, so this can't fail
+	tracker, _ := newTracker(nil)
+	return tracker
+}
+
+// NewTrackerWithStore creates a tracking server that picks up the swarms saved in store and saves every change to them.
+// Peers that timed out while the tracker was down are dropped.
+func NewTrackerWithStore(store PeerStore) (*Tracker, error) {
+	return newTracker(store)
+}
+
+// newTracker creates a tracking server, loading the swarms saved in store if there is one, and only starts the reaper
+// once everything is loaded so it never sees a half built tracker
+func newTracker(store PeerStore) (*Tracker, error) {
+	tracker := &Tracker{
+		peers:       make(map[string]map[string]Peer),
+		completed:   make(map[string]int),
+		store:       store,
+		bannedIPs:   make(map[string]bool),
+		bannedPeers: make(map[string]bool),
+		metrics:     newTrackerMetrics(),
+	}
+
+	if store != nil {
+		peers, completed, err := store.Load()
+		if err != nil {
+			return nil, fmt.Errorf("error loading tracker state: %v", err)
+		}
+		tracker.completed = completed
+
+		tracker.mtx.Lock()
+		for infoHash, swarm := range peers {
+			for _, peer := range swarm {
+				if peer.expired() {
+					tracker.removePeer(infoHash, peer.PeerID)
+					continue
+				}
+				tracker.setPeer(infoHash, peer)
+			}
+		}
+		tracker.mtx.Unlock()
+	}
+
+	go tracker.runReaper()
+	return tracker, nil
+}
+
+// savePeer saves a new or updated peer to the store, the caller must hold tracker.mtx
+func (tracker *Tracker) savePeer(infoHash string, peer Peer) {
+	if tracker.store == nil {
+		return
+	}
+	err := tracker.store.SavePeer(infoHash, peer)
+	if err != nil {
+		log.Println("Error saving peer:", err)
+	}
+}
+
+// removePeer removes a peer from the store, the caller must hold tracker.mtx
+func (tracker *Tracker) removePeer(infoHash string, peerID string) {
+	if tracker.store == nil {
+		return
+	}
+	err := tracker.store.RemovePeer(infoHash, peerID)
+	if err != nil {
+		log.Println("Error removing peer:", err)
 	}
 }
 
+// saveCompleted saves the completed count of an info_hash to the store, the caller must hold tracker.mtx
+func (tracker *Tracker) saveCompleted(infoHash string) {
+	if tracker.store == nil {
+		return
+	}
+	err := tracker.store.SaveCompleted(infoHash, tracker.completed[infoHash])
+	if err != nil {
+		log.Println("Error saving completed count:", err)
+	}
+}
+
+// GetPeers returns a copy of the peers of every info_hash
 func (tracker *Tracker) GetPeers() map[string][]Peer {
 	tracker.mtx.Lock()
 	defer tracker.mtx.Unlock()
 
-	return tracker.peers
+	peers := make(map[string][]Peer)
+	for infoHash, swarm := range tracker.peers {
+		for _, peer := range swarm {
+			peers[infoHash] = append(peers[infoHash], peer)
+		}
+	}
+	return peers
+}
+
+// setPeer adds a peer or replaces the one with the same peer_id, the caller must hold tracker.mtx
+func (tracker *Tracker) setPeer(infoHash string, peer Peer) {
+	if tracker.peers[infoHash] == nil {
+		tracker.peers[infoHash] = make(map[string]Peer)
+	}
+	tracker.peers[infoHash][peer.PeerID] = peer
+}
+
+// deletePeer drops a peer and its swarm if it was the last one, the caller must hold tracker.mtx
+func (tracker *Tracker) deletePeer(infoHash string, peerID string) {
+	delete(tracker.peers[infoHash], peerID)
+	if len(tracker.peers[infoHash]) == 0 {
+		delete(tracker.peers, infoHash)
+	}
+}
+
+// expired reports whether the peer has gone longer than TIMEOUT without announcing
+func (peer *Peer) expired() bool {
+	return peer.LastAnnounce.Before(time.Now().Add(-TIMEOUT))
 }
 
 // / Listen is a function that listens for Announce messages from clients.
@@ -86,6 +231,31 @@ func (tracker *Tracker) Listen() {
 			http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
 		}
 	})
+	http.HandleFunc("/scrape", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
+			return
+		}
+		handleScrapeGET(w, r, tracker)
+	})
+
+	http.Handle("/metrics", metrics.Handler(tracker.writeMetrics))
+
+	// Private trackers take the passkey as the last part of the path, /announce/<passkey> and /scrape/<passkey>
+	http.HandleFunc("/announce/", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
+			return
+		}
+		handleAnnounceGET(w, r, tracker)
+	})
+	http.HandleFunc("/scrape/", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
+			return
+		}
+		handleScrapeGET(w, r, tracker)
+	})
 
 	// Clears the current line
 	log.Print("\r\033[K", "Server Started, Listening on ", port)
@@ -97,6 +267,10 @@ func (tracker *Tracker) Listen() {
 // Used when seeder wants to register itself with the tracker.
 func handleAnnouncePOST(w http.ResponseWriter, r *http.Request, tracker *Tracker) {
 	fmt.Println("Received POST request from", r.RemoteAddr)
+	if tracker.isPrivate() {
+		http.Error(w, "Private tracker, announce with your passkey", http.StatusForbidden)
+		return
+	}
 	// Parse the bencoded request body
 	var announceRequest AnnounceRequest
 	err := bencode.NewDecoder(r.Body).Decode(&announceRequest)
@@ -121,14 +295,16 @@ func handleAnnouncePOST(w http.ResponseWriter, r *http.Request, tracker *Tracker
 	}
 
 	// Add the seeder to the tracker's list
-	tracker.mtx.Lock()
-	tracker.peers[announce.InfoHash] = append(tracker.peers[announce.InfoHash], Peer{
+	peer := Peer{
 		PeerID:       announce.PeerID,
 		Seeder:       true,
 		IP:           announce.IP,
 		Port:         announce.Port,
 		LastAnnounce: time.Now(),
-	})
+	}
+	tracker.mtx.Lock()
+	tracker.setPeer(announce.InfoHash, peer)
+	tracker.savePeer(announce.InfoHash, peer)
 	tracker.mtx.Unlock()
 
 	// encode response first for error handling
@@ -147,133 +323,247 @@ func handleAnnouncePOST(w http.ResponseWriter, r *http.Request, tracker *Tracker
 	w.Write(encodedResponse)
 }
 
-// handleAnnounceGET handles GET requests to the /announce endpoint.
+// handleAnnounceGET handles GET requests to the /announce endpoint, which use the standard announce parameters (BEP 3)
 func handleAnnounceGET(w http.ResponseWriter, r *http.Request, tracker *Tracker) {
 	// Parse query parameters
-	infoHash := r.URL.Query().Get("info_hash")
-	peerID := r.URL.Query().Get("peer_id")
-	ip := strings.Split(r.RemoteAddr, ":")[0]
-	port := r.URL.Query().Get("port")
-	event := r.URL.Query().Get("event")
+	query := r.URL.Query()
+	infoHash := query.Get("info_hash")
+	peerID := query.Get("peer_id")
+	ip, _, err := net.SplitHostPort(r.RemoteAddr) // Also works for IPv6 addresses
+	if err != nil {
+		sendFailure(w, "invalid remote address")
+		return
+	}
+	port := query.Get("port")
+	compact := query.Get("compact") == "1"
 
 	// Validate required fields
 	if infoHash == "" || peerID == "" || port == "" {
-		http.Error(w, "Missing required parameters", http.StatusBadRequest)
+		sendFailure(w, "missing required parameters")
 		return
 	}
 
 	// Convert port to integer
-	portInt := 0
-	_, err := fmt.Sscanf(port, "%d", &portInt)
-	if err != nil {
-		http.Error(w, "Invalid port number", http.StatusBadRequest)
+	portInt, err := strconv.Atoi(port)
+	if err != nil || portInt <= 0 || portInt > 65535 {
+		sendFailure(w, "invalid port")
 		return
 	}
 
-	// Convert event to integer (optional)
-	eventInt := STARTED
-	if event != "" {
-		_, err := fmt.Sscanf(event, "%d", &eventInt)
-		if err != nil {
-			http.Error(w, "Invalid event", http.StatusBadRequest)
+	// An empty or missing event is a regular announce
+	eventInt := NONE
+	switch query.Get("event") {
+	case "started":
+		eventInt = STARTED
+	case "stopped":
+		eventInt = STOPPED
+	case "completed":
+		eventInt = COMPLETED
+	case "", "empty":
+	default:
+		sendFailure(w, "invalid event")
+		return
+	}
+
+	// The counters should always be sent, but don't turn away clients that leave them out
+	uploaded, err1 := parseCounter(query.Get("uploaded"), 0)
+	downloaded, err2 := parseCounter(query.Get("downloaded"), 0)
+	left, err3 := parseCounter(query.Get("left"), -1)
+	if err1 != nil || err2 != nil || err3 != nil {
+		sendFailure(w, "invalid uploaded, downloaded or left")
+		return
+	}
+
+	numWant := DEFAULT_NUMWANT
+	if query.Get("numwant") != "" {
+		numWant, err = strconv.Atoi(query.Get("numwant"))
+		if err != nil || numWant < 0 {
+			sendFailure(w, "invalid numwant")
 			return
 		}
 	}
 
-	// InfoHash is hex encoded, so decode it	
-	infoHashUrlDecoded, err := url.QueryUnescape(infoHash)
-	if err != nil {
-		http.Error(w, "Invalid info_hash", http.StatusBadRequest)
+	// info_hash is the raw 20 bytes, which Query has already URL decoded
+	if len(infoHash) != 20 {
+		sendFailure(w, "info_hash must be 20 bytes")
 		return
 	}
 
-	infoHashBytes := []byte(infoHashUrlDecoded)
-
 	// Encode the info_hash bytes to hex
-	infoHashHex := hex.EncodeToString(infoHashBytes)
+	infoHashHex := hex.EncodeToString([]byte(infoHash))
 
 	fmt.Println("Received Announce Message for InfoHash:", infoHashHex)
 
 	// Create the Announce struct
 	announce := Announce{
-		InfoHash: infoHashHex,
-		PeerID:   peerID,
-		IP:       ip,
-		Port:     portInt,
-		Event:    eventInt,
+		InfoHash:   infoHashHex,
+		PeerID:     peerID,
+		IP:         ip,
+		Port:       portInt,
+		Event:      eventInt,
+		Uploaded:   uploaded,
+		Downloaded: downloaded,
+		Left:       left,
+		NumWant:    min(numWant, MAX_NUMWANT),
+		Passkey:    passkeyFromPath(r.URL.Path),
 	}
 
 	// Handle the Announce message
-	handleAnnounce(w, tracker, &announce)
+	handleAnnounce(w, tracker, &announce, compact)
+}
+
+// parseCounter reads one of the byte counters of an announce, which can't be negative
+func parseCounter(value string, missing int64) (int64, error) {
+	if value == "" {
+		return missing, nil
+	}
+	counter, err := strconv.ParseInt(value, 10, 64)
+	if err != nil || counter < 0 {
+		return 0, fmt.Errorf("invalid counter %q", value)
+	}
+	return counter, nil
 }
 
 // handleAnnounce is a function that handles an Announce message from a client.
-func handleAnnounce(w http.ResponseWriter, tracker *Tracker, announce *Announce) {
+func handleAnnounce(w http.ResponseWriter, tracker *Tracker, announce *Announce, compact bool) {
+	peers, err := tracker.announce(announce)
+	if err != nil {
+		sendFailure(w, err.Error())
+		return
+	}
+
+	// Send the list of peers to the client
+	announceResponse, err := NewAnnounceResponse(peers, compact)
+	if err != nil {
+		http.Error(w, "Error encoding peers", http.StatusInternalServerError)
+		log.Printf("Error encoding peers: %v", err)
+		return
+	}
+	announceResponse.Interval = int(ANNOUNCE_INTERVAL.Seconds())
+	announceResponse.MinInterval = int(MIN_ANNOUNCE_INTERVAL.Seconds())
+	announceResponse.Complete, announceResponse.Incomplete = tracker.counts(announce.InfoHash)
+	sendAnnounceResponse(w, announceResponse)
+}
+
+// announce applies an Announce message to the peer store and returns a random sample of up to NumWant peers the
+// client should connect to, seeders and leechers alike. Seeders only get leechers, since they have nothing to gain
+// from each other. It is shared by the HTTP and UDP endpoints.
+func (tracker *Tracker) announce(announce *Announce) ([]Peer, error) {
 	// Get the list of peers for the info_hash
 	tracker.mtx.Lock()
 	defer tracker.mtx.Unlock()
 
 	fmt.Println("Received Announce Message for InfoHash:", announce.InfoHash)
+	fmt.Print("Received Announce Message from ", announce.IP, ":", announce.Port, "\n")
+
+	tracker.metrics.announces[announce.Event]++
+	err := tracker.checkPrivate(announce.Passkey, announce.InfoHash)
+	if err != nil {
+		tracker.metrics.rejected++
+		return nil, err
+	}
+	if tracker.banned(announce.IP, announce.PeerID) {
+		tracker.metrics.rejected++
+		return nil, errBanned
+	}
 
-	peers := tracker.peers[announce.InfoHash]
-	fmt.Println("Peers:", peers)
-	seeders := []Peer{}
+	existing, known := tracker.peers[announce.InfoHash][announce.PeerID]
 
-	fmt.Print("Received Announce Message from ", announce.IP, ":", announce.Port, "\n")
+	// Private trackers add what the peer transferred since its last announce to its user's totals
+	if tracker.registry != nil {
+		tracker.registry.report(announce.Passkey, announce.InfoHash, announce.PeerID,
+			announce.Uploaded, announce.Downloaded, announce.Event == STOPPED)
+	}
 
-	switch announce.Event {
-	case STARTED:
-		// Add the peer to the list of peers
-		peers = append(peers, Peer{announce.PeerID, false, announce.IP, announce.Port, time.Now()}) // This allows repeats but doesn't matter
-		// Return a list of all of the seeders
-		for i, peer := range peers {
-			if peer.LastAnnounce.Before(time.Now().Add(-TIMEOUT)) {
-				// Remove the peer from the list of peers
-				peers = append(peers[:i], peers[i+1:]...)
-				continue
-			}
-			if peer.Seeder {
-				seeders = append(seeders, peer)
-			}
+	// Only count a download once, even if the peer announces completed again
+	if announce.Event == COMPLETED && (!known || !existing.Seeder) {
+		tracker.completed[announce.InfoHash]++
+		tracker.saveCompleted(announce.InfoHash)
+	}
+
+	if announce.Event == STOPPED {
+		if known {
+			tracker.deletePeer(announce.InfoHash, announce.PeerID)
+			tracker.removePeer(announce.InfoHash, announce.PeerID)
 		}
-	case STOPPED:
-		// Remove the peer from the list of peers
-		for i, peer := range peers {
-			if peer.LastAnnounce.Before(time.Now().Add(-TIMEOUT)) {
-				// Remove the peer from the list of peers
-				peers = append(peers[:i], peers[i+1:]...)
-				continue
-			}
-			if peer.PeerID == announce.PeerID {
-				peers = append(peers[:i], peers[i+1:]...)
-				break
-			}
+		// A peer that is leaving doesn't need anyone to connect to
+		return []Peer{}, nil
+	}
+
+	// Started, completed and regular announces all refresh the peer, adding it if we haven't seen it before
+	peer := Peer{PeerID: announce.PeerID}
+	if known {
+		peer = existing
+	}
+	peer.IP = announce.IP
+	peer.Port = announce.Port
+	peer.LastAnnounce = time.Now()
+	peer.Uploaded = announce.Uploaded
+	peer.Downloaded = announce.Downloaded
+	peer.Left = announce.Left
+
+	// A peer with nothing left is a seeder, peers that don't say keep what they were unless they just completed
+	if announce.Left >= 0 {
+		peer.Seeder = announce.Left == 0
+	} else if announce.Event == COMPLETED {
+		peer.Seeder = true
+	}
+	tracker.setPeer(announce.InfoHash, peer)
+	tracker.savePeer(announce.InfoHash, peer)
+	requesterSeeder := peer.Seeder
+
+	// Everyone but the requester, leaving out the ones that timed out that the reaper hasn't gotten to yet
+	candidates := []Peer{}
+	for _, peer := range tracker.peers[announce.InfoHash] {
+		if peer.PeerID == announce.PeerID || peer.expired() {
+			continue
 		}
-		// Return a list of all of the seeders
-		for i, peer := range peers {
-			if peer.LastAnnounce.Before(time.Now().Add(-TIMEOUT)) {
-				// Remove the peer from the list of peers
-				peers = append(peers[:i], peers[i+1:]...)
-				continue
-			}
-			if peer.Seeder {
-				seeders = append(seeders, peer)
-			}
+		if requesterSeeder && peer.Seeder {
+			continue
 		}
-	case COMPLETED:
-		// Mark the peer as a seeder
-		for i, peer := range peers {
-			if peer.PeerID == announce.PeerID {
-				peers[i].Seeder = true
-				break
-			}
+		candidates = append(candidates, peer)
+	}
+
+	// Partially shuffle so the first NumWant are a random sample, which spreads the load over the swarm
+	numWant := min(announce.NumWant, len(candidates))
+	for i := 0; i < numWant; i++ {
+		j := i + rand.Intn(len(candidates)-i)
+		candidates[i], candidates[j] = candidates[j], candidates[i]
+	}
+	return candidates[:numWant], nil
+}
+
+// counts returns how many seeders and leechers the tracker has for an info_hash, leaving out peers that timed out
+func (tracker *Tracker) counts(infoHash string) (int, int) {
+	tracker.mtx.Lock()
+	defer tracker.mtx.Unlock()
+
+	seeders, leechers := 0, 0
+	for _, peer := range tracker.peers[infoHash] {
+		if peer.expired() {
+			continue
+		}
+		if peer.Seeder {
+			seeders++
+		} else {
+			leechers++
 		}
 	}
-	tracker.peers[announce.InfoHash] = peers
+	return seeders, leechers
+}
+
+// sendFailure rejects an announce with a failure reason, which clients show to the user
+func sendFailure(w http.ResponseWriter, reason string) {
+	data, err := bencode.EncodeBytes(map[string]string{"failure reason": reason})
+	if err != nil {
+		http.Error(w, "Error encoding response", http.StatusInternalServerError)
+		return
+	}
 
-	// Send the list of seeders to the client
-	announceResponse := AnnounceResponse{seeders}
-	sendAnnounceResponse(w, &announceResponse)
+	// Failures still go out as 200 OK, since clients only read the body
+	w.Header().Set("Content-Type", "application/x-bittorrent")
+	w.WriteHeader(http.StatusOK)
+	w.Write(data)
 }
 
 func sendAnnounceResponse(w http.ResponseWriter, announceResponse *AnnounceResponse) {
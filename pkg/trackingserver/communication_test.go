@@ -0,0 +1,223 @@
+package trackingserver
+
+import (
+	"bytes"
+	"encoding/hex"
+	"fmt"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/zeebo/bencode"
+)
+
+const testInfoHash = "0123456789abcdef0123456789abcdef01234567"
+
+// addPeers announces count peers to the tracker, seeders if seeder is set and leechers otherwise
+func addPeers(t *testing.T, tracker *Tracker, prefix string, count int, seeder bool) {
+	t.Helper()
+
+	left := int64(100)
+	if seeder {
+		left = 0
+	}
+	for i := 0; i < count; i++ {
+		_, err := tracker.announce(&Announce{
+			InfoHash: testInfoHash,
+			PeerID:   fmt.Sprintf("%s-%d", prefix, i),
+			IP:       fmt.Sprintf("10.0.%d.%d", i/250, i%250+1),
+			Port:     6881,
+			Event:    STARTED,
+			Left:     left,
+		})
+		if err != nil {
+			t.Fatalf("announce() error = %v", err)
+		}
+	}
+}
+
+// announceGET sends an HTTP announce with the given query on top of the required parameters and decodes the response
+func announceGET(t *testing.T, tracker *Tracker, extra url.Values) AnnounceResponse {
+	t.Helper()
+
+	infoHash, _ := hex.DecodeString(testInfoHash)
+	query := url.Values{
+		"info_hash": {string(infoHash)},
+		"peer_id":   {"-TEST-requester-0001"},
+		"port":      {"6881"},
+		"left":      {"100"},
+		"compact":   {"1"},
+	}
+	for key, values := range extra {
+		query[key] = values
+	}
+
+	r := httptest.NewRequest("GET", "/announce?"+query.Encode(), nil)
+	r.RemoteAddr = "192.0.2.1:50000"
+	w := httptest.NewRecorder()
+	handleAnnounceGET(w, r, tracker)
+
+	var response AnnounceResponse
+	err := bencode.NewDecoder(bytes.NewReader(w.Body.Bytes())).Decode(&response)
+	if err != nil {
+		t.Fatalf("error decoding announce response: %v", err)
+	}
+	return response
+}
+
+func TestAnnounceNumWant(t *testing.T) {
+	tracker := NewTracker()
+	addPeers(t, tracker, "leecher", MAX_NUMWANT+50, false)
+
+	tests := []struct {
+		numWant     string
+		want        int
+		wantFailure bool
+	}{
+		{numWant: "", want: DEFAULT_NUMWANT},
+		{numWant: "10", want: 10},
+		{numWant: "0", want: 0},
+		{numWant: fmt.Sprint(MAX_NUMWANT + 1000), want: MAX_NUMWANT},
+		{numWant: "-1", wantFailure: true},
+		{numWant: "many", wantFailure: true},
+	}
+
+	for _, test := range tests {
+		t.Run("numwant="+test.numWant, func(t *testing.T) {
+			extra := url.Values{}
+			if test.numWant != "" {
+				extra.Set("numwant", test.numWant)
+			}
+			response := announceGET(t, tracker, extra)
+			if (response.FailureReason != "") != test.wantFailure {
+				t.Fatalf("failure reason = %q, wantFailure %v", response.FailureReason, test.wantFailure)
+			}
+			if test.wantFailure {
+				return
+			}
+
+			peers, err := response.DecodePeers()
+			if err != nil {
+				t.Fatalf("DecodePeers() error = %v", err)
+			}
+			if len(peers) != test.want {
+				t.Errorf("got %d peers, want %d", len(peers), test.want)
+			}
+		})
+	}
+}
+
+func TestAnnouncePeerSelection(t *testing.T) {
+	tests := []struct {
+		name         string
+		left         int64
+		wantSeeders  int
+		wantLeechers int
+	}{
+		{name: "leechers get everyone", left: 100, wantSeeders: 3, wantLeechers: 2},
+		{name: "seeders only get leechers", left: 0, wantSeeders: 0, wantLeechers: 2},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			tracker := NewTracker()
+			addPeers(t, tracker, "seeder", 3, true)
+			addPeers(t, tracker, "leecher", 2, false)
+
+			peers, err := tracker.announce(&Announce{
+				InfoHash: testInfoHash,
+				PeerID:   "requester",
+				IP:       "192.0.2.1",
+				Port:     6881,
+				Event:    STARTED,
+				Left:     test.left,
+				NumWant:  DEFAULT_NUMWANT,
+			})
+			if err != nil {
+				t.Fatalf("announce() error = %v", err)
+			}
+
+			seeders, leechers := 0, 0
+			for _, peer := range peers {
+				if peer.PeerID == "requester" {
+					t.Fatal("the requester got itself back")
+				}
+				if peer.Seeder {
+					seeders++
+				} else {
+					leechers++
+				}
+			}
+			if seeders != test.wantSeeders || leechers != test.wantLeechers {
+				t.Errorf("got %d seeders and %d leechers, want %d and %d", seeders, leechers, test.wantSeeders, test.wantLeechers)
+			}
+		})
+	}
+}
+
+func TestAnnounceCompletedCountedOnce(t *testing.T) {
+	type step struct {
+		event int
+		left  int64
+	}
+	tests := []struct {
+		name  string
+		steps []step
+		want  int
+	}{
+		{
+			name:  "started then completed",
+			steps: []step{{STARTED, 100}, {COMPLETED, 0}},
+			want:  1,
+		},
+		{
+			name:  "completed announced twice",
+			steps: []step{{STARTED, 100}, {COMPLETED, 0}, {COMPLETED, 0}},
+			want:  1,
+		},
+		{
+			name:  "completed without started",
+			steps: []step{{COMPLETED, 0}},
+			want:  1,
+		},
+		{
+			name:  "completed by a seeder",
+			steps: []step{{STARTED, 0}, {COMPLETED, 0}},
+			want:  0,
+		},
+		{
+			name:  "downloaded again after starting over",
+			steps: []step{{STARTED, 100}, {COMPLETED, 0}, {STOPPED, 0}, {STARTED, 100}, {COMPLETED, 0}},
+			want:  2,
+		},
+		{
+			name:  "regular announces don't count",
+			steps: []step{{STARTED, 100}, {NONE, 50}, {NONE, 0}},
+			want:  0,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			tracker := NewTracker()
+			for _, step := range test.steps {
+				_, err := tracker.announce(&Announce{
+					InfoHash: testInfoHash,
+					PeerID:   "peer",
+					IP:       "192.0.2.1",
+					Port:     6881,
+					Event:    step.event,
+					Left:     step.left,
+				})
+				if err != nil {
+					t.Fatalf("announce() error = %v", err)
+				}
+			}
+
+			completed := tracker.scrape(testInfoHash).Downloaded
+			if completed != test.want {
+				t.Errorf("completed = %d, want %d", completed, test.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,108 @@
+package trackingserver
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"net"
+
+	"github.com/zeebo/bencode"
+)
+
+// PeerDict is a peer in a non-compact announce response (BEP 3)
+type PeerDict struct {
+	PeerID string `bencode:"peer id"`
+	IP     string `bencode:"ip"`
+	Port   int    `bencode:"port"`
+}
+
+// NewAnnounceResponse builds the response to an announce. Compact responses (BEP 23) pack every IPv4 peer
+// into 6 bytes of peers and every IPv6 peer into 18 bytes of peers6, otherwise peers is a list of PeerDicts.
+func NewAnnounceResponse(peers []Peer, compact bool) (*AnnounceResponse, error) {
+	response := &AnnounceResponse{}
+
+	if !compact {
+		dicts := make([]PeerDict, 0, len(peers))
+		for _, peer := range peers {
+			dicts = append(dicts, PeerDict{peer.PeerID, peer.IP, peer.Port})
+		}
+		encoded, err := bencode.EncodeBytes(dicts)
+		if err != nil {
+			return nil, err
+		}
+		response.Peers = encoded
+		return response, nil
+	}
+
+	peers4 := []byte{}
+	for _, peer := range peers {
+		ip := net.ParseIP(peer.IP)
+		if ip == nil {
+			continue
+		}
+		if ip4 := ip.To4(); ip4 != nil {
+			peers4 = append(peers4, ip4...)
+			peers4 = binary.BigEndian.AppendUint16(peers4, uint16(peer.Port))
+		} else {
+			response.Peers6 = append(response.Peers6, ip.To16()...)
+			response.Peers6 = binary.BigEndian.AppendUint16(response.Peers6, uint16(peer.Port))
+		}
+	}
+
+	encoded, err := bencode.EncodeBytes(peers4)
+	if err != nil {
+		return nil, err
+	}
+	response.Peers = encoded
+	return response, nil
+}
+
+// DecodePeers reads the peers out of an announce response, whether the tracker sent them compact or as dictionaries
+func (response *AnnounceResponse) DecodePeers() ([]Peer, error) {
+	peers := []Peer{}
+
+	if len(response.Peers) > 0 && response.Peers[0] == 'l' {
+		var dicts []PeerDict
+		err := bencode.NewDecoder(bytes.NewReader(response.Peers)).Decode(&dicts)
+		if err != nil {
+			return nil, fmt.Errorf("invalid peer list: %v", err)
+		}
+		for _, dict := range dicts {
+			peers = append(peers, Peer{PeerID: dict.PeerID, IP: dict.IP, Port: dict.Port})
+		}
+	} else if len(response.Peers) > 0 {
+		var compact []byte
+		err := bencode.NewDecoder(bytes.NewReader(response.Peers)).Decode(&compact)
+		if err != nil {
+			return nil, fmt.Errorf("invalid compact peers: %v", err)
+		}
+		compactPeers, err := decodeCompactPeers(compact, net.IPv4len)
+		if err != nil {
+			return nil, err
+		}
+		peers = append(peers, compactPeers...)
+	}
+
+	compactPeers, err := decodeCompactPeers(response.Peers6, net.IPv6len)
+	if err != nil {
+		return nil, err
+	}
+	return append(peers, compactPeers...), nil
+}
+
+// decodeCompactPeers splits a compact peer string into peers, each one an IP of ipLength bytes and a 2 byte port
+func decodeCompactPeers(compact []byte, ipLength int) ([]Peer, error) {
+	entryLength := ipLength + 2
+	if len(compact)%entryLength != 0 {
+		return nil, fmt.Errorf("compact peers length %d is not a multiple of %d", len(compact), entryLength)
+	}
+
+	peers := []Peer{}
+	for i := 0; i < len(compact); i += entryLength {
+		peers = append(peers, Peer{
+			IP:   net.IP(compact[i : i+ipLength]).String(),
+			Port: int(binary.BigEndian.Uint16(compact[i+ipLength : i+entryLength])),
+		})
+	}
+	return peers, nil
+}
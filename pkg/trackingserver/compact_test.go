@@ -0,0 +1,147 @@
+package trackingserver
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+
+	"github.com/zeebo/bencode"
+)
+
+func TestAnnounceResponsePeers(t *testing.T) {
+	tests := []struct {
+		name       string
+		peers      []Peer
+		compact    bool
+		want       []Peer
+		wantPeers6 int // Bytes in peers6
+	}{
+		{
+			name:    "compact IPv4",
+			peers:   []Peer{{PeerID: "a", IP: "10.0.0.1", Port: 6881}, {PeerID: "b", IP: "192.0.2.7", Port: 51413}},
+			compact: true,
+			want:    []Peer{{IP: "10.0.0.1", Port: 6881}, {IP: "192.0.2.7", Port: 51413}},
+		},
+		{
+			name:       "compact IPv6 goes in peers6",
+			peers:      []Peer{{PeerID: "a", IP: "10.0.0.1", Port: 6881}, {PeerID: "b", IP: "2001:db8::1", Port: 6882}},
+			compact:    true,
+			want:       []Peer{{IP: "10.0.0.1", Port: 6881}, {IP: "2001:db8::1", Port: 6882}},
+			wantPeers6: 18,
+		},
+		{
+			name:    "compact IPv4-mapped IPv6 is IPv4",
+			peers:   []Peer{{PeerID: "a", IP: "::ffff:10.0.0.1", Port: 6881}},
+			compact: true,
+			want:    []Peer{{IP: "10.0.0.1", Port: 6881}},
+		},
+		{
+			name:    "compact skips invalid IPs",
+			peers:   []Peer{{PeerID: "a", IP: "not an ip", Port: 6881}},
+			compact: true,
+			want:    []Peer{},
+		},
+		{
+			name:    "compact without peers",
+			peers:   []Peer{},
+			compact: true,
+			want:    []Peer{},
+		},
+		{
+			name:    "dictionaries keep peer IDs",
+			peers:   []Peer{{PeerID: "a", IP: "10.0.0.1", Port: 6881}, {PeerID: "b", IP: "2001:db8::1", Port: 6882}},
+			compact: false,
+			want:    []Peer{{PeerID: "a", IP: "10.0.0.1", Port: 6881}, {PeerID: "b", IP: "2001:db8::1", Port: 6882}},
+		},
+		{
+			name:    "dictionaries without peers",
+			peers:   []Peer{},
+			compact: false,
+			want:    []Peer{},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			response, err := NewAnnounceResponse(test.peers, test.compact)
+			if err != nil {
+				t.Fatalf("NewAnnounceResponse() error = %v", err)
+			}
+			if len(response.Peers6) != test.wantPeers6 {
+				t.Errorf("peers6 is %d bytes, want %d", len(response.Peers6), test.wantPeers6)
+			}
+
+			// Go through bencode the way a client would see the response
+			encoded, err := bencode.EncodeBytes(response)
+			if err != nil {
+				t.Fatalf("error encoding announce response: %v", err)
+			}
+			var decoded AnnounceResponse
+			err = bencode.NewDecoder(bytes.NewReader(encoded)).Decode(&decoded)
+			if err != nil {
+				t.Fatalf("error decoding announce response: %v", err)
+			}
+
+			peers, err := decoded.DecodePeers()
+			if err != nil {
+				t.Fatalf("DecodePeers() error = %v", err)
+			}
+			if !reflect.DeepEqual(peers, test.want) {
+				t.Errorf("DecodePeers() = %+v, want %+v", peers, test.want)
+			}
+		})
+	}
+}
+
+func TestDecodeCompactPeers(t *testing.T) {
+	tests := []struct {
+		name     string
+		compact  []byte
+		ipLength int
+		want     []Peer
+		wantErr  bool
+	}{
+		{
+			name:     "IPv4",
+			compact:  []byte{10, 0, 0, 1, 0x1a, 0xe1},
+			ipLength: 4,
+			want:     []Peer{{IP: "10.0.0.1", Port: 6881}},
+		},
+		{
+			name:     "IPv6",
+			compact:  []byte{0x20, 0x01, 0x0d, 0xb8, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 1, 0x1a, 0xe2},
+			ipLength: 16,
+			want:     []Peer{{IP: "2001:db8::1", Port: 6882}},
+		},
+		{
+			name:     "empty",
+			compact:  []byte{},
+			ipLength: 4,
+			want:     []Peer{},
+		},
+		{
+			name:     "cut off IPv4 entry",
+			compact:  []byte{10, 0, 0, 1, 0x1a, 0xe1, 10, 0},
+			ipLength: 4,
+			wantErr:  true,
+		},
+		{
+			name:     "IPv4 entries read as IPv6",
+			compact:  []byte{10, 0, 0, 1, 0x1a, 0xe1, 10, 0, 0, 2, 0x1a, 0xe1},
+			ipLength: 16,
+			wantErr:  true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			peers, err := decodeCompactPeers(test.compact, test.ipLength)
+			if (err != nil) != test.wantErr {
+				t.Fatalf("decodeCompactPeers() error = %v, wantErr %v", err, test.wantErr)
+			}
+			if !test.wantErr && !reflect.DeepEqual(peers, test.want) {
+				t.Errorf("decodeCompactPeers() = %+v, want %+v", peers, test.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,121 @@
+package trackingserver
+
+import (
+	"sort"
+
+	"bittorrent/pkg/metrics"
+)
+
+// eventNames labels the announce counters
+var eventNames = map[int]string{
+	STARTED:   "started",
+	STOPPED:   "stopped",
+	COMPLETED: "completed",
+	NONE:      "none",
+}
+
+// trackerMetrics counts what the tracker has handled since it started, it is protected by tracker.mtx
+type trackerMetrics struct {
+	announces map[int]int64    // Keyed by event
+	rejected  int64            // Announces refused by a private tracker or a ban
+	scrapes   map[string]int64 // Keyed by protocol
+	reaped    int64
+}
+
+func newTrackerMetrics() trackerMetrics {
+	return trackerMetrics{
+		announces: make(map[int]int64),
+		scrapes:   make(map[string]int64),
+	}
+}
+
+// countScrape counts a scrape that came in over protocol, "http" or "udp"
+func (tracker *Tracker) countScrape(protocol string) {
+	tracker.mtx.Lock()
+	defer tracker.mtx.Unlock()
+	tracker.metrics.scrapes[protocol]++
+}
+
+// writeMetrics writes the tracker's counters along with the size of every swarm. A private tracker leaves the
+// per torrent series out, since /metrics is served to anyone and its info_hashes are only for its users.
+func (tracker *Tracker) writeMetrics(mw *metrics.Writer) {
+	tracker.mtx.Lock()
+	defer tracker.mtx.Unlock()
+
+	announces := []metrics.Sample{}
+	for _, event := range []int{STARTED, STOPPED, COMPLETED, NONE} {
+		announces = append(announces, metrics.Labeled(float64(tracker.metrics.announces[event]), "event", eventNames[event]))
+	}
+	mw.Family("tracker_announces_total", metrics.COUNTER, "Announces received, by event.", announces...)
+	mw.Family("tracker_announces_rejected_total", metrics.COUNTER, "Announces refused for an unknown passkey, an unregistered torrent or a ban.",
+		metrics.Value(float64(tracker.metrics.rejected)))
+
+	scrapes := []metrics.Sample{}
+	for _, protocol := range []string{"http", "udp"} {
+		scrapes = append(scrapes, metrics.Labeled(float64(tracker.metrics.scrapes[protocol]), "protocol", protocol))
+	}
+	mw.Family("tracker_scrapes_total", metrics.COUNTER, "Scrapes received, by protocol.", scrapes...)
+	mw.Family("tracker_reaped_peers_total", metrics.COUNTER, "Peers dropped for not announcing within the timeout.",
+		metrics.Value(float64(tracker.metrics.reaped)))
+
+	// Swarms are written in info_hash order so the output is stable between scrapes
+	infoHashes := []string{}
+	for infoHash := range tracker.peers {
+		infoHashes = append(infoHashes, infoHash)
+	}
+	sort.Strings(infoHashes)
+
+	private := tracker.registry != nil
+	torrents, totalSeeders, totalLeechers := 0, 0, 0
+	peers := []metrics.Sample{}
+	for _, infoHash := range infoHashes {
+		seeders, leechers := 0, 0
+		for _, peer := range tracker.peers[infoHash] {
+			if peer.expired() {
+				continue
+			}
+			if peer.Seeder {
+				seeders++
+			} else {
+				leechers++
+			}
+		}
+		if seeders+leechers == 0 {
+			continue
+		}
+		torrents++
+		totalSeeders += seeders
+		totalLeechers += leechers
+		if !private {
+			peers = append(peers,
+				metrics.Labeled(float64(seeders), "info_hash", infoHash, "state", "seeder"),
+				metrics.Labeled(float64(leechers), "info_hash", infoHash, "state", "leecher"))
+		}
+	}
+	mw.Family("tracker_torrents", metrics.GAUGE, "Torrents with at least one active peer.", metrics.Value(float64(torrents)))
+	mw.Family("tracker_active_peers", metrics.GAUGE, "Active peers over every torrent, by state.",
+		metrics.Labeled(float64(totalSeeders), "state", "seeder"),
+		metrics.Labeled(float64(totalLeechers), "state", "leecher"))
+	if !private {
+		mw.Family("tracker_torrent_active_peers", metrics.GAUGE, "Active peers of each torrent, by state.", peers...)
+	}
+
+	completed := []metrics.Sample{}
+	totalCompleted := 0
+	for infoHash, count := range tracker.completed {
+		totalCompleted += count
+		if !private {
+			completed = append(completed, metrics.Labeled(float64(count), "info_hash", infoHash))
+		}
+	}
+	sort.Slice(completed, func(i, j int) bool { return completed[i].Labels[1] < completed[j].Labels[1] })
+	mw.Family("tracker_completed_total", metrics.COUNTER, "Completed downloads reported over every torrent.",
+		metrics.Value(float64(totalCompleted)))
+	if !private {
+		mw.Family("tracker_torrent_completed_total", metrics.COUNTER, "Completed downloads reported for each torrent.", completed...)
+	}
+
+	mw.Family("tracker_bans", metrics.GAUGE, "IPs and peer_ids banned through the admin API.",
+		metrics.Labeled(float64(len(tracker.bannedIPs)), "kind", "ip"),
+		metrics.Labeled(float64(len(tracker.bannedPeers)), "kind", "peer_id"))
+}
@@ -0,0 +1,128 @@
+package trackingserver
+
+import (
+	"bittorrent/pkg/metrics"
+	"maps"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// scrapeMetrics fetches /metrics from handler and returns the kind of every family along with the value of every
+// series, keyed by its name and labels as they are written
+func scrapeMetrics(t *testing.T, handler http.Handler) (map[string]string, map[string]float64) {
+	t.Helper()
+
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("GET", "/metrics", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("GET /metrics status = %d, want %d", w.Code, http.StatusOK)
+	}
+	if contentType := w.Header().Get("Content-Type"); contentType != metrics.CONTENT_TYPE {
+		t.Errorf("GET /metrics Content-Type = %q, want %q", contentType, metrics.CONTENT_TYPE)
+	}
+
+	families := make(map[string]string)
+	samples := make(map[string]float64)
+	for _, line := range strings.Split(strings.TrimSpace(w.Body.String()), "\n") {
+		if strings.HasPrefix(line, "# TYPE ") {
+			fields := strings.Fields(line)
+			families[fields[2]] = fields[3]
+			continue
+		}
+		if strings.HasPrefix(line, "#") {
+			continue
+		}
+		i := strings.LastIndex(line, " ")
+		value, err := strconv.ParseFloat(line[i+1:], 64)
+		if err != nil {
+			t.Fatalf("series %q has value %q: %v", line[:i], line[i+1:], err)
+		}
+		samples[line[:i]] = value
+	}
+	return families, samples
+}
+
+func TestTrackerMetrics(t *testing.T) {
+	wantFamilies := map[string]string{
+		"tracker_announces_total":          metrics.COUNTER,
+		"tracker_announces_rejected_total": metrics.COUNTER,
+		"tracker_scrapes_total":            metrics.COUNTER,
+		"tracker_reaped_peers_total":       metrics.COUNTER,
+		"tracker_torrents":                 metrics.GAUGE,
+		"tracker_active_peers":             metrics.GAUGE,
+		"tracker_completed_total":          metrics.COUNTER,
+		"tracker_bans":                     metrics.GAUGE,
+	}
+	wantSamples := map[string]float64{
+		`tracker_announces_total{event="started"}`:   4,
+		`tracker_announces_total{event="stopped"}`:   0,
+		`tracker_announces_total{event="completed"}`: 1,
+		`tracker_announces_total{event="none"}`:      0,
+		`tracker_announces_rejected_total`:           1,
+		`tracker_scrapes_total{protocol="http"}`:     0,
+		`tracker_scrapes_total{protocol="udp"}`:      1,
+		`tracker_reaped_peers_total`:                 0,
+		`tracker_torrents`:                           1,
+		`tracker_active_peers{state="seeder"}`:       2,
+		`tracker_active_peers{state="leecher"}`:      1,
+		`tracker_completed_total`:                    1,
+		`tracker_bans{kind="ip"}`:                    1,
+		`tracker_bans{kind="peer_id"}`:               0,
+	}
+
+	tests := []struct {
+		name    string
+		private bool
+	}{
+		{name: "public", private: false},
+		{name: "private leaves out the per torrent series", private: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			tracker := NewTracker()
+			passkey := ""
+			if test.private {
+				tracker, _, passkey = privateTracker(t)
+			}
+			tracker.Ban("10.0.9.9", "")
+
+			announces := []*Announce{
+				{PeerID: "leecher-0", IP: "10.0.0.1", Event: STARTED, Left: 100},
+				{PeerID: "leecher-1", IP: "10.0.0.2", Event: STARTED, Left: 100},
+				{PeerID: "seeder-0", IP: "10.0.0.3", Event: STARTED, Left: 0},
+				{PeerID: "leecher-0", IP: "10.0.0.1", Event: COMPLETED, Left: 0},
+				{PeerID: "banned", IP: "10.0.9.9", Event: STARTED, Left: 100},
+			}
+			for _, announce := range announces {
+				announce.InfoHash = testInfoHash
+				announce.Port = 6881
+				announce.Passkey = passkey
+				tracker.announce(announce)
+			}
+			tracker.countScrape("udp")
+
+			families := maps.Clone(wantFamilies)
+			want := maps.Clone(wantSamples)
+			if !test.private {
+				families["tracker_torrent_active_peers"] = metrics.GAUGE
+				families["tracker_torrent_completed_total"] = metrics.COUNTER
+				want[`tracker_torrent_active_peers{info_hash="`+testInfoHash+`",state="seeder"}`] = 2
+				want[`tracker_torrent_active_peers{info_hash="`+testInfoHash+`",state="leecher"}`] = 1
+				want[`tracker_torrent_completed_total{info_hash="`+testInfoHash+`"}`] = 1
+			}
+
+			gotFamilies, got := scrapeMetrics(t, metrics.Handler(tracker.writeMetrics))
+			if !reflect.DeepEqual(gotFamilies, families) {
+				t.Errorf("families = %v, want %v", gotFamilies, families)
+			}
+			if !reflect.DeepEqual(got, want) {
+				t.Errorf("series = %v, want %v", got, want)
+			}
+		})
+	}
+}
@@ -0,0 +1,309 @@
+package trackingserver
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// REGISTRY_SAVE_INTERVAL is how often the transfer totals of a private tracker's users are written back to disk
+const REGISTRY_SAVE_INTERVAL = 30 * time.Second
+
+// REPORT_TTL is how long the counters a client last reported are kept after it stops announcing without saying so.
+// It is far longer than TIMEOUT, so a peer the reaper dropped still gets credited for just what it transferred since.
+const REPORT_TTL = 24 * time.Hour
+
+// Failure reasons of a private tracker, sent back to clients as-is
+var (
+	errUnknownPasskey      = errors.New("unknown passkey")
+	errUnregisteredTorrent = errors.New("torrent is not registered with this tracker")
+)
+
+// User is someone allowed to use a private tracker. Their passkey goes in the announce URL, /announce/<passkey>,
+// and their totals add up what every one of their clients has reported.
+type User struct {
+	Name       string `json:"name"`
+	Passkey    string `json:"passkey"`
+	Uploaded   int64  `json:"uploaded"`
+	Downloaded int64  `json:"downloaded"`
+}
+
+// Registry holds the users and torrents of a private tracker. It is kept as a JSON file, so users and torrents
+// can also be added by hand while the tracker is stopped.
+type Registry struct {
+	mtx      sync.Mutex
+	path     string
+	Users    []*User  `json:"users"`
+	Torrents []string `json:"torrents"` // The hex info_hashes that are tracked, announces for anything else are refused
+	dirty    bool     // Set when the totals changed since the last save
+
+	reports map[reportKey]transferReport // The counters each client last reported, only kept in memory
+}
+
+// reportKey is a single client of a user downloading a single torrent
+type reportKey struct {
+	passkey  string
+	infoHash string
+	peerID   string
+}
+
+// transferReport is what a client said it had transferred in its last announce
+type transferReport struct {
+	uploaded   int64
+	downloaded int64
+	at         time.Time
+}
+
+// LoadRegistry reads the registry at path, starting an empty one if the file doesn't exist yet
+func LoadRegistry(path string) (*Registry, error) {
+	registry := &Registry{path: path, Users: []*User{}, Torrents: []string{}, reports: make(map[reportKey]transferReport)}
+
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return registry, registry.Save()
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error reading registry: %v", err)
+	}
+
+	err = json.Unmarshal(data, registry)
+	if err != nil {
+		return nil, fmt.Errorf("error decoding registry: %v", err)
+	}
+	for i, infoHash := range registry.Torrents {
+		registry.Torrents[i] = strings.ToLower(infoHash)
+	}
+	return registry, nil
+}
+
+// Save writes the registry to disk, replacing the old file in one go so a crash can't leave half of it behind
+func (r *Registry) Save() error {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	return r.save()
+}
+
+// save writes the registry to disk, the caller must hold r.mtx
+func (r *Registry) save() error {
+	data, err := json.MarshalIndent(r, "", "  ")
+	if err != nil {
+		return fmt.Errorf("error encoding registry: %v", err)
+	}
+
+	tmpPath := r.path + ".tmp"
+	err = os.WriteFile(tmpPath, data, 0600) // Passkeys are secrets
+	if err != nil {
+		return fmt.Errorf("error writing registry: %v", err)
+	}
+	err = os.Rename(tmpPath, r.path)
+	if err != nil {
+		return fmt.Errorf("error writing registry: %v", err)
+	}
+
+	r.dirty = false
+	return nil
+}
+
+// AddUser registers a new user with a random passkey and saves the registry
+func (r *Registry) AddUser(name string) (*User, error) {
+	passkey := make([]byte, 16)
+	_, err := rand.Read(passkey)
+	if err != nil {
+		return nil, fmt.Errorf("error generating passkey: %v", err)
+	}
+
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+
+	user := &User{Name: name, Passkey: hex.EncodeToString(passkey)}
+	r.Users = append(r.Users, user)
+	return user, r.save()
+}
+
+// RegisterTorrent starts tracking a hex info_hash and saves the registry
+func (r *Registry) RegisterTorrent(infoHash string) error {
+	infoHash = strings.ToLower(infoHash)
+	raw, err := hex.DecodeString(infoHash)
+	if err != nil || len(raw) != 20 {
+		return fmt.Errorf("info_hash must be 40 hex characters")
+	}
+
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+
+	for _, registered := range r.Torrents {
+		if registered == infoHash {
+			return nil
+		}
+	}
+	r.Torrents = append(r.Torrents, infoHash)
+	return r.save()
+}
+
+// UnregisterTorrent stops tracking a hex info_hash and saves the registry
+func (r *Registry) UnregisterTorrent(infoHash string) error {
+	infoHash = strings.ToLower(infoHash)
+
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+
+	for i, registered := range r.Torrents {
+		if registered == infoHash {
+			r.Torrents = append(r.Torrents[:i], r.Torrents[i+1:]...)
+			return r.save()
+		}
+	}
+	return nil
+}
+
+// ListUsers returns a copy of every user
+func (r *Registry) ListUsers() []User {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+
+	users := make([]User, len(r.Users))
+	for i, user := range r.Users {
+		users[i] = *user
+	}
+	return users
+}
+
+// check makes sure the passkey belongs to a user and the torrent is registered
+func (r *Registry) check(passkey string, infoHash string) error {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+
+	if r.user(passkey) == nil {
+		return errUnknownPasskey
+	}
+	if infoHash == "" {
+		return nil
+	}
+	for _, registered := range r.Torrents {
+		if registered == infoHash {
+			return nil
+		}
+	}
+	return errUnregisteredTorrent
+}
+
+// user finds the user with a passkey, the caller must hold r.mtx
+func (r *Registry) user(passkey string) *User {
+	if passkey == "" {
+		return nil
+	}
+	for _, user := range r.Users {
+		if user.Passkey == passkey {
+			return user
+		}
+	}
+	return nil
+}
+
+// report adds what a client transferred since its last announce to the totals of the user with a passkey, which get
+// saved on the next REGISTRY_SAVE_INTERVAL. The counters are remembered apart from the swarm, so a client the reaper
+// dropped isn't credited for everything it reported before all over again. A client that stopped starts over.
+func (r *Registry) report(passkey string, infoHash string, peerID string, uploaded int64, downloaded int64, stopped bool) {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+
+	user := r.user(passkey)
+	if user == nil {
+		return
+	}
+
+	key := reportKey{passkey, infoHash, peerID}
+	last, known := r.reports[key]
+	if stopped {
+		delete(r.reports, key)
+	} else {
+		r.reports[key] = transferReport{uploaded, downloaded, time.Now()}
+	}
+
+	uploadedDelta := transferDelta(uploaded, last.uploaded, known)
+	downloadedDelta := transferDelta(downloaded, last.downloaded, known)
+	if uploadedDelta == 0 && downloadedDelta == 0 {
+		return
+	}
+	user.Uploaded += uploadedDelta
+	user.Downloaded += downloadedDelta
+	r.dirty = true
+}
+
+// pruneReports forgets the counters of clients that haven't announced in REPORT_TTL, the caller must hold r.mtx
+func (r *Registry) pruneReports() {
+	for key, report := range r.reports {
+		if time.Since(report.at) > REPORT_TTL {
+			delete(r.reports, key)
+		}
+	}
+}
+
+// runSaver writes the totals to disk every REGISTRY_SAVE_INTERVAL if they changed, and forgets stale reports
+func (r *Registry) runSaver() {
+	ticker := time.NewTicker(REGISTRY_SAVE_INTERVAL)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		r.mtx.Lock()
+		r.pruneReports()
+		var err error
+		if r.dirty {
+			err = r.save()
+		}
+		r.mtx.Unlock()
+		if err != nil {
+			log.Println("Error saving registry:", err)
+		}
+	}
+}
+
+// SetRegistry turns the tracker into a private tracker, which only tracks the torrents in the registry for its users
+func (tracker *Tracker) SetRegistry(registry *Registry) {
+	tracker.mtx.Lock()
+	defer tracker.mtx.Unlock()
+
+	tracker.registry = registry
+	go registry.runSaver()
+}
+
+// checkPrivate refuses announces and scrapes from unknown passkeys and for unregistered torrents when the tracker
+// is private, an empty infoHash only checks the passkey. The caller must hold tracker.mtx.
+func (tracker *Tracker) checkPrivate(passkey string, infoHash string) error {
+	if tracker.registry == nil {
+		return nil
+	}
+	return tracker.registry.check(passkey, infoHash)
+}
+
+// isPrivate reports whether the tracker only serves the users and torrents in its registry
+func (tracker *Tracker) isPrivate() bool {
+	tracker.mtx.Lock()
+	defer tracker.mtx.Unlock()
+	return tracker.registry != nil
+}
+
+// passkeyFromPath takes the passkey out of /announce/<passkey> or /scrape/<passkey>, it is empty for /announce and /scrape
+func passkeyFromPath(path string) string {
+	_, passkey, found := strings.Cut(strings.TrimPrefix(path, "/"), "/")
+	if !found {
+		return ""
+	}
+	return strings.Trim(passkey, "/")
+}
+
+// transferDelta is how much a counter went up since the client's last announce. Clients count from zero again
+// when they restart, so a counter that went down is all new.
+func transferDelta(now int64, before int64, known bool) int64 {
+	if !known || now < before {
+		return max(now, 0)
+	}
+	return now - before
+}
@@ -0,0 +1,188 @@
+package trackingserver
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// privateTracker starts a private tracker with a single user, who can use testInfoHash
+func privateTracker(t *testing.T) (*Tracker, *Registry, string) {
+	t.Helper()
+
+	registry, err := LoadRegistry(filepath.Join(t.TempDir(), "registry.json"))
+	if err != nil {
+		t.Fatalf("LoadRegistry() error = %v", err)
+	}
+	user, err := registry.AddUser("alice")
+	if err != nil {
+		t.Fatalf("AddUser() error = %v", err)
+	}
+	err = registry.RegisterTorrent(testInfoHash)
+	if err != nil {
+		t.Fatalf("RegisterTorrent() error = %v", err)
+	}
+
+	tracker := NewTracker()
+	tracker.SetRegistry(registry)
+	return tracker, registry, user.Passkey
+}
+
+func TestPasskeyFromPath(t *testing.T) {
+	tests := []struct {
+		path string
+		want string
+	}{
+		{"/announce", ""},
+		{"/announce/", ""},
+		{"/announce/abc123", "abc123"},
+		{"/announce/abc123/", "abc123"},
+		{"/scrape/abc123", "abc123"},
+		{"announce/abc123", "abc123"},
+		{"/", ""},
+	}
+
+	for _, test := range tests {
+		got := passkeyFromPath(test.path)
+		if got != test.want {
+			t.Errorf("passkeyFromPath(%q) = %q, want %q", test.path, got, test.want)
+		}
+	}
+}
+
+func TestPrivateAnnounce(t *testing.T) {
+	tracker, _, passkey := privateTracker(t)
+
+	tests := []struct {
+		name     string
+		passkey  string
+		infoHash string
+		wantErr  error
+	}{
+		{name: "registered user and torrent", passkey: passkey, infoHash: testInfoHash},
+		{name: "no passkey", passkey: "", infoHash: testInfoHash, wantErr: errUnknownPasskey},
+		{name: "unknown passkey", passkey: "0000", infoHash: testInfoHash, wantErr: errUnknownPasskey},
+		{name: "unregistered torrent", passkey: passkey, infoHash: "ffffffffffffffffffffffffffffffffffffffff", wantErr: errUnregisteredTorrent},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, err := tracker.announce(&Announce{
+				InfoHash: test.infoHash,
+				PeerID:   "peer",
+				IP:       "192.0.2.1",
+				Port:     6881,
+				Event:    STARTED,
+				Left:     100,
+				Passkey:  test.passkey,
+			})
+			if err != test.wantErr {
+				t.Errorf("announce() error = %v, want %v", err, test.wantErr)
+			}
+		})
+	}
+}
+
+func TestPrivateTransferCredit(t *testing.T) {
+	type step struct {
+		event      int
+		uploaded   int64
+		downloaded int64
+		reapFirst  bool // Whether the reaper drops the peer before this announce
+	}
+	tests := []struct {
+		name           string
+		steps          []step
+		wantUploaded   int64
+		wantDownloaded int64
+	}{
+		{
+			name:           "first announce",
+			steps:          []step{{event: STARTED, uploaded: 100, downloaded: 50}},
+			wantUploaded:   100,
+			wantDownloaded: 50,
+		},
+		{
+			name: "counters going up",
+			steps: []step{
+				{event: STARTED, uploaded: 100, downloaded: 50},
+				{event: NONE, uploaded: 250, downloaded: 80},
+			},
+			wantUploaded:   250,
+			wantDownloaded: 80,
+		},
+		{
+			name: "same counters again",
+			steps: []step{
+				{event: STARTED, uploaded: 100, downloaded: 50},
+				{event: NONE, uploaded: 100, downloaded: 50},
+			},
+			wantUploaded:   100,
+			wantDownloaded: 50,
+		},
+		{
+			name: "announcing again after being reaped",
+			steps: []step{
+				{event: STARTED, uploaded: 100, downloaded: 50},
+				{event: NONE, uploaded: 150, downloaded: 60, reapFirst: true},
+			},
+			wantUploaded:   150,
+			wantDownloaded: 60,
+		},
+		{
+			name: "starting over after stopping",
+			steps: []step{
+				{event: STARTED, uploaded: 100},
+				{event: STOPPED, uploaded: 120},
+				{event: STARTED, uploaded: 30},
+			},
+			wantUploaded: 150,
+		},
+		{
+			name: "client restarted without stopping",
+			steps: []step{
+				{event: STARTED, uploaded: 100},
+				{event: STARTED, uploaded: 20},
+			},
+			wantUploaded: 120,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			tracker, registry, passkey := privateTracker(t)
+			for i, step := range test.steps {
+				if step.reapFirst {
+					tracker.mtx.Lock()
+					peer := tracker.peers[testInfoHash]["peer"]
+					peer.LastAnnounce = time.Now().Add(-2 * TIMEOUT)
+					tracker.setPeer(testInfoHash, peer)
+					tracker.mtx.Unlock()
+					if reaped := tracker.reap(); reaped != 1 {
+						t.Fatalf("step %d: reap() = %d, want 1", i, reaped)
+					}
+				}
+
+				_, err := tracker.announce(&Announce{
+					InfoHash:   testInfoHash,
+					PeerID:     "peer",
+					IP:         "192.0.2.1",
+					Port:       6881,
+					Event:      step.event,
+					Uploaded:   step.uploaded,
+					Downloaded: step.downloaded,
+					Left:       100,
+					Passkey:    passkey,
+				})
+				if err != nil {
+					t.Fatalf("step %d: announce() error = %v", i, err)
+				}
+			}
+
+			user := registry.ListUsers()[0]
+			if user.Uploaded != test.wantUploaded || user.Downloaded != test.wantDownloaded {
+				t.Errorf("user totals = %d up, %d down, want %d, %d", user.Uploaded, user.Downloaded, test.wantUploaded, test.wantDownloaded)
+			}
+		})
+	}
+}
@@ -0,0 +1,42 @@
+package trackingserver
+
+import (
+	"fmt"
+	"time"
+)
+
+// REAP_INTERVAL is how often the reaper looks for peers that went longer than TIMEOUT without announcing
+const REAP_INTERVAL = 30 * time.Second
+
+// runReaper drops the peers that timed out every REAP_INTERVAL, for as long as the tracker runs
+func (tracker *Tracker) runReaper() {
+	ticker := time.NewTicker(REAP_INTERVAL)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		reaped := tracker.reap()
+		if reaped > 0 {
+			fmt.Println("Reaped", reaped, "peers that stopped announcing")
+		}
+	}
+}
+
+// reap drops every peer that timed out, along with the swarms that are left empty, and returns how many it dropped
+func (tracker *Tracker) reap() int {
+	tracker.mtx.Lock()
+	defer tracker.mtx.Unlock()
+
+	reaped := 0
+	for infoHash, swarm := range tracker.peers {
+		for peerID, peer := range swarm {
+			if peer.expired() {
+				// Deleting from a map while ranging over it is fine in Go
+				tracker.deletePeer(infoHash, peerID)
+				tracker.removePeer(infoHash, peerID)
+				reaped++
+			}
+		}
+	}
+	tracker.metrics.reaped += int64(reaped)
+	return reaped
+}
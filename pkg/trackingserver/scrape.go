@@ -0,0 +1,111 @@
+package trackingserver
+
+import (
+	"encoding/hex"
+	"fmt"
+	"log"
+	"net/http"
+
+	"github.com/zeebo/bencode"
+)
+
+// MAX_SCRAPE is the most info_hashes a single HTTP scrape can ask about, a scrape without any gets every torrent
+const MAX_SCRAPE = 100
+
+// ScrapeFile is the health of a single swarm
+type ScrapeFile struct {
+	Complete   int `bencode:"complete"`   // How many seeders the torrent has
+	Downloaded int `bencode:"downloaded"` // How many times the torrent has been downloaded
+	Incomplete int `bencode:"incomplete"` // How many leechers the torrent has
+}
+
+// ScrapeResponse is the response to a scrape, Files is keyed by the raw 20 byte info_hash.
+// Failed scrapes only have FailureReason set.
+type ScrapeResponse struct {
+	FailureReason string                `bencode:"failure reason,omitempty"`
+	Files         map[string]ScrapeFile `bencode:"files,omitempty"`
+}
+
+// handleScrapeGET answers a scrape for every info_hash in the query, or for every torrent if there are none
+func handleScrapeGET(w http.ResponseWriter, r *http.Request, tracker *Tracker) {
+	// Private trackers only answer their own users, who can only see the registered torrents anyway
+	tracker.mtx.Lock()
+	err := tracker.checkPrivate(passkeyFromPath(r.URL.Path), "")
+	tracker.mtx.Unlock()
+	if err != nil {
+		sendFailure(w, err.Error())
+		return
+	}
+
+	// info_hash is the raw 20 bytes, which Query has already URL decoded
+	infoHashes := r.URL.Query()["info_hash"]
+	if len(infoHashes) > MAX_SCRAPE {
+		sendFailure(w, fmt.Sprintf("can scrape at most %d torrents at once", MAX_SCRAPE))
+		return
+	}
+	for _, infoHash := range infoHashes {
+		if len(infoHash) != 20 {
+			sendFailure(w, "invalid info_hash")
+			return
+		}
+	}
+
+	if len(infoHashes) == 0 {
+		for _, infoHash := range tracker.infoHashes() {
+			raw, err := hex.DecodeString(infoHash)
+			if err == nil {
+				infoHashes = append(infoHashes, string(raw))
+			}
+		}
+	}
+
+	fmt.Println("Received Scrape for", len(infoHashes), "torrents from", r.RemoteAddr)
+	tracker.countScrape("http")
+
+	scrapeResponse := ScrapeResponse{Files: make(map[string]ScrapeFile)}
+	for _, infoHash := range infoHashes {
+		scrapeResponse.Files[infoHash] = tracker.scrape(hex.EncodeToString([]byte(infoHash)))
+	}
+
+	data, err := bencode.EncodeBytes(scrapeResponse)
+	if err != nil {
+		http.Error(w, "Error encoding response", http.StatusInternalServerError)
+		log.Printf("Error marshalling scrape response: %v", err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/x-bittorrent")
+	w.WriteHeader(http.StatusOK)
+	w.Write(data)
+}
+
+// scrape returns the health of a swarm, leaving out peers that timed out. It is shared by the HTTP and UDP endpoints.
+func (tracker *Tracker) scrape(infoHash string) ScrapeFile {
+	seeders, leechers := tracker.counts(infoHash)
+
+	tracker.mtx.Lock()
+	defer tracker.mtx.Unlock()
+
+	return ScrapeFile{
+		Complete:   seeders,
+		Downloaded: tracker.completed[infoHash],
+		Incomplete: leechers,
+	}
+}
+
+// infoHashes lists the torrents that have peers that haven't timed out, as hex
+func (tracker *Tracker) infoHashes() []string {
+	tracker.mtx.Lock()
+	defer tracker.mtx.Unlock()
+
+	infoHashes := []string{}
+	for infoHash, peers := range tracker.peers {
+		for _, peer := range peers {
+			if !peer.expired() {
+				infoHashes = append(infoHashes, infoHash)
+				break
+			}
+		}
+	}
+	return infoHashes
+}
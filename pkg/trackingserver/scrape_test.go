@@ -0,0 +1,88 @@
+package trackingserver
+
+import (
+	"bytes"
+	"encoding/hex"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/zeebo/bencode"
+)
+
+func TestHandleScrapeGET(t *testing.T) {
+	tracker := NewTracker()
+	addPeers(t, tracker, "seeder", 2, true)
+	addPeers(t, tracker, "leecher", 3, false)
+	_, err := tracker.announce(&Announce{InfoHash: testInfoHash, PeerID: "leecher-0", IP: "10.0.0.1", Port: 6881, Event: COMPLETED, Left: 0})
+	if err != nil {
+		t.Fatalf("announce() error = %v", err)
+	}
+
+	raw, _ := hex.DecodeString(testInfoHash)
+	infoHash := string(raw)
+	unknown := strings.Repeat("x", 20)
+
+	tests := []struct {
+		name        string
+		infoHashes  []string
+		want        map[string]ScrapeFile
+		wantFailure bool
+	}{
+		{
+			name:       "one torrent",
+			infoHashes: []string{infoHash},
+			want:       map[string]ScrapeFile{infoHash: {Complete: 3, Downloaded: 1, Incomplete: 2}},
+		},
+		{
+			name:       "unknown torrent",
+			infoHashes: []string{unknown},
+			want:       map[string]ScrapeFile{unknown: {}},
+		},
+		{
+			name:       "several torrents",
+			infoHashes: []string{infoHash, unknown},
+			want: map[string]ScrapeFile{
+				infoHash: {Complete: 3, Downloaded: 1, Incomplete: 2},
+				unknown:  {},
+			},
+		},
+		{
+			name: "every torrent",
+			want: map[string]ScrapeFile{infoHash: {Complete: 3, Downloaded: 1, Incomplete: 2}},
+		},
+		{
+			name:        "short info_hash",
+			infoHashes:  []string{"short"},
+			wantFailure: true,
+		},
+		{
+			name:        "too many info_hashes",
+			infoHashes:  make([]string, MAX_SCRAPE+1),
+			wantFailure: true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			query := url.Values{"info_hash": test.infoHashes}
+			r := httptest.NewRequest("GET", "/scrape?"+query.Encode(), nil)
+			w := httptest.NewRecorder()
+			handleScrapeGET(w, r, tracker)
+
+			var response ScrapeResponse
+			err := bencode.NewDecoder(bytes.NewReader(w.Body.Bytes())).Decode(&response)
+			if err != nil {
+				t.Fatalf("error decoding scrape response: %v", err)
+			}
+			if (response.FailureReason != "") != test.wantFailure {
+				t.Fatalf("failure reason = %q, wantFailure %v", response.FailureReason, test.wantFailure)
+			}
+			if !test.wantFailure && !reflect.DeepEqual(response.Files, test.want) {
+				t.Errorf("files = %+v, want %+v", response.Files, test.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,281 @@
+package trackingserver
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+// The log of a FileStore is rewritten with just the current state once it has at least COMPACT_MIN_RECORDS
+// records and COMPACT_RATIO times as many records as there are live peers and counts
+const (
+	COMPACT_MIN_RECORDS = 1000
+	COMPACT_RATIO       = 2
+)
+
+// PeerStore keeps the tracker's swarms somewhere that survives a restart. Every change to the peers goes
+// through it, and Load hands everything back when the tracker starts. The tracker calls it while holding its
+// lock, so a store never sees two changes at once.
+type PeerStore interface {
+	Load() (map[string][]Peer, map[string]int, error) // Every peer and completed count, keyed by hex info_hash
+	SavePeer(infoHash string, peer Peer) error        // Adds a peer or replaces the one with the same peer ID
+	RemovePeer(infoHash string, peerID string) error
+	SaveCompleted(infoHash string, completed int) error
+	Close() error
+}
+
+// storeRecord is a single change in the log of a FileStore. Peer IDs are binary, so they are stored as bytes,
+// which JSON writes as base64.
+type storeRecord struct {
+	Op           string    `json:"op"` // "peer", "remove" or "completed"
+	InfoHash     string    `json:"info_hash"`
+	PeerID       []byte    `json:"peer_id,omitempty"`
+	Seeder       bool      `json:"seeder,omitempty"`
+	IP           string    `json:"ip,omitempty"`
+	Port         int       `json:"port,omitempty"`
+	LastAnnounce time.Time `json:"last_announce"`
+	Uploaded     int64     `json:"uploaded,omitempty"`
+	Downloaded   int64     `json:"downloaded,omitempty"`
+	Left         int64     `json:"left,omitempty"`
+	Completed    int       `json:"completed,omitempty"`
+}
+
+// FileStore is a PeerStore that appends every change to a log file, one JSON record per line.
+// It keeps the current state in memory as well, so the log can be compacted without reading it back.
+type FileStore struct {
+	mtx       sync.Mutex
+	path      string
+	file      *os.File
+	peers     map[string]map[string]Peer // Keyed by info_hash and then peer ID
+	completed map[string]int
+	records   int // Records in the log since it was last compacted
+}
+
+// OpenFileStore replays the log at path, creating it if it doesn't exist, and compacts it
+func OpenFileStore(path string) (*FileStore, error) {
+	store := &FileStore{
+		path:      path,
+		peers:     make(map[string]map[string]Peer),
+		completed: make(map[string]int),
+	}
+
+	err := store.replay()
+	if err != nil {
+		return nil, err
+	}
+
+	// Start every run with a fresh log, which also gets rid of a half written record from a crash
+	err = store.compact()
+	if err != nil {
+		return nil, err
+	}
+	return store, nil
+}
+
+// replay applies every record in the log to the in-memory state
+func (s *FileStore) replay() error {
+	file, err := os.Open(s.path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("error opening tracker state: %v", err)
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for lineNumber := 1; scanner.Scan(); lineNumber++ {
+		var record storeRecord
+		err := json.Unmarshal(scanner.Bytes(), &record)
+		if err != nil {
+			// Only the last record can be torn by a crash, so skipping it loses at most one change
+			log.Printf("Skipping bad record on line %d of %s: %v", lineNumber, s.path, err)
+			continue
+		}
+		s.apply(record)
+	}
+	return scanner.Err()
+}
+
+// apply applies a record to the in-memory state
+func (s *FileStore) apply(record storeRecord) {
+	switch record.Op {
+	case "peer":
+		if s.peers[record.InfoHash] == nil {
+			s.peers[record.InfoHash] = make(map[string]Peer)
+		}
+		s.peers[record.InfoHash][string(record.PeerID)] = Peer{
+			PeerID:       string(record.PeerID),
+			Seeder:       record.Seeder,
+			IP:           record.IP,
+			Port:         record.Port,
+			LastAnnounce: record.LastAnnounce,
+			Uploaded:     record.Uploaded,
+			Downloaded:   record.Downloaded,
+			Left:         record.Left,
+		}
+	case "remove":
+		delete(s.peers[record.InfoHash], string(record.PeerID))
+		if len(s.peers[record.InfoHash]) == 0 {
+			delete(s.peers, record.InfoHash)
+		}
+	case "completed":
+		s.completed[record.InfoHash] = record.Completed
+	}
+}
+
+// append applies a record and writes it to the end of the log, compacting the log once it has grown too much
+func (s *FileStore) append(record storeRecord) error {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	if s.file == nil {
+		return fmt.Errorf("tracker state is closed")
+	}
+
+	s.apply(record)
+	err := writeRecord(s.file, record)
+	if err != nil {
+		return fmt.Errorf("error writing tracker state: %v", err)
+	}
+	s.records++
+
+	if s.records >= COMPACT_MIN_RECORDS && s.records >= COMPACT_RATIO*s.live() {
+		return s.compact()
+	}
+	return nil
+}
+
+// live counts the records a compacted log would have
+func (s *FileStore) live() int {
+	live := len(s.completed)
+	for _, peers := range s.peers {
+		live += len(peers)
+	}
+	return live
+}
+
+// compact writes the current state to a new log and swaps it in for the old one, the caller must hold s.mtx
+func (s *FileStore) compact() error {
+	tmpPath := s.path + ".tmp"
+	tmp, err := os.Create(tmpPath)
+	if err != nil {
+		return fmt.Errorf("error compacting tracker state: %v", err)
+	}
+
+	writer := bufio.NewWriter(tmp)
+	for infoHash, peers := range s.peers {
+		for _, peer := range peers {
+			err = writeRecord(writer, peerRecord(infoHash, peer))
+			if err != nil {
+				tmp.Close()
+				return fmt.Errorf("error compacting tracker state: %v", err)
+			}
+		}
+	}
+	for infoHash, completed := range s.completed {
+		err = writeRecord(writer, storeRecord{Op: "completed", InfoHash: infoHash, Completed: completed})
+		if err != nil {
+			tmp.Close()
+			return fmt.Errorf("error compacting tracker state: %v", err)
+		}
+	}
+
+	// The new log has to be on disk before it replaces the old one
+	err = writer.Flush()
+	if err == nil {
+		err = tmp.Sync()
+	}
+	tmp.Close()
+	if err != nil {
+		return fmt.Errorf("error compacting tracker state: %v", err)
+	}
+
+	if s.file != nil {
+		s.file.Close()
+		s.file = nil
+	}
+	err = os.Rename(tmpPath, s.path)
+	if err != nil {
+		return fmt.Errorf("error compacting tracker state: %v", err)
+	}
+
+	s.file, err = os.OpenFile(s.path, os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return fmt.Errorf("error opening tracker state: %v", err)
+	}
+	s.records = s.live()
+	return nil
+}
+
+func writeRecord(w io.Writer, record storeRecord) error {
+	line, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(append(line, '\n'))
+	return err
+}
+
+func peerRecord(infoHash string, peer Peer) storeRecord {
+	return storeRecord{
+		Op:           "peer",
+		InfoHash:     infoHash,
+		PeerID:       []byte(peer.PeerID),
+		Seeder:       peer.Seeder,
+		IP:           peer.IP,
+		Port:         peer.Port,
+		LastAnnounce: peer.LastAnnounce,
+		Uploaded:     peer.Uploaded,
+		Downloaded:   peer.Downloaded,
+		Left:         peer.Left,
+	}
+}
+
+func (s *FileStore) Load() (map[string][]Peer, map[string]int, error) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	peers := make(map[string][]Peer)
+	for infoHash, swarm := range s.peers {
+		for _, peer := range swarm {
+			peers[infoHash] = append(peers[infoHash], peer)
+		}
+	}
+	completed := make(map[string]int)
+	for infoHash, count := range s.completed {
+		completed[infoHash] = count
+	}
+	return peers, completed, nil
+}
+
+func (s *FileStore) SavePeer(infoHash string, peer Peer) error {
+	return s.append(peerRecord(infoHash, peer))
+}
+
+func (s *FileStore) RemovePeer(infoHash string, peerID string) error {
+	return s.append(storeRecord{Op: "remove", InfoHash: infoHash, PeerID: []byte(peerID)})
+}
+
+func (s *FileStore) SaveCompleted(infoHash string, completed int) error {
+	return s.append(storeRecord{Op: "completed", InfoHash: infoHash, Completed: completed})
+}
+
+// Close closes the log, the store can't be written to afterwards
+func (s *FileStore) Close() error {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	if s.file == nil {
+		return nil
+	}
+	err := s.file.Close()
+	s.file = nil
+	return err
+}
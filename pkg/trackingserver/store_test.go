@@ -0,0 +1,269 @@
+package trackingserver
+
+import (
+	"bytes"
+	"maps"
+	"os"
+	"path/filepath"
+	"reflect"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestFileStoreReplay(t *testing.T) {
+	announced := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	peerA := Peer{PeerID: "a\x00\xff", IP: "10.0.0.1", Port: 6881, LastAnnounce: announced, Left: 100}
+	peerB := Peer{PeerID: "b", IP: "10.0.0.2", Port: 6882, LastAnnounce: announced, Seeder: true, Uploaded: 7}
+
+	tests := []struct {
+		name          string
+		changes       func(store *FileStore)
+		torn          bool // Whether a half written record is left at the end of the log
+		wantPeers     map[string][]Peer
+		wantCompleted map[string]int
+	}{
+		{
+			name:          "nothing",
+			changes:       func(store *FileStore) {},
+			wantPeers:     map[string][]Peer{},
+			wantCompleted: map[string]int{},
+		},
+		{
+			name: "peers and counts",
+			changes: func(store *FileStore) {
+				store.SavePeer("h1", peerA)
+				store.SavePeer("h2", peerB)
+				store.SaveCompleted("h1", 1)
+				store.SaveCompleted("h1", 2)
+			},
+			wantPeers:     map[string][]Peer{"h1": {peerA}, "h2": {peerB}},
+			wantCompleted: map[string]int{"h1": 2},
+		},
+		{
+			name: "updated peer",
+			changes: func(store *FileStore) {
+				store.SavePeer("h1", peerA)
+				updated := peerA
+				updated.Left = 0
+				updated.Seeder = true
+				store.SavePeer("h1", updated)
+			},
+			wantPeers: map[string][]Peer{"h1": {{
+				PeerID: peerA.PeerID, IP: peerA.IP, Port: peerA.Port, LastAnnounce: announced, Seeder: true,
+			}}},
+			wantCompleted: map[string]int{},
+		},
+		{
+			name: "removed peers",
+			changes: func(store *FileStore) {
+				store.SavePeer("h1", peerA)
+				store.SavePeer("h1", peerB)
+				store.SavePeer("h2", peerA)
+				store.RemovePeer("h1", peerA.PeerID)
+				store.RemovePeer("h2", peerA.PeerID)
+				store.RemovePeer("h3", "unknown")
+			},
+			wantPeers:     map[string][]Peer{"h1": {peerB}},
+			wantCompleted: map[string]int{},
+		},
+		{
+			name: "torn last record",
+			changes: func(store *FileStore) {
+				store.SavePeer("h1", peerA)
+			},
+			torn:          true,
+			wantPeers:     map[string][]Peer{"h1": {peerA}},
+			wantCompleted: map[string]int{},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "state.log")
+			store, err := OpenFileStore(path)
+			if err != nil {
+				t.Fatalf("OpenFileStore() error = %v", err)
+			}
+			test.changes(store)
+			store.Close()
+
+			if test.torn {
+				file, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0644)
+				if err != nil {
+					t.Fatalf("error opening log: %v", err)
+				}
+				file.WriteString(`{"op":"peer","info_hash":"h1","peer_id":"Yg=`)
+				file.Close()
+			}
+
+			store, err = OpenFileStore(path)
+			if err != nil {
+				t.Fatalf("OpenFileStore() of the existing log error = %v", err)
+			}
+			defer store.Close()
+
+			peers, completed, err := store.Load()
+			if err != nil {
+				t.Fatalf("Load() error = %v", err)
+			}
+			if !reflect.DeepEqual(peers, test.wantPeers) {
+				t.Errorf("Load() peers = %+v, want %+v", peers, test.wantPeers)
+			}
+			if !reflect.DeepEqual(completed, test.wantCompleted) {
+				t.Errorf("Load() completed = %v, want %v", completed, test.wantCompleted)
+			}
+		})
+	}
+}
+
+func TestFileStoreCompaction(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "state.log")
+	store, err := OpenFileStore(path)
+	if err != nil {
+		t.Fatalf("OpenFileStore() error = %v", err)
+	}
+	defer store.Close()
+
+	// lines counts the records in the log
+	lines := func() int {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			t.Fatalf("error reading log: %v", err)
+		}
+		return bytes.Count(data, []byte("\n"))
+	}
+
+	// A single peer announcing over and over only ever needs one record
+	peer := Peer{PeerID: "a", IP: "10.0.0.1", Port: 6881}
+	for i := 0; i < COMPACT_MIN_RECORDS-1; i++ {
+		peer.Uploaded = int64(i)
+		store.SavePeer("h1", peer)
+	}
+	if got := lines(); got != COMPACT_MIN_RECORDS-1 {
+		t.Fatalf("log has %d records before compacting, want %d", got, COMPACT_MIN_RECORDS-1)
+	}
+
+	peer.Uploaded = COMPACT_MIN_RECORDS
+	store.SavePeer("h1", peer)
+	if got := lines(); got != 1 {
+		t.Errorf("log has %d records after compacting, want 1", got)
+	}
+
+	// The compacted log keeps taking changes
+	store.SaveCompleted("h1", 1)
+	if got := lines(); got != 2 {
+		t.Errorf("log has %d records after another change, want 2", got)
+	}
+	store.Close()
+
+	store, err = OpenFileStore(path)
+	if err != nil {
+		t.Fatalf("OpenFileStore() of the compacted log error = %v", err)
+	}
+	peers, completed, _ := store.Load()
+	wantPeers := map[string][]Peer{"h1": {peer}}
+	if !reflect.DeepEqual(peers, wantPeers) {
+		t.Errorf("Load() peers = %+v, want %+v", peers, wantPeers)
+	}
+	if completed["h1"] != 1 {
+		t.Errorf("Load() completed = %v, want 1 for h1", completed)
+	}
+}
+
+// sortedPeers lists every swarm's peers in peer_id order with the announce times left out, since they come back
+// from the log without their monotonic clock reading
+func sortedPeers(peers map[string][]Peer) map[string][]Peer {
+	sorted := make(map[string][]Peer)
+	for infoHash, swarm := range peers {
+		swarm = slices.Clone(swarm)
+		for i := range swarm {
+			swarm[i].LastAnnounce = time.Time{}
+		}
+		slices.SortFunc(swarm, func(a, b Peer) int { return strings.Compare(a.PeerID, b.PeerID) })
+		sorted[infoHash] = swarm
+	}
+	return sorted
+}
+
+func TestTrackerRestart(t *testing.T) {
+	const otherInfoHash = "89abcdef0123456789abcdef0123456789abcdef"
+	path := filepath.Join(t.TempDir(), "state.log")
+	store, err := OpenFileStore(path)
+	if err != nil {
+		t.Fatalf("OpenFileStore() error = %v", err)
+	}
+	tracker, err := NewTrackerWithStore(store)
+	if err != nil {
+		t.Fatalf("NewTrackerWithStore() error = %v", err)
+	}
+
+	addPeers(t, tracker, "leecher", 3, false)
+	addPeers(t, tracker, "seeder", 2, true)
+	announces := []*Announce{
+		{InfoHash: testInfoHash, PeerID: "leecher-1", IP: "10.0.0.2", Port: 6881, Event: COMPLETED, Left: 0, Downloaded: 100},
+		{InfoHash: testInfoHash, PeerID: "leecher-2", IP: "10.0.0.3", Port: 6881, Event: STOPPED, Left: 100},
+		{InfoHash: testInfoHash, PeerID: "stale", IP: "10.0.1.1", Port: 6881, Event: STARTED, Left: 100},
+		{InfoHash: otherInfoHash, PeerID: "stale", IP: "10.0.1.1", Port: 6881, Event: COMPLETED, Left: 0},
+	}
+	for _, announce := range announces {
+		_, err := tracker.announce(announce)
+		if err != nil {
+			t.Fatalf("announce() error = %v", err)
+		}
+	}
+
+	// The stale peer stops announcing while the tracker is down, and has timed out by the time it comes back
+	tracker.mtx.Lock()
+	for _, infoHash := range []string{testInfoHash, otherInfoHash} {
+		peer := tracker.peers[infoHash]["stale"]
+		peer.LastAnnounce = time.Now().Add(-TIMEOUT - time.Minute)
+		tracker.setPeer(infoHash, peer)
+		tracker.savePeer(infoHash, peer)
+	}
+	tracker.mtx.Unlock()
+
+	wantPeers := sortedPeers(tracker.GetPeers())
+	wantPeers[testInfoHash] = slices.DeleteFunc(wantPeers[testInfoHash], func(peer Peer) bool { return peer.PeerID == "stale" })
+	delete(wantPeers, otherInfoHash)
+	wantCompleted := map[string]int{testInfoHash: 1, otherInfoHash: 1}
+	store.Close()
+
+	store, err = OpenFileStore(path)
+	if err != nil {
+		t.Fatalf("OpenFileStore() after restarting error = %v", err)
+	}
+	restarted, err := NewTrackerWithStore(store)
+	if err != nil {
+		t.Fatalf("NewTrackerWithStore() after restarting error = %v", err)
+	}
+
+	if got := sortedPeers(restarted.GetPeers()); !reflect.DeepEqual(got, wantPeers) {
+		t.Errorf("peers after restarting = %+v, want %+v", got, wantPeers)
+	}
+	restarted.mtx.Lock()
+	completed := maps.Clone(restarted.completed)
+	restarted.mtx.Unlock()
+	if !reflect.DeepEqual(completed, wantCompleted) {
+		t.Errorf("completed after restarting = %v, want %v", completed, wantCompleted)
+	}
+	if seeders, leechers := restarted.counts(testInfoHash); seeders != 3 || leechers != 1 {
+		t.Errorf("counts() after restarting = %d seeders, %d leechers, want 3 and 1", seeders, leechers)
+	}
+
+	// The timed out peers are dropped from the log as well, so they don't come back on the next restart
+	store.Close()
+	store, err = OpenFileStore(path)
+	if err != nil {
+		t.Fatalf("OpenFileStore() after restarting twice error = %v", err)
+	}
+	defer store.Close()
+	peers, _, err := store.Load()
+	if err != nil {
+		t.Fatalf("Load() error = %v", err)
+	}
+	if got := sortedPeers(peers); !reflect.DeepEqual(got, wantPeers) {
+		t.Errorf("Load() after restarting = %+v, want %+v", got, wantPeers)
+	}
+}
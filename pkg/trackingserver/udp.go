@@ -0,0 +1,259 @@
+package trackingserver
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"net"
+	"sync"
+	"time"
+)
+
+// UDP tracker protocol (BEP 15). Clients connect first to get a connection ID, which proves that they really are
+// at the address the packets come from, and then send it with every announce and scrape.
+const (
+	UDP_PROTOCOL_ID = 0x41727101980 // The magic connection ID of a connect request
+
+	UDP_CONNECT  = 0
+	UDP_ANNOUNCE = 1
+	UDP_SCRAPE   = 2
+	UDP_ERROR    = 3
+
+	UDP_EVENT_NONE      = 0
+	UDP_EVENT_COMPLETED = 1
+	UDP_EVENT_STARTED   = 2
+	UDP_EVENT_STOPPED   = 3
+
+	UDP_CONNECTION_ID_TTL = 2 * time.Minute // Clients reuse a connection ID for a minute, so give them some slack
+	UDP_MAX_SCRAPE        = 74              // The most info_hashes a single scrape can ask about
+	UDP_MAX_PACKET        = 65507
+)
+
+// udpServer answers BEP 15 packets on behalf of a Tracker
+type udpServer struct {
+	tracker *Tracker
+	conn    net.PacketConn
+
+	mtx           sync.Mutex
+	connectionIDs map[uint64]udpConnection // Connection IDs we handed out
+}
+
+// udpConnection is the IP a connection ID was handed out to and until when it is good for.
+// Clients may send from a different port than they connected from, so only the IP has to match.
+type udpConnection struct {
+	ip      string
+	expires time.Time
+}
+
+// ListenUDP answers UDP tracker packets on port, sharing the same peers as the HTTP endpoint
+func (tracker *Tracker) ListenUDP(port int) {
+	conn, err := net.ListenPacket("udp", fmt.Sprintf(":%d", port))
+	if err != nil {
+		log.Fatalf("Error listening for UDP on port %d: %v", port, err)
+	}
+	defer conn.Close()
+
+	server := &udpServer{
+		tracker:       tracker,
+		conn:          conn,
+		connectionIDs: make(map[uint64]udpConnection),
+	}
+
+	log.Print("\r\033[K", "UDP Server Started, Listening on ", port)
+	fmt.Print("> ")
+
+	buf := make([]byte, UDP_MAX_PACKET)
+	for {
+		n, addr, err := conn.ReadFrom(buf)
+		if err != nil {
+			log.Println("Error reading UDP packet:", err)
+			continue
+		}
+
+		packet := make([]byte, n)
+		copy(packet, buf[:n])
+		go server.handlePacket(packet, addr)
+	}
+}
+
+// handlePacket answers a single packet. Every request starts with the connection ID, the action and the transaction ID.
+func (server *udpServer) handlePacket(packet []byte, addr net.Addr) {
+	if len(packet) < 16 {
+		return
+	}
+	connectionID := binary.BigEndian.Uint64(packet[0:8])
+	action := binary.BigEndian.Uint32(packet[8:12])
+	transactionID := packet[12:16]
+
+	if action == UDP_CONNECT {
+		if connectionID != UDP_PROTOCOL_ID {
+			return
+		}
+		server.handleConnect(transactionID, addr)
+		return
+	}
+
+	if !server.validConnection(connectionID, addr) {
+		server.sendError(transactionID, addr, "invalid connection id")
+		return
+	}
+
+	switch action {
+	case UDP_ANNOUNCE:
+		server.handleAnnounce(packet, transactionID, addr)
+	case UDP_SCRAPE:
+		server.handleScrape(packet, transactionID, addr)
+	default:
+		server.sendError(transactionID, addr, "unknown action")
+	}
+}
+
+// handleConnect hands out a new connection ID for the address the packet came from
+func (server *udpServer) handleConnect(transactionID []byte, addr net.Addr) {
+	idBytes := make([]byte, 8)
+	_, err := rand.Read(idBytes)
+	if err != nil {
+		log.Println("Error generating connection id:", err)
+		return
+	}
+	connectionID := binary.BigEndian.Uint64(idBytes)
+
+	server.mtx.Lock()
+	// Forget the connection IDs that ran out while we are here
+	for id, connection := range server.connectionIDs {
+		if time.Now().After(connection.expires) {
+			delete(server.connectionIDs, id)
+		}
+	}
+	server.connectionIDs[connectionID] = udpConnection{udpIP(addr), time.Now().Add(UDP_CONNECTION_ID_TTL)}
+	server.mtx.Unlock()
+
+	server.send(addr, UDP_CONNECT, transactionID, idBytes)
+}
+
+// validConnection checks that a connection ID was handed out to the IP of addr and hasn't run out
+func (server *udpServer) validConnection(connectionID uint64, addr net.Addr) bool {
+	server.mtx.Lock()
+	defer server.mtx.Unlock()
+
+	connection, ok := server.connectionIDs[connectionID]
+	return ok && connection.ip == udpIP(addr) && time.Now().Before(connection.expires)
+}
+
+func udpIP(addr net.Addr) string {
+	if udpAddr, ok := addr.(*net.UDPAddr); ok {
+		return udpAddr.IP.String()
+	}
+	return addr.String()
+}
+
+// handleAnnounce applies an announce to the peer store and sends back a sample of the swarm, 6 bytes for each IPv4 peer
+func (server *udpServer) handleAnnounce(packet []byte, transactionID []byte, addr net.Addr) {
+	// connection ID, action, transaction ID, info_hash, peer_id, downloaded, left, uploaded, event, IP, key, num_want, port
+	if len(packet) < 98 {
+		server.sendError(transactionID, addr, "announce too short")
+		return
+	}
+
+	event := NONE
+	switch binary.BigEndian.Uint32(packet[80:84]) {
+	case UDP_EVENT_STARTED:
+		event = STARTED
+	case UDP_EVENT_COMPLETED:
+		event = COMPLETED
+	case UDP_EVENT_STOPPED:
+		event = STOPPED
+	}
+
+	// Peers are always reached at the address the packet came from
+	// num_want is -1 when the client leaves it up to us
+	numWant := int(int32(binary.BigEndian.Uint32(packet[92:96])))
+	if numWant < 0 {
+		numWant = DEFAULT_NUMWANT
+	}
+
+	announce := Announce{
+		InfoHash:   hex.EncodeToString(packet[16:36]),
+		PeerID:     string(packet[36:56]),
+		IP:         udpIP(addr),
+		Port:       int(binary.BigEndian.Uint16(packet[96:98])),
+		Event:      event,
+		Downloaded: int64(binary.BigEndian.Uint64(packet[56:64])),
+		Left:       int64(binary.BigEndian.Uint64(packet[64:72])),
+		Uploaded:   int64(binary.BigEndian.Uint64(packet[72:80])),
+		NumWant:    min(numWant, MAX_NUMWANT),
+	}
+	if announce.Port == 0 {
+		server.sendError(transactionID, addr, "missing port")
+		return
+	}
+
+	fmt.Println("Received UDP Announce Message for InfoHash:", announce.InfoHash)
+	// BEP 15 has nowhere to put a passkey, so private trackers turn every UDP announce away here
+	peers, err := server.tracker.announce(&announce)
+	if err != nil {
+		server.sendError(transactionID, addr, err.Error())
+		return
+	}
+	seeders, leechers := server.tracker.counts(announce.InfoHash)
+
+	// interval, leechers, seeders and then the peers
+	body := make([]byte, 12, 12+6*len(peers))
+	binary.BigEndian.PutUint32(body[0:4], uint32(ANNOUNCE_INTERVAL.Seconds()))
+	binary.BigEndian.PutUint32(body[4:8], uint32(leechers))
+	binary.BigEndian.PutUint32(body[8:12], uint32(seeders))
+	for _, peer := range peers {
+		peerIP := net.ParseIP(peer.IP).To4()
+		if peerIP == nil {
+			continue
+		}
+		body = append(body, peerIP...)
+		body = binary.BigEndian.AppendUint16(body, uint16(peer.Port))
+	}
+
+	server.send(addr, UDP_ANNOUNCE, transactionID, body)
+}
+
+// handleScrape sends back the seeders, completed and leechers of every info_hash in the packet
+func (server *udpServer) handleScrape(packet []byte, transactionID []byte, addr net.Addr) {
+	if server.tracker.isPrivate() {
+		server.sendError(transactionID, addr, "private tracker, scrape over HTTP with your passkey")
+		return
+	}
+
+	infoHashes := packet[16:]
+	if len(infoHashes) == 0 || len(infoHashes)%20 != 0 || len(infoHashes)/20 > UDP_MAX_SCRAPE {
+		server.sendError(transactionID, addr, "invalid scrape")
+		return
+	}
+
+	server.tracker.countScrape("udp")
+	body := []byte{}
+	for i := 0; i < len(infoHashes); i += 20 {
+		scrape := server.tracker.scrape(hex.EncodeToString(infoHashes[i : i+20]))
+		body = binary.BigEndian.AppendUint32(body, uint32(scrape.Complete))
+		body = binary.BigEndian.AppendUint32(body, uint32(scrape.Downloaded))
+		body = binary.BigEndian.AppendUint32(body, uint32(scrape.Incomplete))
+	}
+
+	server.send(addr, UDP_SCRAPE, transactionID, body)
+}
+
+func (server *udpServer) sendError(transactionID []byte, addr net.Addr, message string) {
+	server.send(addr, UDP_ERROR, transactionID, []byte(message))
+}
+
+// send writes a response, which starts with the action and the transaction ID of the request
+func (server *udpServer) send(addr net.Addr, action uint32, transactionID []byte, body []byte) {
+	packet := make([]byte, 8, 8+len(body))
+	binary.BigEndian.PutUint32(packet[0:4], action)
+	copy(packet[4:8], transactionID)
+	packet = append(packet, body...)
+
+	_, err := server.conn.WriteTo(packet, addr)
+	if err != nil {
+		log.Println("Error sending UDP response:", err)
+	}
+}
@@ -0,0 +1,168 @@
+package trackingserver
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net"
+	"testing"
+	"time"
+)
+
+// udpRequest builds a request packet: connection ID, action, transaction ID and then the body
+func udpRequest(connectionID uint64, action uint32, body []byte) []byte {
+	packet := binary.BigEndian.AppendUint64(nil, connectionID)
+	packet = binary.BigEndian.AppendUint32(packet, action)
+	packet = append(packet, 0xde, 0xad, 0xbe, 0xef)
+	return append(packet, body...)
+}
+
+// udpAnnounceBody builds the body of an announce for an info_hash of twenty 0x01 bytes
+func udpAnnounceBody(peerID string, event uint32, left uint64, port uint16) []byte {
+	body := make([]byte, 82)
+	copy(body[0:20], bytes.Repeat([]byte{0x01}, 20))
+	copy(body[20:40], peerID)
+	binary.BigEndian.PutUint64(body[48:56], left)
+	binary.BigEndian.PutUint32(body[64:68], event)
+	binary.BigEndian.PutUint32(body[76:80], 0xFFFFFFFF)
+	binary.BigEndian.PutUint16(body[80:82], port)
+	return body
+}
+
+func TestUDPServerPackets(t *testing.T) {
+	serverConn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("error listening: %v", err)
+	}
+	defer serverConn.Close()
+	clientConn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("error listening: %v", err)
+	}
+	defer clientConn.Close()
+
+	tracker := NewTracker()
+	server := &udpServer{
+		tracker:       tracker,
+		conn:          serverConn,
+		connectionIDs: make(map[uint64]udpConnection),
+	}
+	addr := clientConn.LocalAddr()
+
+	// exchange hands the server a packet from the client and returns the response, nil if there was none
+	exchange := func(t *testing.T, packet []byte) []byte {
+		t.Helper()
+		server.handlePacket(packet, addr)
+		clientConn.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+		buf := make([]byte, UDP_MAX_PACKET)
+		n, _, err := clientConn.ReadFrom(buf)
+		if err != nil {
+			return nil
+		}
+		return buf[:n]
+	}
+
+	resp := exchange(t, udpRequest(UDP_PROTOCOL_ID, UDP_CONNECT, nil))
+	if len(resp) != 16 || binary.BigEndian.Uint32(resp[0:4]) != UDP_CONNECT {
+		t.Fatalf("connect response = %v, want a 16 byte connect", resp)
+	}
+	connectionID := binary.BigEndian.Uint64(resp[8:16])
+
+	tests := []struct {
+		name       string
+		packet     []byte
+		wantAction uint32
+		wantBody   []byte // Only checked if set
+		noResponse bool
+	}{
+		{
+			name:       "too short",
+			packet:     []byte{0, 0, 0, 0},
+			noResponse: true,
+		},
+		{
+			name:       "connect without the protocol ID",
+			packet:     udpRequest(12345, UDP_CONNECT, nil),
+			noResponse: true,
+		},
+		{
+			name:       "unknown connection ID",
+			packet:     udpRequest(connectionID+1, UDP_ANNOUNCE, udpAnnounceBody("a", UDP_EVENT_STARTED, 100, 6881)),
+			wantAction: UDP_ERROR,
+			wantBody:   []byte("invalid connection id"),
+		},
+		{
+			name:       "unknown action",
+			packet:     udpRequest(connectionID, 7, nil),
+			wantAction: UDP_ERROR,
+			wantBody:   []byte("unknown action"),
+		},
+		{
+			name:       "announce too short",
+			packet:     udpRequest(connectionID, UDP_ANNOUNCE, make([]byte, 10)),
+			wantAction: UDP_ERROR,
+		},
+		{
+			name:       "announce without a port",
+			packet:     udpRequest(connectionID, UDP_ANNOUNCE, udpAnnounceBody("a", UDP_EVENT_STARTED, 100, 0)),
+			wantAction: UDP_ERROR,
+			wantBody:   []byte("missing port"),
+		},
+		{
+			name:       "first announce",
+			packet:     udpRequest(connectionID, UDP_ANNOUNCE, udpAnnounceBody("a", UDP_EVENT_STARTED, 100, 6881)),
+			wantAction: UDP_ANNOUNCE,
+			wantBody:   []byte{0, 0, 0, 60, 0, 0, 0, 1, 0, 0, 0, 0},
+		},
+		{
+			name:       "second announce gets the first peer",
+			packet:     udpRequest(connectionID, UDP_ANNOUNCE, udpAnnounceBody("b", UDP_EVENT_STARTED, 0, 6882)),
+			wantAction: UDP_ANNOUNCE,
+			wantBody:   []byte{0, 0, 0, 60, 0, 0, 0, 1, 0, 0, 0, 1, 127, 0, 0, 1, 0x1a, 0xe1},
+		},
+		{
+			name:       "scrape",
+			packet:     udpRequest(connectionID, UDP_SCRAPE, bytes.Repeat([]byte{0x01}, 20)),
+			wantAction: UDP_SCRAPE,
+			wantBody:   []byte{0, 0, 0, 1, 0, 0, 0, 0, 0, 0, 0, 1},
+		},
+		{
+			name:       "scrape without info_hashes",
+			packet:     udpRequest(connectionID, UDP_SCRAPE, nil),
+			wantAction: UDP_ERROR,
+		},
+		{
+			name:       "scrape with a cut off info_hash",
+			packet:     udpRequest(connectionID, UDP_SCRAPE, make([]byte, 30)),
+			wantAction: UDP_ERROR,
+		},
+		{
+			name:       "scrape of too many torrents",
+			packet:     udpRequest(connectionID, UDP_SCRAPE, make([]byte, 20*(UDP_MAX_SCRAPE+1))),
+			wantAction: UDP_ERROR,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			resp := exchange(t, test.packet)
+			if test.noResponse {
+				if resp != nil {
+					t.Errorf("got response %v, want none", resp)
+				}
+				return
+			}
+			if len(resp) < 8 {
+				t.Fatalf("response = %v, want at least 8 bytes", resp)
+			}
+			if action := binary.BigEndian.Uint32(resp[0:4]); action != test.wantAction {
+				t.Errorf("action = %d, want %d (%q)", action, test.wantAction, resp[8:])
+			}
+			if !bytes.Equal(resp[4:8], []byte{0xde, 0xad, 0xbe, 0xef}) {
+				t.Errorf("transaction ID = %v, want the one from the request", resp[4:8])
+			}
+			if test.wantBody != nil && !bytes.Equal(resp[8:], test.wantBody) {
+				t.Errorf("body = %v, want %v", resp[8:], test.wantBody)
+			}
+		})
+	}
+}